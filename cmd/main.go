@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/grahamgilbert/crypt/pkg/authdb"
 	"github.com/grahamgilbert/crypt/pkg/authmechs"
 	"github.com/grahamgilbert/crypt/pkg/checkin"
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
 	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
 	"github.com/grahamgilbert/crypt/pkg/utils"
 )
 
@@ -16,6 +25,14 @@ var version = "development" // nolint:gochecknoglobals
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		if err := runProfile(os.Args[2:]); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if os.Geteuid() != 0 {
 		fmt.Println("Crypt must be run as root!")
 		os.Exit(1)
@@ -23,36 +40,121 @@ func main() {
 
 	install := flag.Bool("install", false, "Install the AuthDB mechanisms")
 	uninstall := flag.Bool("uninstall", false, "Uninstall the AuthDB mechanisms")
+	restoreAuthDB := flag.Bool("restore-authdb", false, "Restore system.login.console from the backup taken at the timestamp given as the argument, or the latest backup")
 	checkMechs := flag.Bool("check-auth-mechs", false, "Check the AuthDB mechanisms. Returns 0 if all are present, 1 if not.")
 	versionFlag := flag.Bool("version", false, "print the version")
+	watch := flag.Bool("watch", false, "Keep running, and escrow again when the preferences change")
+	keyHistory := flag.Bool("key-history", false, "List the recovery keys kept in the key history, without showing the keys")
+	migrateStorage := flag.Bool("migrate-storage", false, "Move the recovery key to the keychain or plist, following StoreRecoveryKeyInKeychain")
+	history := flag.Bool("history", false, "Print the escrow journal: when this Mac last escrowed and what has happened since")
+	authDBStatus := flag.Bool("authdb-status", false, "Print the times Crypt's mechanisms were found removed from system.login.console. Returns 1 if AuthMechsDriftThreshold is reached.")
+	format := flag.String("format", "", "Output format for -history and -authdb-status, table (the default) or json. -check-auth-mechs only prints a report when this is set.")
+	var overrides pref.OverrideFlag
+	flag.Var(&overrides, "set", "Override a preference for this run only, as Key=Value. May be repeated.")
 	flag.Parse()
 
-	p := pref.New()
+	envOverrides, err := pref.OverridesFromEnv(os.Environ())
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	p := pref.WithOverrides(pref.New(), append(envOverrides, overrides...))
 	r := utils.NewRunner()
 	if *versionFlag {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+
 	if *install {
-		err := authmechs.Run(r, true)
+		cfg := loadConfig(p, pref.LoadAuthMechs)
+		err := authmechs.Run(authdb.New(r), authmechs.SpecFromConfig(cfg), true)
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
 		}
 	} else if *uninstall {
-		err := authmechs.Run(r, false)
+		cfg := loadConfig(p, pref.LoadAuthMechs)
+		err := authmechs.Run(authdb.New(r), authmechs.SpecFromConfig(cfg), false)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else if *restoreAuthDB {
+		err := authmechs.Restore(authdb.New(r), flag.Arg(0))
 		if err != nil {
 			log.Println(err)
+			printBackups(os.Stdout, authdb.New(r))
 			os.Exit(1)
 		}
 	} else if *checkMechs {
-		err := authmechs.Check(r)
+		cfg := loadConfig(p, pref.LoadAuthMechs)
+		report, err := authmechs.Check(authdb.New(r), authmechs.SpecFromConfig(cfg))
+		if *format != "" && report.Mechanisms != nil {
+			if printErr := printReport(os.Stdout, report, *format); printErr != nil {
+				log.Println(printErr)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else if *keyHistory {
+		cfg := loadConfig(p, pref.Load)
+		entries, err := keyhistory.New(utils.NewKeychainSecretStore(), cfg.KeyHistoryLimit).Entries()
+		if err == nil {
+			err = keyhistory.PrintEntries(os.Stdout, entries)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else if *migrateStorage {
+		cfg := loadConfig(p, pref.Load)
+		err := checkin.MigrateStorage(r, cfg, state.New(state.DefaultPath), utils.NewKeychainSecretStore())
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else if *history {
+		if err := printHistory(os.Stdout, journal.New(journal.DefaultPath), *format); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else if *authDBStatus {
+		cfg := loadConfig(p, pref.LoadAuthMechs)
+		status, err := checkin.GetDriftStatus(state.New(state.DefaultPath), cfg, time.Now())
+		if err == nil {
+			err = printDriftStatus(os.Stdout, status, *format)
+		}
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
 		}
+		if status.Failing {
+			os.Exit(1)
+		}
+	} else if *watch {
+		cfg := loadConfig(p, pref.Load)
+		st := state.New(state.DefaultPath)
+		secrets := utils.NewKeychainSecretStore()
+		j := journal.New(journal.DefaultPath)
+		err := checkin.RunEscrow(r, p, cfg, st, secrets, j)
+		if err != nil {
+			log.Println(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		log.Println("Watching for preference changes")
+		pref.NewWatcher(p).Watch(ctx, cfg, func(old, next pref.Config) {
+			reconfigure(r, p, st, secrets, j, old, next)
+		})
+		stop()
 	} else {
-		err := checkin.RunEscrow(r, p)
+		cfg := loadConfig(p, pref.Load)
+		st := state.New(state.DefaultPath)
+		secrets := utils.NewKeychainSecretStore()
+		err := checkin.RunEscrow(r, p, cfg, st, secrets, journal.New(journal.DefaultPath))
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
@@ -61,3 +163,83 @@ func main() {
 
 	os.Exit(0)
 }
+
+// loadConfig loads the preferences a mode needs with load, exiting if they
+// can't be read or are invalid. Modes that don't use the preferences don't
+// load them, so a bad setting can't stop them running.
+func loadConfig(p pref.PrefInterface, load func(pref.PrefInterface) (pref.Config, error)) pref.Config {
+	cfg, err := load(p)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// reconfigure applies a changed configuration while running with -watch.
+func reconfigure(r utils.Runner, p pref.PrefInterface, st *state.Store, secrets utils.SecretStore, j *journal.Journal, old, cfg pref.Config) {
+	if cfg.ManageAuthMechs && !old.ManageAuthMechs {
+		log.Println("ManageAuthMechs was enabled, checking the AuthDB mechanisms")
+		if err := checkin.EnsureAuthMechs(r, cfg, st); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if err := checkin.RunEscrow(r, p, cfg, st, secrets, j); err != nil {
+		log.Println(err)
+	}
+}
+
+// printBackups writes the timestamps of the system.login.console backups to w,
+// so a failed restore shows what can be restored.
+func printBackups(w io.Writer, c *authdb.Client) {
+	backups, err := c.ListBackups(authmechs.RightName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(backups) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Available backups:")
+	for _, b := range backups {
+		fmt.Fprintln(w, b.Timestamp)
+	}
+}
+
+// printReport writes the -check-auth-mechs report to w in the given format.
+func printReport(w io.Writer, report authmechs.Report, format string) error {
+	switch format {
+	case "", "table":
+		return report.Print(w)
+	case "json":
+		return report.PrintJSON(w)
+	}
+	return fmt.Errorf("unknown format %q, expected table or json", format)
+}
+
+// printDriftStatus writes the -authdb-status output to w in the given format.
+func printDriftStatus(w io.Writer, status checkin.DriftStatus, format string) error {
+	switch format {
+	case "", "table":
+		return status.Print(w)
+	case "json":
+		return status.PrintJSON(w)
+	}
+	return fmt.Errorf("unknown format %q, expected table or json", format)
+}
+
+// printHistory writes the entries in j to w in the given format.
+func printHistory(w io.Writer, j *journal.Journal, format string) error {
+	entries, err := j.Entries()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "table":
+		return journal.PrintTable(w, entries)
+	case "json":
+		return journal.PrintJSON(w, entries)
+	}
+	return fmt.Errorf("unknown format %q, expected table or json", format)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/grahamgilbert/crypt/pkg/profile"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// runProfile handles the profile subcommand. The only action is generate,
+// which writes a configuration profile for the preferences given as flags.
+func runProfile(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return errors.New("usage: checkin profile generate [flags]")
+	}
+
+	opts := profile.Options{Values: map[string]interface{}{}}
+	fs := flag.NewFlagSet("checkin profile generate", flag.ExitOnError)
+	fs.StringVar(&opts.Organization, "organization", "", "PayloadOrganization of the profile")
+	fs.StringVar(&opts.DisplayName, "display-name", "Crypt Settings", "PayloadDisplayName of the profile")
+	fs.StringVar(&opts.Description, "description", "", "PayloadDescription of the profile")
+	fs.StringVar(&opts.Identifier, "identifier", profile.DefaultIdentifier, "PayloadIdentifier of the profile")
+	fs.BoolVar(&opts.RemovalDisallowed, "removal-disallowed", false, "prevent users from removing the profile")
+	output := fs.String("output", "", "path to write the profile to, instead of stdout")
+	signCert := fs.String("sign-cert", "", "PEM certificate to sign the profile with")
+	signKey := fs.String("sign-key", "", "PEM private key for -sign-cert")
+	profile.RegisterFlags(fs, opts.Values)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	data, err := profile.Generate(opts)
+	if err != nil {
+		return err
+	}
+
+	if *signCert != "" || *signKey != "" {
+		if *signCert == "" || *signKey == "" {
+			return errors.New("-sign-cert and -sign-key must be used together")
+		}
+		data, err = profile.Sign(utils.NewRunner(), data, *signCert, *signKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return errors.Wrap(err, "failed to write profile")
+	}
+	return errors.Wrap(os.WriteFile(*output, data, 0644), "failed to write profile")
+}
@@ -0,0 +1,135 @@
+// Package authdb reads and writes rights in the macOS authorization database
+// through `security authorizationdb`, backing up every right before it is
+// written.
+package authdb
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// Client reads and writes rights in the authorization database.
+type Client struct {
+	Runner utils.Runner
+	// BackupDir is where a right is backed up before it is written.
+	BackupDir string
+	// BackupLimit is how many backups are kept of each right.
+	BackupLimit int
+}
+
+// New returns a Client that keeps its backups in DefaultBackupDir.
+func New(r utils.Runner) *Client {
+	return &Client{Runner: r, BackupDir: DefaultBackupDir, BackupLimit: DefaultBackupLimit}
+}
+
+// readRaw returns the right called name as printed by security.
+func (c *Client) readRaw(name string) ([]byte, error) {
+	out, err := c.Runner.Runner.RunCmd("/usr/bin/security", "authorizationdb", "read", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read right %s", name)
+	}
+	return out, nil
+}
+
+// Read returns the right called name.
+func (c *Client) Read(name string) (Right, error) {
+	data, err := c.readRaw(name)
+	if err != nil {
+		return Right{}, err
+	}
+	return Parse(name, data)
+}
+
+// ErrConflict is returned when a right was changed by another process between
+// being read and written.
+var ErrConflict = errors.New("right was changed since it was read")
+
+// updateAttempts is how many times Update reads and edits a right that keeps
+// changing before it gives up.
+const updateAttempts = 3
+
+// Write backs up the right as it is now, then replaces it with right. Nothing
+// is written if the backup fails.
+func (c *Client) Write(right Right) error {
+	current, err := c.readRaw(right.Name)
+	if err != nil {
+		return err
+	}
+	return c.write(right, current)
+}
+
+// WriteIfUnchanged is Write, but only if the right in the database is still
+// exactly as it was when right was read. Otherwise it returns ErrConflict and
+// writes nothing. security can't write conditionally, so this narrows the
+// window in which another process's change can be lost rather than closing it.
+func (c *Client) WriteIfUnchanged(right Right) error {
+	if right.raw == nil {
+		return errors.New("right was not read from the authorization database")
+	}
+	current, err := c.readRaw(right.Name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, right.raw) {
+		return errors.Wrap(ErrConflict, right.Name)
+	}
+	return c.write(right, current)
+}
+
+// Update reads the right called name, edits it and writes it back with
+// WriteIfUnchanged. If the right changes in between, the edit is made again
+// on the right as it is now, up to updateAttempts times. edit must return the
+// right it was given, changed, and is not run again if it fails.
+func (c *Client) Update(name string, edit func(Right) (Right, error)) (Right, error) {
+	var err error
+	for attempt := 1; attempt <= updateAttempts; attempt++ {
+		var right Right
+		right, err = c.Read(name)
+		if err != nil {
+			return Right{}, err
+		}
+		right, err = edit(right)
+		if err != nil {
+			return Right{}, err
+		}
+		err = c.WriteIfUnchanged(right)
+		if err == nil {
+			return right, nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return Right{}, err
+		}
+		log.Printf("%s changed while it was being edited, trying again (attempt %d of %d)", name, attempt, updateAttempts)
+	}
+	return Right{}, errors.Wrapf(err, "gave up after %d attempts", updateAttempts)
+}
+
+// write backs up current, the right as it is in the database, then replaces
+// it with right.
+func (c *Client) write(right Right, current []byte) error {
+	data, err := right.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := c.backup(right.Name, current); err != nil {
+		return err
+	}
+
+	if _, err := c.Runner.Runner.RunCmdWithStdin("/usr/bin/security", string(data), "authorizationdb", "write", right.Name); err != nil {
+		return errors.Wrapf(err, "failed to write right %s", right.Name)
+	}
+	return nil
+}
+
+// Verify reads want's right back and returns how it differs from want,
+// ignoring the keys the authorization database updates on every write.
+func (c *Client) Verify(want Right) ([]Change, error) {
+	got, err := c.Read(want.Name)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(want, got, bookkeepingKeys...)
+}
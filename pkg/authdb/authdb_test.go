@@ -0,0 +1,219 @@
+package authdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/grahamgilbert/crypt/pkg/authdb/authdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	loginConsole     = "system.login.console"
+	securitySettings = "system.preferences.security"
+)
+
+func readTestdata(t *testing.T, file string) string {
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func newFake(t *testing.T) *authdbtest.Fake {
+	return authdbtest.New(map[string]string{
+		loginConsole:     readTestdata(t, "sequoia_custom_rules.plist"),
+		securitySettings: readTestdata(t, "system_preferences_security.plist"),
+	})
+}
+
+func TestClientRead(t *testing.T) {
+	c := newFake(t).Client(t)
+
+	right, err := c.Read(securitySettings)
+	require.NoError(t, err)
+	assert.Equal(t, securitySettings, right.Name)
+	assert.False(t, right.HasMechanisms())
+	values, err := right.Values()
+	require.NoError(t, err)
+	assert.Equal(t, "admin", values["group"])
+
+	right, err = c.Read(loginConsole)
+	require.NoError(t, err)
+	assert.Contains(t, right.Mechanisms, "VendorAuth:login,privileged")
+
+	_, err = c.Read("system.missing")
+	assert.Error(t, err)
+}
+
+func TestClientWrite(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+
+	right, err := c.Read(loginConsole)
+	require.NoError(t, err)
+	right.Mechanisms = right.Mechanisms[1:]
+	require.NoError(t, c.Write(right))
+	assert.Equal(t, 1, fake.Writes[loginConsole])
+	assert.Zero(t, fake.Writes[securitySettings])
+
+	changes, err := c.Verify(right)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// the right as it was before the write is backed up
+	backups, err := c.ListBackups(loginConsole)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, loginConsole, backups[0].Right)
+	data, err := os.ReadFile(backups[0].Path)
+	require.NoError(t, err)
+	assert.Equal(t, readTestdata(t, "sequoia_custom_rules.plist"), string(data))
+
+	backups, err = c.ListBackups(securitySettings)
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+}
+
+func TestClientVerify(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	right, err := c.Read(securitySettings)
+	require.NoError(t, err)
+
+	// the authorization database bumps the version and modified time
+	fake.AfterWrite = func(name string, right string) string {
+		right = strings.Replace(right, "<integer>1</integer>", "<integer>2</integer>", 1)
+		return strings.Replace(right, "<real>756225017.73891997</real>\n\t<key>shared</key>", "<real>756225999.5</real>\n\t<key>shared</key>", 1)
+	}
+	require.NoError(t, c.Write(right))
+	changes, err := c.Verify(right)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// another process changes the group
+	fake.AfterWrite = func(name string, right string) string {
+		return strings.Replace(right, "<string>admin</string>", "<string>staff</string>", 1)
+	}
+	require.NoError(t, c.Write(right))
+	changes, err = c.Verify(right)
+	require.NoError(t, err)
+	assert.Equal(t, []authdb.Change{{Key: "group", Old: "admin", New: "staff"}}, changes)
+}
+
+func TestDiff(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	a, err := c.Read(loginConsole)
+	require.NoError(t, err)
+
+	changes, err := authdb.Diff(a, a)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	b := a
+	b.Mechanisms = append([]string{"Test:Mech"}, a.Mechanisms...)
+	changes, err = authdb.Diff(a, b)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "mechanisms", changes[0].Key)
+	assert.True(t, strings.HasPrefix(changes[0].String(), "~mechanisms: "))
+
+	changes, err = authdb.Diff(a, b, "mechanisms")
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// keys only one right has
+	fake.Rights["test"] = "<plist><dict><key>shared</key><true/><key>group</key><string>admin</string></dict></plist>"
+	x, err := c.Read("test")
+	require.NoError(t, err)
+	fake.Rights["test"] = "<plist><dict><key>shared</key><true/><key>tries</key><integer>3</integer></dict></plist>"
+	y, err := c.Read("test")
+	require.NoError(t, err)
+	changes, err = authdb.Diff(x, y)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "-group: admin", changes[0].String())
+	assert.Equal(t, "tries", changes[1].Key)
+	assert.Nil(t, changes[1].Old)
+}
+
+func TestClientWriteIfUnchanged(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	right, err := c.Read(loginConsole)
+	require.NoError(t, err)
+
+	// another process edits the right after it was read
+	changed := strings.Replace(fake.Rights[loginConsole], "<integer>10000</integer>", "<integer>3</integer>", 1)
+	fake.Rights[loginConsole] = changed
+	right.Mechanisms = right.Mechanisms[1:]
+	err = c.WriteIfUnchanged(right)
+	assert.True(t, errors.Is(err, authdb.ErrConflict))
+	assert.Zero(t, fake.Writes[loginConsole])
+	assert.Equal(t, changed, fake.Rights[loginConsole])
+
+	right, err = c.Read(loginConsole)
+	require.NoError(t, err)
+	right.Mechanisms = right.Mechanisms[1:]
+	require.NoError(t, c.WriteIfUnchanged(right))
+	assert.Equal(t, 1, fake.Writes[loginConsole])
+
+	assert.Error(t, c.WriteIfUnchanged(authdb.Right{Name: loginConsole}))
+}
+
+func TestClientUpdate(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	// another process changes tries between the first read and the write
+	fake.AfterRead = func(name string, reads int) {
+		if reads == 1 {
+			fake.Rights[name] = strings.Replace(fake.Rights[name], "<integer>10000</integer>", "<integer>3</integer>", 1)
+		}
+	}
+
+	edits := 0
+	right, err := c.Update(loginConsole, func(right authdb.Right) (authdb.Right, error) {
+		edits++
+		right.Mechanisms = append(right.Mechanisms, "Test:Mech")
+		return right, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, edits)
+	assert.Equal(t, 1, fake.Writes[loginConsole])
+
+	// both changes are kept
+	got, err := c.Read(loginConsole)
+	require.NoError(t, err)
+	assert.Equal(t, right.Mechanisms, got.Mechanisms)
+	values, err := got.Values()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, values["tries"])
+}
+
+func TestClientUpdateGivesUp(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	// the right changes after every read
+	fake.AfterRead = func(name string, reads int) {
+		fake.Rights[name] += " "
+	}
+
+	_, err := c.Update(securitySettings, func(right authdb.Right) (authdb.Right, error) {
+		return right, nil
+	})
+	assert.True(t, errors.Is(err, authdb.ErrConflict))
+	assert.Zero(t, fake.Writes[securitySettings])
+
+	fake.AfterRead = nil
+	editErr := errors.New("edit failed")
+	_, err = c.Update(securitySettings, func(right authdb.Right) (authdb.Right, error) {
+		return authdb.Right{}, editErr
+	})
+	assert.True(t, errors.Is(err, editErr))
+	assert.Zero(t, fake.Writes[securitySettings])
+}
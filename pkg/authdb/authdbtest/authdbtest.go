@@ -0,0 +1,74 @@
+// Package authdbtest provides an in-memory authorization database for tests
+// of code that reads and writes rights through authdb.
+package authdbtest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// Fake stands in for `security authorizationdb`, keeping each right as it was
+// last written.
+type Fake struct {
+	Rights map[string]string
+	// Reads and Writes count the reads and writes of each right.
+	Reads  map[string]int
+	Writes map[string]int
+	// AfterRead, if set, is run after every read with the number of times the
+	// right has been read, to act as another process editing the right
+	// between reads.
+	AfterRead func(name string, reads int)
+	// AfterWrite, if set, is run after every write and its result stored in
+	// place of what was written, to act as another process editing the right.
+	AfterWrite func(name string, right string) string
+}
+
+// New returns a Fake holding rights, keyed by name.
+func New(rights map[string]string) *Fake {
+	f := &Fake{Rights: map[string]string{}, Reads: map[string]int{}, Writes: map[string]int{}}
+	for name, right := range rights {
+		f.Rights[name] = right
+	}
+	return f
+}
+
+// Client returns an authdb.Client backed by f that keeps its backups in a
+// temporary directory removed when t ends.
+func (f *Fake) Client(t testing.TB) *authdb.Client {
+	return &authdb.Client{
+		Runner:      utils.Runner{Runner: f},
+		BackupDir:   filepath.Join(t.TempDir(), "authdb"),
+		BackupLimit: authdb.DefaultBackupLimit,
+	}
+}
+
+func (f *Fake) RunCmd(name string, arg ...string) ([]byte, error) {
+	if name != "/usr/bin/security" || len(arg) != 3 || arg[0] != "authorizationdb" || arg[1] != "read" {
+		return nil, errors.Errorf("unexpected command %s %v", name, arg)
+	}
+	right, ok := f.Rights[arg[2]]
+	if !ok {
+		return nil, errors.Errorf("no right named %s", arg[2])
+	}
+	f.Reads[arg[2]]++
+	if f.AfterRead != nil {
+		f.AfterRead(arg[2], f.Reads[arg[2]])
+	}
+	return []byte(right), nil
+}
+
+func (f *Fake) RunCmdWithStdin(name string, stdin string, arg ...string) ([]byte, error) {
+	if name != "/usr/bin/security" || len(arg) != 3 || arg[0] != "authorizationdb" || arg[1] != "write" {
+		return nil, errors.Errorf("unexpected command %s %v", name, arg)
+	}
+	f.Writes[arg[2]]++
+	f.Rights[arg[2]] = stdin
+	if f.AfterWrite != nil {
+		f.Rights[arg[2]] = f.AfterWrite(arg[2], stdin)
+	}
+	return nil, nil
+}
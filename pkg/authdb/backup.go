@@ -0,0 +1,148 @@
+package authdb
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBackupDir is where a copy of a right is kept before every
+	// write. Only root can read it.
+	DefaultBackupDir = "/var/db/crypt/authdb"
+	// DefaultBackupLimit is how many backups are kept of each right.
+	DefaultBackupLimit = 10
+
+	// BackupTimeFormat is the format of backup timestamps, which are in UTC.
+	BackupTimeFormat = "20060102T150405Z"
+
+	backupSuffix = ".plist"
+)
+
+// ErrNoBackup is returned when there is no backup to restore.
+var ErrNoBackup = errors.New("no backup found")
+
+// Backup is a copy of a right taken before it was written.
+type Backup struct {
+	Right string
+	// Timestamp is when the backup was taken, in BackupTimeFormat.
+	Timestamp string
+	Time      time.Time
+	Path      string
+}
+
+// backup saves data, the right called name as read before a write, to the
+// backup directory and removes the oldest backups of it over the limit. A
+// right already backed up within the same second is kept, as it is the older
+// state.
+func (c *Client) backup(name string, data []byte) error {
+	if err := os.MkdirAll(c.BackupDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create backup directory")
+	}
+
+	timestamp := time.Now().UTC().Format(BackupTimeFormat)
+	path := filepath.Join(c.BackupDir, name+"."+timestamp+backupSuffix)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := utils.WriteFileAtomic(path, data, 0600); err != nil {
+			return errors.Wrapf(err, "failed to back up %s", name)
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "failed to check for backup")
+	}
+
+	backups, err := c.ListBackups(name)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(backups)-c.BackupLimit; i++ {
+		if err := os.Remove(backups[i].Path); err != nil {
+			return errors.Wrap(err, "failed to remove old backup")
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the backups of the right called name, oldest first.
+func (c *Client) ListBackups(name string) ([]Backup, error) {
+	entries, err := os.ReadDir(c.BackupDir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read backup directory")
+	}
+
+	prefix := name + "."
+	backups := []Backup{}
+	for _, entry := range entries {
+		file := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(file, prefix) || !strings.HasSuffix(file, backupSuffix) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(file, prefix), backupSuffix)
+		t, err := time.Parse(BackupTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Right: name, Timestamp: timestamp, Time: t, Path: filepath.Join(c.BackupDir, file)})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.Before(backups[j].Time) })
+	return backups, nil
+}
+
+// Restore writes a backup of the right called name back to the authorization
+// database and checks it took. An empty timestamp restores the latest backup.
+func (c *Client) Restore(name string, timestamp string) error {
+	backup, err := c.findBackup(name, timestamp)
+	if err != nil {
+		return err
+	}
+	data, err := utils.ReadFileSecure(backup.Path, os.Geteuid())
+	if err != nil {
+		return errors.Wrap(err, "failed to read backup")
+	}
+	want, err := Parse(name, data)
+	if err != nil {
+		return errors.Wrapf(err, "backup %s is not a valid right", backup.Timestamp)
+	}
+
+	log.Printf("Restoring %s from backup %s", name, backup.Timestamp)
+	if err := c.Write(want); err != nil {
+		return err
+	}
+
+	changes, err := c.Verify(want)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return errors.Errorf("%s does not match backup %s after restoring it: %v", name, backup.Timestamp, changes)
+	}
+	return nil
+}
+
+// findBackup returns the backup of the right called name taken at timestamp,
+// or the latest if timestamp is empty.
+func (c *Client) findBackup(name string, timestamp string) (Backup, error) {
+	backups, err := c.ListBackups(name)
+	if err != nil {
+		return Backup{}, err
+	}
+	if len(backups) == 0 {
+		return Backup{}, errors.Wrap(ErrNoBackup, name)
+	}
+	if timestamp == "" {
+		return backups[len(backups)-1], nil
+	}
+	for _, backup := range backups {
+		if backup.Timestamp == timestamp {
+			return backup, nil
+		}
+	}
+	return Backup{}, errors.Wrapf(ErrNoBackup, "%s at %s", name, timestamp)
+}
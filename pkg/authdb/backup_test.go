@@ -0,0 +1,100 @@
+package authdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	c.BackupLimit = 3
+
+	require.NoError(t, os.MkdirAll(c.BackupDir, 0700))
+	old := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		name := loginConsole + "." + old.Add(time.Duration(i)*time.Minute).Format(authdb.BackupTimeFormat) + ".plist"
+		require.NoError(t, os.WriteFile(filepath.Join(c.BackupDir, name), []byte("old"), 0600))
+	}
+	// not a backup, left alone
+	require.NoError(t, os.WriteFile(filepath.Join(c.BackupDir, "notes.txt"), []byte("notes"), 0600))
+	// a backup of another right, which has its own limit
+	other := securitySettings + "." + old.Format(authdb.BackupTimeFormat) + ".plist"
+	require.NoError(t, os.WriteFile(filepath.Join(c.BackupDir, other), []byte("other"), 0600))
+
+	current := fake.Rights[loginConsole]
+	right, err := c.Read(loginConsole)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(right))
+
+	backups, err := c.ListBackups(loginConsole)
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	assert.Equal(t, old.Add(time.Minute).Format(authdb.BackupTimeFormat), backups[0].Timestamp)
+
+	latest := backups[2]
+	data, err := os.ReadFile(latest.Path)
+	require.NoError(t, err)
+	assert.Equal(t, current, string(data))
+	info, err := os.Stat(latest.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(c.BackupDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	assert.FileExists(t, filepath.Join(c.BackupDir, "notes.txt"))
+	assert.FileExists(t, filepath.Join(c.BackupDir, other))
+
+	// a second write in the same second keeps the first backup
+	fake.Rights[loginConsole] = readTestdata(t, "system_preferences_security.plist")
+	require.NoError(t, c.Write(right))
+	data, err = os.ReadFile(latest.Path)
+	require.NoError(t, err)
+	assert.Equal(t, current, string(data))
+}
+
+func TestRestore(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	original := fake.Rights[securitySettings]
+
+	assert.True(t, errors.Is(c.Restore(securitySettings, ""), authdb.ErrNoBackup))
+
+	// another tool rewrites the right, after Crypt backed it up
+	right, err := c.Read(securitySettings)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(right))
+	fake.Rights[securitySettings] = "<plist><dict><key>class</key><string>allow</string></dict></plist>"
+	backups, err := c.ListBackups(securitySettings)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+
+	assert.True(t, errors.Is(c.Restore(securitySettings, "20000101T000000Z"), authdb.ErrNoBackup))
+
+	require.NoError(t, c.Restore(securitySettings, backups[0].Timestamp))
+	assert.Equal(t, original, fake.Rights[securitySettings])
+}
+
+func TestRestoreNotApplied(t *testing.T) {
+	fake := newFake(t)
+	c := fake.Client(t)
+	right, err := c.Read(loginConsole)
+	require.NoError(t, err)
+	right.Mechanisms = right.Mechanisms[1:]
+	require.NoError(t, c.Write(right))
+
+	// the write does not take
+	edited := fake.Rights[loginConsole]
+	fake.AfterWrite = func(string, string) string { return edited }
+
+	err = c.Restore(loginConsole, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match backup")
+}
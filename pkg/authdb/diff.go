@@ -0,0 +1,77 @@
+package authdb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/groob/plist"
+	"github.com/pkg/errors"
+)
+
+// bookkeepingKeys are set by the authorization database itself when a right
+// is written, so they are ignored when checking a write took.
+var bookkeepingKeys = []string{"created", "modified", "version"} // nolint:gochecknoglobals
+
+// Change is a top-level key that differs between two rights. Old is nil if
+// the key was added, and New is nil if it was removed.
+type Change struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("+%s: %v", c.Key, c.New)
+	case c.New == nil:
+		return fmt.Sprintf("-%s: %v", c.Key, c.Old)
+	}
+	return fmt.Sprintf("~%s: %v -> %v", c.Key, c.Old, c.New)
+}
+
+// Values decodes the right into its top-level keys, with the mechanisms as
+// they are now rather than as they were read.
+func (db Right) Values() (map[string]interface{}, error) {
+	data, err := db.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := plist.Unmarshal(data, &values); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode right %s", db.Name)
+	}
+	return values, nil
+}
+
+// Diff returns the top-level keys that differ from a to b, sorted by key.
+// Keys in ignore are not compared.
+func Diff(a, b Right, ignore ...string) ([]Change, error) {
+	before, err := a.Values()
+	if err != nil {
+		return nil, err
+	}
+	after, err := b.Values()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range ignore {
+		delete(before, key)
+		delete(after, key)
+	}
+
+	changes := []Change{}
+	for key, old := range before {
+		if value, ok := after[key]; !ok || !reflect.DeepEqual(old, value) {
+			changes = append(changes, Change{Key: key, Old: old, New: after[key]})
+		}
+	}
+	for key, value := range after {
+		if _, ok := before[key]; !ok {
+			changes = append(changes, Change{Key: key, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
@@ -0,0 +1,170 @@
+package authdb
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Right is a right read from the authorization database. Only the mechanisms
+// are parsed, the rest of the right is kept as security printed it so writing
+// it back never drops or rewrites a key.
+type Right struct {
+	Name string
+	// Mechanisms is nil if the right has no mechanisms array, as with rules
+	// such as system.preferences.security.
+	Mechanisms []string
+
+	// raw is the right as read, and parsed the mechanisms it held.
+	raw    []byte
+	parsed []string
+	// mechStart and mechEnd are the offsets of the mechanisms array in raw,
+	// and itemStart of its first string, or -1 if it was empty.
+	mechStart int
+	mechEnd   int
+	itemStart int
+}
+
+// Parse reads the right called name from data, as printed by
+// `security authorizationdb read`. The right is kept as it was printed, so
+// keys that are not modelled here, such as rule, k-of-n or vendor keys, are
+// written back exactly as they were read.
+func Parse(name string, data []byte) (Right, error) {
+	db := Right{Name: name, raw: data, mechStart: -1, itemStart: -1}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	depth := 0
+	lastKey := ""
+	var text bytes.Buffer
+	inKey, inMechs, inString, inDict := false, false, false, false
+
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Right{}, errors.Wrap(err, "failed to parse right")
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1 && t.Name.Local != "plist":
+				return Right{}, errors.Errorf("right is not a property list, found <%s>", t.Name.Local)
+			case depth == 2 && t.Name.Local != "dict":
+				return Right{}, errors.Errorf("right is not a dictionary, found <%s>", t.Name.Local)
+			case depth == 2:
+				inDict = true
+			case depth == 3 && t.Name.Local == "key":
+				inKey = true
+				text.Reset()
+			case depth == 3 && lastKey == "mechanisms":
+				if t.Name.Local != "array" {
+					return Right{}, errors.Errorf("mechanisms is not an array, found <%s>", t.Name.Local)
+				}
+				inMechs = true
+				db.mechStart = offset
+				db.Mechanisms = []string{}
+			case depth == 4 && inMechs:
+				if t.Name.Local != "string" {
+					return Right{}, errors.Errorf("mechanism is not a string, found <%s>", t.Name.Local)
+				}
+				inString = true
+				text.Reset()
+				if db.itemStart < 0 {
+					db.itemStart = offset
+				}
+			}
+		case xml.CharData:
+			if inKey || inString {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case depth == 3 && inKey:
+				inKey = false
+				lastKey = text.String()
+			case depth == 3:
+				if inMechs {
+					inMechs = false
+					db.mechEnd = int(dec.InputOffset())
+				}
+				lastKey = ""
+			case depth == 4 && inString:
+				inString = false
+				db.Mechanisms = append(db.Mechanisms, text.String())
+			}
+			depth--
+		}
+	}
+
+	if !inDict {
+		return Right{}, errors.Errorf("right %s is not a property list", name)
+	}
+	if db.mechStart >= 0 {
+		db.parsed = append([]string{}, db.Mechanisms...)
+	}
+	return db, nil
+}
+
+// HasMechanisms reports whether the right was read with a mechanisms array.
+func (db Right) HasMechanisms() bool {
+	return db.mechStart >= 0
+}
+
+// Bytes returns the right with its mechanisms replaced by db.Mechanisms.
+// Nothing outside the mechanisms array is changed, and if the mechanisms are
+// unchanged the right is returned exactly as it was read.
+func (db Right) Bytes() ([]byte, error) {
+	if db.raw == nil {
+		return nil, errors.New("right was not read from the authorization database")
+	}
+	if reflect.DeepEqual(db.Mechanisms, db.parsed) {
+		return db.raw, nil
+	}
+	if !db.HasMechanisms() {
+		return nil, errors.Errorf("right %s has no mechanisms to replace", db.Name)
+	}
+
+	indent := lineIndent(db.raw, db.mechStart)
+	itemIndent := indent + "\t"
+	if db.itemStart >= 0 {
+		itemIndent = lineIndent(db.raw, db.itemStart)
+	}
+
+	var b bytes.Buffer
+	b.Write(db.raw[:db.mechStart])
+	if len(db.Mechanisms) == 0 {
+		b.WriteString("<array/>")
+	} else {
+		b.WriteString("<array>\n")
+		for _, mech := range db.Mechanisms {
+			b.WriteString(itemIndent + "<string>")
+			if err := xml.EscapeText(&b, []byte(mech)); err != nil {
+				return nil, err
+			}
+			b.WriteString("</string>\n")
+		}
+		b.WriteString(indent + "</array>")
+	}
+	b.Write(db.raw[db.mechEnd:])
+	return b.Bytes(), nil
+}
+
+// lineIndent returns the whitespace between the start of the line and pos.
+func lineIndent(data []byte, pos int) string {
+	start := pos
+	for start > 0 && (data[start-1] == ' ' || data[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && data[start-1] != '\n' {
+		return ""
+	}
+	return string(data[start:pos])
+}
@@ -0,0 +1,129 @@
+package authdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readRight(t *testing.T, file string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	require.NoError(t, err)
+	return data
+}
+
+func TestRightRoundTrip(t *testing.T) {
+	raw := readRight(t, "sequoia_custom_rules.plist")
+
+	db, err := Parse("system.login.console", raw)
+	require.NoError(t, err)
+	assert.True(t, db.HasMechanisms())
+	// the vendor dictionary's mechanisms are not the right's
+	assert.NotContains(t, db.Mechanisms, "Vendor:Ignore")
+
+	got, err := db.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, raw, got)
+}
+
+func TestRightEditMechanisms(t *testing.T) {
+	raw := readRight(t, "sequoia_custom_rules.plist")
+	db, err := Parse("system.login.console", raw)
+	require.NoError(t, err)
+
+	db.Mechanisms = append([]string{"Test:Mech"}, db.Mechanisms...)
+	got, err := db.Bytes()
+	require.NoError(t, err)
+
+	// everything around the mechanisms array is untouched
+	assert.Equal(t, string(raw[:db.mechStart]), string(got[:db.mechStart]))
+	assert.True(t, strings.HasSuffix(string(got), string(raw[db.mechEnd:])))
+
+	written, err := Parse("system.login.console", got)
+	require.NoError(t, err)
+	assert.Equal(t, db.Mechanisms, written.Mechanisms)
+}
+
+func TestRightRemoveMechanisms(t *testing.T) {
+	raw := readRight(t, "sequoia_custom_rules.plist")
+	db, err := Parse("system.login.console", raw)
+	require.NoError(t, err)
+
+	kept := []string{}
+	for _, mech := range db.Mechanisms {
+		if mech != "VendorAuth:login,privileged" {
+			kept = append(kept, mech)
+		}
+	}
+	db.Mechanisms = kept
+	got, err := db.Bytes()
+	require.NoError(t, err)
+
+	// the removed mechanism is gone, the vendor dictionary's is not
+	written, err := Parse("system.login.console", got)
+	require.NoError(t, err)
+	assert.Equal(t, kept, written.Mechanisms)
+	assert.NotContains(t, string(got), "VendorAuth:login,privileged")
+	assert.Contains(t, string(got), "Vendor:Ignore")
+}
+
+func TestRightWithoutMechanisms(t *testing.T) {
+	raw := readRight(t, "system_preferences_security.plist")
+	db, err := Parse("system.preferences.security", raw)
+	require.NoError(t, err)
+	assert.False(t, db.HasMechanisms())
+	assert.Nil(t, db.Mechanisms)
+
+	got, err := db.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, raw, got)
+
+	db.Mechanisms = []string{"Test:Mech"}
+	_, err = db.Bytes()
+	assert.Error(t, err)
+}
+
+func TestRightEmptyMechanisms(t *testing.T) {
+	raw := []byte("<plist version=\"1.0\">\n<dict>\n\t<key>mechanisms</key>\n\t<array/>\n\t<key>shared</key>\n\t<true/>\n</dict>\n</plist>\n")
+	db, err := Parse("test", raw)
+	require.NoError(t, err)
+	assert.True(t, db.HasMechanisms())
+	assert.Empty(t, db.Mechanisms)
+
+	db.Mechanisms = []string{"a&b"}
+	got, err := db.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "<plist version=\"1.0\">\n<dict>\n\t<key>mechanisms</key>\n\t<array>\n\t\t<string>a&amp;b</string>\n\t</array>\n\t<key>shared</key>\n\t<true/>\n</dict>\n</plist>\n", string(got))
+
+	db.Mechanisms = []string{}
+	got, err = db.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, string(raw), string(got))
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not xml", data: "mechanisms"},
+		{name: "not a dictionary", data: "<plist><array/></plist>"},
+		{name: "mechanisms not an array", data: "<plist><dict><key>mechanisms</key><string>builtin:prelogin</string></dict></plist>"},
+		{name: "mechanism not a string", data: "<plist><dict><key>mechanisms</key><array><true/></array></dict></plist>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("test", []byte(tt.data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRightBytesNotRead(t *testing.T) {
+	_, err := Right{Name: "test", Mechanisms: []string{}}.Bytes()
+	assert.Error(t, err)
+}
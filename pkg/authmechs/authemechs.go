@@ -7,62 +7,49 @@ import (
 	"os"
 	"reflect"
 
-	"github.com/grahamgilbert/crypt/pkg/utils"
-	"github.com/groob/plist"
+	"github.com/grahamgilbert/crypt/pkg/authdb"
 )
 
-var (
-	fv2Mechs         = []string{"Crypt:Check,privileged"}
-	fv2MechsToRemove = []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"}
-	fv2IndexMech     = "loginwindow:done"
-	fv2IndexOffset   = 0
-)
+// RightName is the right Crypt adds its mechanisms to.
+const RightName = "system.login.console"
 
-type AuthDB struct {
-	Class      string   `plist:"class"`
-	Comment    string   `plist:"comment"`
-	Created    float64  `plist:"created"`
-	Modified   float64  `plist:"modified"`
-	Shared     bool     `plist:"shared"`
-	Tries      int      `plist:"tries"`
-	Version    int      `plist:"version"`
-	Mechanisms []string `plist:"mechanisms"`
-}
+// AuthDB is system.login.console as read from the authorization database.
+type AuthDB = authdb.Right
 
 func removeMechsInDB(db AuthDB, mechList []string) AuthDB {
-	for i := len(db.Mechanisms) - 1; i >= 0; i-- {
-		for _, mechToRemove := range mechList {
-			if db.Mechanisms[i] == mechToRemove {
-				db.Mechanisms = append(db.Mechanisms[:i], db.Mechanisms[i+1:]...)
-				break
-			}
-		}
-	}
-
+	db.Mechanisms = removeMechs(db.Mechanisms, mechList)
 	return db
 }
 
-func checkMechsInDB(db AuthDB, mechList []string, indexMech string, indexOffset int) bool {
-	insertIndex := indexOf(db.Mechanisms, indexMech) - len(mechList) // start from the position before the indexMech
-
-	// Check if the position is valid
-	if insertIndex < 0 || insertIndex+len(mechList) > len(db.Mechanisms) {
-		fmt.Println("Invalid index")
-		return false
+// removeMechs returns a copy of mechanisms without any that are in mechList.
+func removeMechs(mechanisms []string, mechList []string) []string {
+	result := []string{}
+	for _, mech := range mechanisms {
+		if indexOf(mechList, mech) < 0 {
+			result = append(result, mech)
+		}
 	}
-
-	// Compare the corresponding elements of the two slices
-	return reflect.DeepEqual(db.Mechanisms[insertIndex:insertIndex+len(mechList)], mechList)
+	return result
 }
 
-func setMechsInDB(db AuthDB, mechList []string, indexMech string, indexOffset int) AuthDB {
-	// Remove all the mechanisms that crypt ever added but are not needed anymore we'll re-add the ones we need
-	db = removeMechsInDB(db, fv2MechsToRemove)
-
-	insertIndex := indexOf(db.Mechanisms, indexMech) + indexOffset
-	db.Mechanisms = insertMechsAtPosition(db.Mechanisms, mechList, insertIndex)
+// checkMechsInDB reports whether the mechanisms in db are already as spec
+// places them.
+func checkMechsInDB(db AuthDB, spec MechanismSpec) (bool, error) {
+	want, err := spec.place(db.Mechanisms)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(want, db.Mechanisms), nil
+}
 
-	return db
+// setMechsInDB places the mechanisms in db as spec describes.
+func setMechsInDB(db AuthDB, spec MechanismSpec) (AuthDB, error) {
+	mechs, err := spec.place(db.Mechanisms)
+	if err != nil {
+		return AuthDB{}, err
+	}
+	db.Mechanisms = mechs
+	return db, nil
 }
 
 func insertMechsAtPosition(mechanisms []string, mechsToInsert []string, pos int) []string {
@@ -92,41 +79,96 @@ func indexOf(slice []string, item string) int {
 	return -1
 }
 
-func getAuthDb(r utils.Runner) (AuthDB, error) {
-	securityConsoleOut, err := r.Runner.RunCmd("/usr/bin/security", "authorizationdb", "read", "system.login.console")
+// getAuthDb reads system.login.console, which must have mechanisms.
+func getAuthDb(c *authdb.Client) (AuthDB, error) {
+	d, err := c.Read(RightName)
 	if err != nil {
 		return AuthDB{}, err
 	}
+	return d, requireMechanisms(d)
+}
 
-	var d AuthDB
-	err = plist.Unmarshal(securityConsoleOut, &d)
-	if err != nil {
-		return AuthDB{}, err
+func requireMechanisms(d AuthDB) error {
+	if !d.HasMechanisms() {
+		return errors.New("system.login.console has no mechanisms")
 	}
-
-	return d, nil
+	return nil
 }
 
-func editAuthDB(r utils.Runner, add bool) error {
-	d, err := getAuthDb(r)
+// ErrMechsReAdded is returned when the Crypt mechanisms were removed but are
+// back in the right when it is read again, because another process added them.
+var ErrMechsReAdded = errors.New("Crypt mechanisms were added back to system.login.console after being removed")
+
+// ErrMechsNotPlaced is returned when the Crypt mechanisms were written but are
+// not placed as configured when the right is read again.
+var ErrMechsNotPlaced = errors.New("Crypt mechanisms are not placed as configured in system.login.console after writing it")
+
+// editAuthDB places the mechanisms in system.login.console as spec
+// describes, or removes every mechanism spec inserts or purges when add is
+// false. If another process changes the right while it is being edited, the
+// edit is made again on its changes rather than overwriting them. The right is
+// read back afterwards to check the edit took.
+func editAuthDB(c *authdb.Client, spec MechanismSpec, add bool) error {
+	_, err := c.Update(RightName, func(d AuthDB) (AuthDB, error) {
+		if err := requireMechanisms(d); err != nil {
+			return AuthDB{}, err
+		}
+		if add {
+			return setMechsInDB(d, spec)
+		}
+		return removeMechsInDB(d, spec.removals()), nil
+	})
 	if err != nil {
 		return err
 	}
 
-	d = setMechsInDB(d, fv2Mechs, fv2IndexMech, fv2IndexOffset)
-	data, err := plist.Marshal(d)
+	if add {
+		return verifyMechsPlaced(c, spec)
+	}
+	return verifyMechsRemoved(c, spec)
+}
+
+// verifyMechsPlaced reads system.login.console back and checks the mechanisms
+// are placed as spec describes.
+func verifyMechsPlaced(c *authdb.Client, spec MechanismSpec) error {
+	d, err := getAuthDb(c)
 	if err != nil {
 		return err
 	}
+	ok, err := checkMechsInDB(d, spec)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMechsNotPlaced, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: found %v", ErrMechsNotPlaced, d.Mechanisms)
+	}
+	return nil
+}
 
-	_, err = r.Runner.RunCmdWithStdin("/usr/bin/security", string(data), "authorizationdb", "write", "system.login.console")
+// verifyMechsRemoved reads system.login.console back and checks none of the
+// mechanisms spec inserts or purges are in it.
+func verifyMechsRemoved(c *authdb.Client, spec MechanismSpec) error {
+	d, err := getAuthDb(c)
 	if err != nil {
 		return err
 	}
-
+	if found := findMechsInDB(d, spec.removals()); len(found) > 0 {
+		return fmt.Errorf("%w: %v", ErrMechsReAdded, found)
+	}
 	return nil
 }
 
+// findMechsInDB returns the mechanisms in mechList that are in db.
+func findMechsInDB(db AuthDB, mechList []string) []string {
+	var found []string
+	for _, mech := range mechList {
+		if indexOf(db.Mechanisms, mech) >= 0 {
+			found = append(found, mech)
+		}
+	}
+	return found
+}
+
 func checkRoot() error {
 	if os.Geteuid() != 0 {
 		return errors.New("only root can run this tool")
@@ -135,44 +177,82 @@ func checkRoot() error {
 	return nil
 }
 
-func Check(r utils.Runner) error {
+// Check reports on system.login.console, returning an error if the
+// mechanisms are not placed as spec wants them.
+func Check(c *authdb.Client, spec MechanismSpec) (Report, error) {
 	err := checkRoot()
 	if err != nil {
-		return err
+		return Report{}, err
 	}
 
-	d, err := getAuthDb(r)
+	d, err := getAuthDb(c)
 	if err != nil {
-		return err
+		return Report{}, err
 	}
 
-	if !checkMechsInDB(d, fv2Mechs, fv2IndexMech, fv2IndexOffset) {
-		return errors.New("mechanisms are not set correctly")
+	report := buildReport(d, spec)
+	if report.Error != "" {
+		return report, errors.New(report.Error)
+	}
+	if !report.Installed {
+		return report, errors.New("mechanisms are not set correctly")
 	}
 
-	return nil
+	return report, nil
 }
 
-func Run(r utils.Runner, add bool) error {
+func Run(c *authdb.Client, spec MechanismSpec, add bool) error {
 	err := checkRoot()
 	if err != nil {
 		return err
 	}
 
-	return editAuthDB(r, add)
+	return editAuthDB(c, spec, add)
 }
 
-func Ensure(r utils.Runner) error {
-	d, err := getAuthDb(r)
+// Restore writes a backup of system.login.console back to the authorization
+// database and checks it took. An empty timestamp restores the latest backup.
+func Restore(c *authdb.Client, timestamp string) error {
+	err := checkRoot()
 	if err != nil {
 		return err
 	}
 
-	if checkMechsInDB(d, fv2Mechs, fv2IndexMech, fv2IndexOffset) {
-		return nil
+	return c.Restore(RightName, timestamp)
+}
+
+// Drift is system.login.console as Ensure found it, not as configured, and
+// as it was once Ensure put the mechanisms back.
+type Drift struct {
+	Before []string
+	After  []string
+}
+
+// Ensure places the mechanisms in system.login.console as spec describes if
+// they are not already. It returns the drift it corrected, or nil if there
+// was none.
+func Ensure(c *authdb.Client, spec MechanismSpec) (*Drift, error) {
+	d, err := getAuthDb(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := checkMechsInDB(d, spec)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, nil
 	}
 
 	log.Println("Mechanisms are not set correctly, adding to AuthDB")
 
-	return editAuthDB(r, true)
+	if err := editAuthDB(c, spec, true); err != nil {
+		return nil, err
+	}
+	after, err := getAuthDb(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Drift{Before: d.Mechanisms, After: after.Mechanisms}, nil
 }
@@ -1,10 +1,19 @@
 package authmechs
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/grahamgilbert/crypt/pkg/authdb/authdbtest"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
 	"github.com/grahamgilbert/crypt/pkg/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRemoveMechsInDB(t *testing.T) {
@@ -94,61 +103,103 @@ func TestRemoveMechsInDB(t *testing.T) {
 	}
 }
 
+// defaultSpec returns the MechanismSpec of the default preferences.
+func defaultSpec(t *testing.T) MechanismSpec {
+	cfg, err := pref.Load(preftest.New())
+	require.NoError(t, err)
+	return SpecFromConfig(cfg)
+}
+
 func TestSetMechsInDB(t *testing.T) {
 	tests := []struct {
-		name        string
-		db          AuthDB
-		mechList    []string
-		indexMech   string
-		indexOffset int
-		want        AuthDB
+		name    string
+		db      AuthDB
+		spec    MechanismSpec
+		want    AuthDB
+		wantErr bool
 	}{
 		{
-			name:        "Test with empty db",
-			db:          AuthDB{Mechanisms: []string{}},
-			mechList:    []string{"mech1", "mech2"},
-			indexMech:   "mech1",
-			indexOffset: 1,
-			want:        AuthDB{Mechanisms: []string{"mech1", "mech2"}},
+			name:    "Test with anchor missing",
+			db:      AuthDB{Mechanisms: []string{}},
+			spec:    MechanismSpec{Insert: []string{"mech1", "mech2"}, Anchor: "mech3"},
+			wantErr: true,
+		},
+		{
+			name: "Test with non-empty db and mechList",
+			db:   AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec: MechanismSpec{Insert: []string{"mech4", "mech5"}, Anchor: "mech2", Placement: "after"},
+			want: AuthDB{Mechanisms: []string{"mech1", "mech2", "mech4", "mech5", "mech3"}},
+		},
+		{
+			name: "Test with before and an offset",
+			db:   AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec: MechanismSpec{Insert: []string{"mech4", "mech5"}, Anchor: "mech3", Placement: "before", Offset: -1},
+			want: AuthDB{Mechanisms: []string{"mech1", "mech4", "mech5", "mech2", "mech3"}},
+		},
+		{
+			name: "Test with mechanisms already present elsewhere",
+			db:   AuthDB{Mechanisms: []string{"mech4", "mech1", "old", "mech2", "mech3"}},
+			spec: MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech2", Purge: []string{"old"}},
+			want: AuthDB{Mechanisms: []string{"mech1", "mech4", "mech2", "mech3"}},
+		},
+		{
+			name:    "Test with offset past the end",
+			db:      AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec:    MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech3", Placement: "after", Offset: 1},
+			wantErr: true,
+		},
+		{
+			name: "Test with a constraint moving the mechanisms down",
+			db:   AuthDB{Mechanisms: []string{"mech1", "Vendor:a", "mech2", "Vendor:b", "mech3"}},
+			spec: MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech2", After: []string{"Vendor:*"}},
+			want: AuthDB{Mechanisms: []string{"mech1", "Vendor:a", "mech2", "Vendor:b", "mech4", "mech3"}},
+		},
+		{
+			name: "Test with a constraint moving the mechanisms up",
+			db:   AuthDB{Mechanisms: []string{"mech1", "Vendor:a", "mech2", "mech3"}},
+			spec: MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech3", Placement: "after", Before: []string{"Vendor:*"}},
+			want: AuthDB{Mechanisms: []string{"mech1", "mech4", "Vendor:a", "mech2", "mech3"}},
 		},
 		{
-			name:        "Test with non-empty db and mechList",
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{"mech4", "mech5"},
-			indexMech:   "mech2",
-			indexOffset: 1,
-			want:        AuthDB{Mechanisms: []string{"mech1", "mech2", "mech4", "mech5", "mech3"}},
+			name:    "Test with constraints that cannot both be met",
+			db:      AuthDB{Mechanisms: []string{"Other:a", "mech1", "Vendor:a"}},
+			spec:    MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech1", After: []string{"Vendor:*"}, Before: []string{"Other:*"}},
+			wantErr: true,
 		},
 		{
-			name:        "Test with non-empty db and empty mechList",
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{},
-			indexMech:   "mech2",
-			indexOffset: 1,
-			want:        AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			name:    "Test with a bad pattern",
+			db:      AuthDB{Mechanisms: []string{"mech1"}},
+			spec:    MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech1", After: []string{"["}},
+			wantErr: true,
 		},
 		{
-			name:        "Test with non-empty db and mechList to add",
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{"mech4", "mech5"},
-			indexMech:   "mech2",
-			indexOffset: 1,
-			want:        AuthDB{Mechanisms: []string{"mech1", "mech2", "mech4", "mech5", "mech3"}},
+			name:    "Test with nothing to insert",
+			db:      AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec:    MechanismSpec{Anchor: "mech2"},
+			wantErr: true,
 		},
 		{
-			name:        "Test with non-empty db, empty mechList",
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{},
-			indexMech:   "mech2",
-			indexOffset: 1,
-			want:        AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			name:    "Test with anchor purged",
+			db:      AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec:    MechanismSpec{Insert: []string{"mech4"}, Anchor: "mech2", Purge: []string{"mech2"}},
+			wantErr: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := setMechsInDB(tt.db, tt.mechList, tt.indexMech, tt.indexOffset)
+			got, err := setMechsInDB(tt.db, tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
 			assert.Equal(t, tt.want, got)
+
+			// Check agrees with what Set placed
+			ok, err := checkMechsInDB(got, tt.spec)
+			require.NoError(t, err)
+			assert.True(t, ok)
 		})
 	}
 }
@@ -237,41 +288,32 @@ func TestInsertMechsAtPosition(t *testing.T) {
 func TestGetAuthDB(t *testing.T) {
 	tests := []struct {
 		name   string
-		want   AuthDB
+		want   []string
 		runner utils.MockCmdRunner
 	}{
 		{
 			name: "Test with Crypt config",
-			want: AuthDB{
-				Class:   "evaluate-mechanisms",
-				Comment: "Login mechanism based rule.  Not for general use, yet.",
-				Created: 730353220.36463201,
-				Mechanisms: []string{
-					"builtin:prelogin",
-					"builtin:policy-banner",
-					"loginwindow:login",
-					"builtin:login-begin",
-					"builtin:reset-password,privileged",
-					"loginwindow:FDESupport,privileged",
-					"builtin:forward-login,privileged",
-					"builtin:auto-login,privileged",
-					"builtin:authenticate,privileged",
-					"PKINITMechanism:auth,privileged",
-					"builtin:login-success",
-					"loginwindow:success",
-					"HomeDirMechanism:login,privileged",
-					"HomeDirMechanism:status",
-					"MCXMechanism:login",
-					"CryptoTokenKit:login",
-					"Crypt:Check,privileged",
-					"Crypt:CryptGUI",
-					"Crypt:Enablement,privileged",
-					"loginwindow:done",
-				},
-				Modified: 730407814.24742103,
-				Shared:   true,
-				Tries:    10000,
-				Version:  11,
+			want: []string{
+				"builtin:prelogin",
+				"builtin:policy-banner",
+				"loginwindow:login",
+				"builtin:login-begin",
+				"builtin:reset-password,privileged",
+				"loginwindow:FDESupport,privileged",
+				"builtin:forward-login,privileged",
+				"builtin:auto-login,privileged",
+				"builtin:authenticate,privileged",
+				"PKINITMechanism:auth,privileged",
+				"builtin:login-success",
+				"loginwindow:success",
+				"HomeDirMechanism:login,privileged",
+				"HomeDirMechanism:status",
+				"MCXMechanism:login",
+				"CryptoTokenKit:login",
+				"Crypt:Check,privileged",
+				"Crypt:CryptGUI",
+				"Crypt:Enablement,privileged",
+				"loginwindow:done",
 			},
 			runner: utils.MockCmdRunner{
 				Output: `<?xml version="1.0" encoding="UTF-8"?>
@@ -324,69 +366,214 @@ func TestGetAuthDB(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			runner := &tt.runner
-			r := utils.Runner{Runner: runner}
-			got, err := getAuthDb(r)
+			c := &authdb.Client{Runner: utils.Runner{Runner: runner}}
+			got, err := getAuthDb(c)
 			assert.NoError(t, err)
-			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want, got.Mechanisms)
+
+			// the right is written back exactly as it was read
+			data, err := got.Bytes()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.runner.Output, string(data))
 		})
 	}
 }
 
 func TestCheckMechsInDB(t *testing.T) {
+	before := MechanismSpec{Insert: []string{"mech2", "mech3"}, Anchor: "mech1"}
 	tests := []struct {
-		name        string
-		db          AuthDB
-		mechList    []string
-		indexMech   string
-		indexOffset int
-		expected    bool
+		name     string
+		db       AuthDB
+		spec     MechanismSpec
+		expected bool
 	}{
 		{
-			name:        "Test Case 1", // The case when the sequence is present before the indexMech
-			db:          AuthDB{Mechanisms: []string{"mech2", "mech3", "mech1"}},
-			mechList:    []string{"mech2", "mech3"},
-			indexMech:   "mech1",
-			indexOffset: 0,
-			expected:    true,
+			name:     "Test Case 1", // The case when the sequence is present before the indexMech
+			db:       AuthDB{Mechanisms: []string{"mech2", "mech3", "mech1"}},
+			spec:     before,
+			expected: true,
+		},
+		{
+			name:     "Test Case 2", // The case when the sequence is present after the indexMech
+			db:       AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec:     before,
+			expected: false,
+		},
+		{
+			name:     "Test Case 3",
+			db:       AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
+			spec:     MechanismSpec{Insert: []string{"mech4", "mech5"}, Anchor: "mech3"},
+			expected: false,
 		},
 		{
-			name:        "Test Case 2", // The case when the sequence is present after the indexMech
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{"mech2", "mech3"},
-			indexMech:   "mech1",
-			indexOffset: 0,
-			expected:    false,
+			name:     "Test Case 4", // The case when the sequence is not present before the indexMech
+			db:       AuthDB{Mechanisms: []string{"mech3", "mech1", "mech2"}},
+			spec:     before,
+			expected: false,
 		},
 		{
-			name:        "Test Case 3",
-			db:          AuthDB{Mechanisms: []string{"mech1", "mech2", "mech3"}},
-			mechList:    []string{"mech4", "mech5"},
-			indexMech:   "mech3",
-			indexOffset: 0,
-			expected:    false,
+			name:     "Test Case 5", // The case when the sequence is present, but not in the correct order
+			db:       AuthDB{Mechanisms: []string{"mech3", "mech2", "mech1"}},
+			spec:     before,
+			expected: false,
 		},
 		{
-			name:        "Test Case 4", // The case when the sequence is not present before the indexMech
-			db:          AuthDB{Mechanisms: []string{"mech3", "mech1", "mech2"}},
-			mechList:    []string{"mech2", "mech3"},
-			indexMech:   "mech1",
-			indexOffset: 0,
-			expected:    false,
+			name:     "Test Case 6", // The case when the sequence is placed with a nonzero offset
+			db:       AuthDB{Mechanisms: []string{"mech2", "mech3", "mech0", "mech1"}},
+			spec:     MechanismSpec{Insert: []string{"mech2", "mech3"}, Anchor: "mech1", Offset: -1},
+			expected: true,
 		},
 		{
-			name:        "Test Case 5", // The case when the sequence is present, but not in the correct order
-			db:          AuthDB{Mechanisms: []string{"mech3", "mech2", "mech1"}},
-			mechList:    []string{"mech2", "mech3"},
-			indexMech:   "mech1",
-			indexOffset: 0,
-			expected:    false,
+			name:     "Test Case 7", // The case when a purged mechanism is still present
+			db:       AuthDB{Mechanisms: []string{"mech2", "mech3", "mech1", "old"}},
+			spec:     MechanismSpec{Insert: []string{"mech2", "mech3"}, Anchor: "mech1", Purge: []string{"old"}},
+			expected: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := checkMechsInDB(tt.db, tt.mechList, tt.indexMech, tt.indexOffset)
+			result, err := checkMechsInDB(tt.db, tt.spec)
+			require.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
+
+func readTestdata(t *testing.T, name string) string {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestEditAuthDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		right   string
+		add     bool
+		want    []string
+		wantOut []string
+	}{
+		{
+			name:  "install",
+			right: "ventura_login_console.plist",
+			add:   true,
+			want:  []string{"Crypt:Check,privileged"},
+		},
+		{
+			name:    "uninstall",
+			right:   "sequoia_login_console.plist",
+			wantOut: []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+		},
+		{
+			name:    "uninstall mechanisms from python Crypt",
+			right:   "sonoma_login_console.plist",
+			wantOut: []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+		},
+		{
+			name:    "uninstall when not installed",
+			right:   "ventura_login_console.plist",
+			wantOut: []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+		},
+	}
+
+	spec := defaultSpec(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := authdbtest.New(map[string]string{RightName: readTestdata(t, tt.right)})
+			c := fake.Client(t)
+
+			require.NoError(t, editAuthDB(c, spec, tt.add))
+			assert.Equal(t, 1, fake.Writes[RightName])
+
+			d, err := getAuthDb(c)
+			require.NoError(t, err)
+			assert.Subset(t, d.Mechanisms, tt.want)
+			assert.Empty(t, findMechsInDB(d, tt.wantOut))
+			ok, err := checkMechsInDB(d, spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.add, ok)
+			assert.Contains(t, d.Mechanisms, "loginwindow:done")
+		})
+	}
+}
+
+func TestEditAuthDBReAdded(t *testing.T) {
+	fake := authdbtest.New(map[string]string{RightName: readTestdata(t, "sequoia_login_console.plist")})
+	fake.AfterWrite = func(name string, right string) string {
+		return strings.Replace(right, "<string>loginwindow:done</string>", "<string>Crypt:Check,privileged</string>\n\t\t<string>loginwindow:done</string>", 1)
+	}
+
+	err := editAuthDB(fake.Client(t), defaultSpec(t), false)
+	assert.True(t, errors.Is(err, ErrMechsReAdded))
+	assert.Contains(t, err.Error(), "Crypt:Check,privileged")
+}
+
+func TestRestore(t *testing.T) {
+	original := readTestdata(t, "ventura_login_console.plist")
+	fake := authdbtest.New(map[string]string{RightName: original})
+	c := fake.Client(t)
+
+	require.NoError(t, editAuthDB(c, defaultSpec(t), true))
+	assert.NotEqual(t, original, fake.Rights[RightName])
+
+	// restoring is left to authdb, which has its own tests
+	require.NoError(t, c.Restore(RightName, ""))
+	assert.Equal(t, original, fake.Rights[RightName])
+	d, err := getAuthDb(c)
+	require.NoError(t, err)
+	ok, err := checkMechsInDB(d, defaultSpec(t))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestEditAuthDBConcurrentChange(t *testing.T) {
+	fake := authdbtest.New(map[string]string{RightName: readTestdata(t, "ventura_login_console.plist")})
+	// another agent adds its mechanism after the right is first read
+	fake.AfterRead = func(name string, reads int) {
+		if reads == 1 {
+			fake.Rights[name] = strings.Replace(fake.Rights[name], "<string>loginwindow:done</string>", "<string>Other:Agent</string>\n\t\t<string>loginwindow:done</string>", 1)
+		}
+	}
+
+	spec := defaultSpec(t)
+	require.NoError(t, editAuthDB(fake.Client(t), spec, true))
+	assert.Equal(t, 1, fake.Writes[RightName])
+
+	d, err := getAuthDb(fake.Client(t))
+	require.NoError(t, err)
+	assert.Contains(t, d.Mechanisms, "Other:Agent")
+	ok, err := checkMechsInDB(d, spec)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestEditAuthDBNotPlaced(t *testing.T) {
+	original := readTestdata(t, "ventura_login_console.plist")
+	fake := authdbtest.New(map[string]string{RightName: original})
+	// the write does not take
+	fake.AfterWrite = func(name string, right string) string { return original }
+
+	err := editAuthDB(fake.Client(t), defaultSpec(t), true)
+	assert.True(t, errors.Is(err, ErrMechsNotPlaced))
+}
+
+func TestEnsure(t *testing.T) {
+	spec := defaultSpec(t)
+	installed := readTestdata(t, "sequoia_login_console.plist")
+	fake := authdbtest.New(map[string]string{RightName: installed})
+
+	drift, err := Ensure(fake.Client(t), spec)
+	require.NoError(t, err)
+	assert.Nil(t, drift)
+	assert.Zero(t, fake.Writes[RightName])
+
+	// an OS update removes the mechanisms
+	fake.Rights[RightName] = readTestdata(t, "ventura_login_console.plist")
+	drift, err = Ensure(fake.Client(t), spec)
+	require.NoError(t, err)
+	require.NotNil(t, drift)
+	assert.Equal(t, 1, fake.Writes[RightName])
+	assert.NotContains(t, drift.Before, "Crypt:Check,privileged")
+	assert.Contains(t, drift.After, "Crypt:Check,privileged")
+}
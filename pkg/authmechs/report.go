@@ -0,0 +1,233 @@
+package authmechs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+)
+
+// applePlugins are the authorization plugins macOS ships in
+// system.login.console. Mechanisms from any other plugin are foreign.
+var applePlugins = []string{ // nolint:gochecknoglobals
+	"builtin",
+	"loginwindow",
+	"HomeDirMechanism",
+	"MCXMechanism",
+	"CryptoTokenKit",
+	"PKINITMechanism",
+	"PSSOAuthPlugin",
+}
+
+// ForeignMechanism is a mechanism in system.login.console from a plugin
+// other than Crypt or macOS, such as Jamf Connect or XCreds.
+type ForeignMechanism struct {
+	Mechanism string `json:"mechanism"`
+	Index     int    `json:"index"`
+	// Constraint is "after" if Crypt's mechanisms must come after it,
+	// "before" if they must come before it, or empty if neither.
+	Constraint string `json:"constraint,omitempty"`
+	// Satisfied is whether the constraint is met. It is false when Crypt's
+	// mechanisms are missing, and always true without a constraint.
+	Satisfied bool `json:"satisfied"`
+}
+
+// Verdicts of a Report.
+const (
+	VerdictCompliant    = "compliant"
+	VerdictNonCompliant = "noncompliant"
+	// VerdictError means the spec could not be placed at all, such as when
+	// the anchor is missing.
+	VerdictError = "error"
+)
+
+// Diff is how Crypt's mechanisms differ from where the spec wants them.
+type Diff struct {
+	// Missing are mechanisms to insert that are not there.
+	Missing []string `json:"missing"`
+	// Misplaced are mechanisms to insert that are there, but not where
+	// they should be.
+	Misplaced []string `json:"misplaced"`
+	// Extra are purged mechanisms that are still there, and second copies
+	// of mechanisms to insert.
+	Extra []string `json:"extra"`
+}
+
+// Report describes system.login.console as seen by -check-auth-mechs.
+type Report struct {
+	Verdict    string   `json:"verdict"`
+	Mechanisms []string `json:"mechanisms"`
+	// Expected is the mechanisms as the MechanismSpec wants them, or nil if
+	// it can't be placed.
+	Expected []string `json:"expected"`
+	Diff     Diff     `json:"diff"`
+	// AnchorIndex is where the anchor is in Mechanisms, or -1.
+	AnchorIndex int `json:"anchor_index"`
+	// Installed is whether Crypt's mechanisms are placed as the
+	// MechanismSpec wants them.
+	Installed bool               `json:"installed"`
+	Foreign   []ForeignMechanism `json:"foreign"`
+	// Error is why the spec could not be placed, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// buildReport checks db against spec and finds the foreign mechanisms in it.
+func buildReport(db AuthDB, spec MechanismSpec) Report {
+	report := Report{
+		Mechanisms:  db.Mechanisms,
+		AnchorIndex: indexOf(db.Mechanisms, spec.Anchor),
+		Foreign:     []ForeignMechanism{},
+	}
+	expected, err := spec.place(db.Mechanisms)
+	switch {
+	case err != nil:
+		report.Error = err.Error()
+		report.Verdict = VerdictError
+	case reflect.DeepEqual(expected, db.Mechanisms):
+		report.Installed = true
+		report.Verdict = VerdictCompliant
+	default:
+		report.Verdict = VerdictNonCompliant
+	}
+	report.Expected = expected
+	report.Diff = diffMechs(db.Mechanisms, expected, spec)
+
+	// where Crypt's own mechanisms are
+	first, last := -1, -1
+	for i, mech := range db.Mechanisms {
+		if indexOf(spec.Insert, mech) >= 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+
+	removals := spec.removals()
+	for i, mech := range db.Mechanisms {
+		if indexOf(removals, mech) >= 0 || !isForeign(mech) {
+			continue
+		}
+		foreign := ForeignMechanism{Mechanism: mech, Index: i, Constraint: spec.constraint(mech)}
+		switch foreign.Constraint {
+		case pref.PlacementAfter:
+			foreign.Satisfied = first >= 0 && i < first
+		case pref.PlacementBefore:
+			foreign.Satisfied = last >= 0 && i > last
+		default:
+			foreign.Satisfied = true
+		}
+		report.Foreign = append(report.Foreign, foreign)
+	}
+	return report
+}
+
+// diffMechs compares Crypt's mechanisms in current with where they are in
+// expected. Without expected, only missing and extra mechanisms are found.
+func diffMechs(current, expected []string, spec MechanismSpec) Diff {
+	diff := Diff{Missing: []string{}, Misplaced: []string{}, Extra: []string{}}
+	// expected has no purged mechanisms or second copies, so positions are
+	// compared once they are left out of current too
+	kept := withoutExtra(current, spec)
+	for _, mech := range spec.Insert {
+		i := indexOf(kept, mech)
+		switch {
+		case i < 0:
+			diff.Missing = append(diff.Missing, mech)
+		case expected != nil && i != indexOf(expected, mech):
+			diff.Misplaced = append(diff.Misplaced, mech)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, mech := range current {
+		switch {
+		case indexOf(spec.Insert, mech) >= 0:
+			if seen[mech] {
+				diff.Extra = append(diff.Extra, mech)
+			}
+			seen[mech] = true
+		case indexOf(spec.Purge, mech) >= 0:
+			diff.Extra = append(diff.Extra, mech)
+		}
+	}
+	return diff
+}
+
+// withoutExtra returns mechs without the purged mechanisms and second copies
+// of the mechanisms to insert.
+func withoutExtra(mechs []string, spec MechanismSpec) []string {
+	kept := []string{}
+	seen := map[string]bool{}
+	for _, mech := range mechs {
+		switch {
+		case indexOf(spec.Insert, mech) >= 0:
+			if seen[mech] {
+				continue
+			}
+			seen[mech] = true
+		case indexOf(spec.Purge, mech) >= 0:
+			continue
+		}
+		kept = append(kept, mech)
+	}
+	return kept
+}
+
+// isForeign reports whether mech comes from a plugin macOS doesn't ship.
+func isForeign(mech string) bool {
+	plugin := strings.SplitN(mech, ":", 2)[0]
+	return indexOf(applePlugins, plugin) < 0
+}
+
+// PrintJSON writes the report to w as a JSON object.
+func (report Report) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// Print writes the report to w as text.
+func (report Report) Print(w io.Writer) error {
+	if report.Installed {
+		fmt.Fprintln(w, "Crypt mechanisms: installed")
+	} else {
+		fmt.Fprintln(w, "Crypt mechanisms: not installed as configured")
+	}
+	if report.Error != "" {
+		fmt.Fprintf(w, "Error: %s\n", report.Error)
+	}
+	printList(w, "Missing", report.Diff.Missing)
+	printList(w, "Misplaced", report.Diff.Misplaced)
+	printList(w, "Extra", report.Diff.Extra)
+	if len(report.Foreign) == 0 {
+		fmt.Fprintln(w, "Foreign mechanisms: none")
+		return nil
+	}
+
+	fmt.Fprintln(w, "Foreign mechanisms:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tMECHANISM\tCRYPT MUST COME\tSATISFIED")
+	for _, f := range report.Foreign {
+		constraint, satisfied := "-", "-"
+		if f.Constraint != "" {
+			constraint = f.Constraint
+			satisfied = "no"
+			if f.Satisfied {
+				satisfied = "yes"
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", f.Index, f.Mechanism, constraint, satisfied)
+	}
+	return tw.Flush()
+}
+
+func printList(w io.Writer, label string, mechs []string) {
+	if len(mechs) > 0 {
+		fmt.Fprintf(w, "%s: %s\n", label, strings.Join(mechs, ", "))
+	}
+}
@@ -0,0 +1,181 @@
+package authmechs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jamfConnectMechs is system.login.console as Jamf Connect leaves it, with
+// Crypt added by an older version before loginwindow:done.
+var jamfConnectMechs = []string{ // nolint:gochecknoglobals
+	"builtin:prelogin",
+	"builtin:policy-banner",
+	"JamfConnectLogin:LoginUI",
+	"builtin:login-begin",
+	"builtin:reset-password,privileged",
+	"loginwindow:FDESupport,privileged",
+	"builtin:forward-login,privileged",
+	"builtin:auto-login,privileged",
+	"builtin:authenticate,privileged",
+	"PKINITMechanism:auth,privileged",
+	"builtin:login-success",
+	"loginwindow:success",
+	"HomeDirMechanism:login,privileged",
+	"HomeDirMechanism:status",
+	"MCXMechanism:login",
+	"CryptoTokenKit:login",
+	"Crypt:Check,privileged",
+	"loginwindow:done",
+	"JamfConnectLogin:CreateUser,privileged",
+	"JamfConnectLogin:LoginDone",
+}
+
+func jamfConnectSpec(t *testing.T) MechanismSpec {
+	spec := defaultSpec(t)
+	spec.After = []string{"JamfConnectLogin:*"}
+	spec.Before = []string{"loginwindow:done"}
+	return spec
+}
+
+func TestBuildReport(t *testing.T) {
+	db := AuthDB{Mechanisms: append([]string{}, jamfConnectMechs...)}
+
+	// without constraints Crypt is where it should be
+	report := buildReport(db, defaultSpec(t))
+	assert.True(t, report.Installed)
+	require.Len(t, report.Foreign, 3)
+	assert.Equal(t, ForeignMechanism{Mechanism: "JamfConnectLogin:LoginUI", Index: 2, Satisfied: true}, report.Foreign[0])
+
+	// Crypt has to come after every Jamf Connect mechanism, which can't also
+	// be before loginwindow:done
+	report = buildReport(db, jamfConnectSpec(t))
+	assert.False(t, report.Installed)
+	assert.Contains(t, report.Error, "cannot come after JamfConnectLogin:LoginDone and before loginwindow:done")
+	require.Len(t, report.Foreign, 3)
+	assert.Equal(t, "after", report.Foreign[0].Constraint)
+	assert.True(t, report.Foreign[0].Satisfied)
+	assert.False(t, report.Foreign[1].Satisfied)
+	assert.False(t, report.Foreign[2].Satisfied)
+}
+
+func TestJamfConnectPlacement(t *testing.T) {
+	spec := defaultSpec(t)
+	spec.After = []string{"JamfConnectLogin:LoginUI"}
+	spec.Before = []string{"JamfConnectLogin:CreateUser*"}
+	spec.Anchor = "builtin:prelogin"
+
+	db, err := setMechsInDB(AuthDB{Mechanisms: append([]string{}, jamfConnectMechs...)}, spec)
+	require.NoError(t, err)
+	// the anchor puts Crypt first, the constraints move it after LoginUI
+	assert.Equal(t, []string{"builtin:prelogin", "builtin:policy-banner", "JamfConnectLogin:LoginUI", "Crypt:Check,privileged", "builtin:login-begin"}, db.Mechanisms[:5])
+
+	report := buildReport(db, spec)
+	assert.True(t, report.Installed)
+	for _, f := range report.Foreign {
+		assert.True(t, f.Satisfied, f.Mechanism)
+	}
+}
+
+func TestReportPrint(t *testing.T) {
+	db := AuthDB{Mechanisms: append([]string{}, jamfConnectMechs...)}
+	spec := defaultSpec(t)
+	spec.Before = []string{"JamfConnectLogin:*"}
+
+	var buf bytes.Buffer
+	require.NoError(t, buildReport(db, spec).Print(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 7)
+	assert.Equal(t, "Crypt mechanisms: not installed as configured", lines[0])
+	assert.Equal(t, "Misplaced: Crypt:Check,privileged", lines[1])
+	assert.Equal(t, "Foreign mechanisms:", lines[2])
+	assert.Regexp(t, `^2\s+JamfConnectLogin:LoginUI\s+before\s+no$`, lines[4])
+	assert.Regexp(t, `^18\s+JamfConnectLogin:CreateUser,privileged\s+before\s+yes$`, lines[5])
+
+	buf.Reset()
+	require.NoError(t, buildReport(AuthDB{Mechanisms: []string{"builtin:prelogin", "Crypt:Check,privileged", "loginwindow:done"}}, defaultSpec(t)).Print(&buf))
+	assert.Equal(t, "Crypt mechanisms: installed\nForeign mechanisms: none\n", buf.String())
+}
+
+func TestReportDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		mechs       []string
+		wantVerdict string
+		wantDiff    Diff
+		wantAnchor  int
+	}{
+		{
+			name:        "compliant",
+			mechs:       []string{"builtin:prelogin", "Crypt:Check,privileged", "loginwindow:done"},
+			wantVerdict: VerdictCompliant,
+			wantDiff:    Diff{Missing: []string{}, Misplaced: []string{}, Extra: []string{}},
+			wantAnchor:  2,
+		},
+		{
+			name:        "missing",
+			mechs:       []string{"builtin:prelogin", "loginwindow:done"},
+			wantVerdict: VerdictNonCompliant,
+			wantDiff:    Diff{Missing: []string{"Crypt:Check,privileged"}, Misplaced: []string{}, Extra: []string{}},
+			wantAnchor:  1,
+		},
+		{
+			name:        "misplaced, with mechanisms from python Crypt",
+			mechs:       []string{"builtin:prelogin", "loginwindow:done", "Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+			wantVerdict: VerdictNonCompliant,
+			wantDiff:    Diff{Missing: []string{}, Misplaced: []string{"Crypt:Check,privileged"}, Extra: []string{"Crypt:CryptGUI", "Crypt:Enablement,privileged"}},
+			wantAnchor:  1,
+		},
+		{
+			name:        "in place, after a mechanism from python Crypt",
+			mechs:       []string{"builtin:prelogin", "Crypt:CryptGUI", "Crypt:Check,privileged", "loginwindow:done"},
+			wantVerdict: VerdictNonCompliant,
+			wantDiff:    Diff{Missing: []string{}, Misplaced: []string{}, Extra: []string{"Crypt:CryptGUI"}},
+			wantAnchor:  3,
+		},
+		{
+			name:        "added twice",
+			mechs:       []string{"Crypt:Check,privileged", "builtin:prelogin", "Crypt:Check,privileged", "loginwindow:done"},
+			wantVerdict: VerdictNonCompliant,
+			wantDiff:    Diff{Missing: []string{}, Misplaced: []string{"Crypt:Check,privileged"}, Extra: []string{"Crypt:Check,privileged"}},
+			wantAnchor:  3,
+		},
+		{
+			name:        "no anchor",
+			mechs:       []string{"builtin:prelogin", "Crypt:CryptGUI"},
+			wantVerdict: VerdictError,
+			wantDiff:    Diff{Missing: []string{"Crypt:Check,privileged"}, Misplaced: []string{}, Extra: []string{"Crypt:CryptGUI"}},
+			wantAnchor:  -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := buildReport(AuthDB{Mechanisms: tt.mechs}, defaultSpec(t))
+			assert.Equal(t, tt.wantVerdict, report.Verdict)
+			assert.Equal(t, tt.wantDiff, report.Diff)
+			assert.Equal(t, tt.wantAnchor, report.AnchorIndex)
+			assert.Equal(t, tt.wantVerdict == VerdictError, report.Expected == nil)
+		})
+	}
+}
+
+func TestReportPrintJSON(t *testing.T) {
+	mechs := []string{"builtin:prelogin", "loginwindow:done", "Crypt:Check,privileged"}
+	var buf bytes.Buffer
+	require.NoError(t, buildReport(AuthDB{Mechanisms: mechs}, defaultSpec(t)).PrintJSON(&buf))
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, "noncompliant", out["verdict"])
+	assert.Equal(t, float64(1), out["anchor_index"])
+	assert.Equal(t, []interface{}{"builtin:prelogin", "Crypt:Check,privileged", "loginwindow:done"}, out["expected"])
+	assert.Equal(t, map[string]interface{}{
+		"missing":   []interface{}{},
+		"misplaced": []interface{}{"Crypt:Check,privileged"},
+		"extra":     []interface{}{},
+	}, out["diff"])
+}
@@ -0,0 +1,69 @@
+package authmechs
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata") // nolint:gochecknoglobals
+
+// sharedRights are rights in authdb's testdata that are also run through the
+// golden tests here, rather than keeping a second copy.
+var sharedRights = []string{ // nolint:gochecknoglobals
+	filepath.Join("..", "authdb", "testdata", "sequoia_custom_rules.plist"),
+}
+
+// TestAuthDBGolden sets the Crypt mechanisms on rights captured from several
+// macOS releases and checks nothing but the mechanisms changed.
+func TestAuthDBGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.plist"))
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+	inputs = append(inputs, sharedRights...)
+
+	spec := defaultSpec(t)
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".plist")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			require.NoError(t, err)
+
+			db, err := authdb.Parse(RightName, raw)
+			require.NoError(t, err)
+			db, err = setMechsInDB(db, spec)
+			require.NoError(t, err)
+			got, err := db.Bytes()
+			require.NoError(t, err)
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				require.NoError(t, os.WriteFile(golden, got, 0644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+
+			// only the mechanisms changed
+			original, err := authdb.Parse(RightName, raw)
+			require.NoError(t, err)
+			changes, err := authdb.Diff(original, db)
+			require.NoError(t, err)
+			for _, change := range changes {
+				assert.Equal(t, "mechanisms", change.Key)
+			}
+
+			written, err := authdb.Parse(RightName, got)
+			require.NoError(t, err)
+			ok, err := checkMechsInDB(written, spec)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package authmechs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+)
+
+// MechanismSpec describes the mechanisms Crypt adds to system.login.console
+// and where they go, so sites can fit them into their own login stack.
+type MechanismSpec struct {
+	// Insert is the mechanisms to add, in order.
+	Insert []string
+	// Anchor is the mechanism Insert is placed next to.
+	Anchor string
+	// Placement is pref.PlacementBefore or pref.PlacementAfter the anchor.
+	// Empty means before.
+	Placement string
+	// Offset moves the insertion point by this many mechanisms, counted once
+	// Insert and Purge have been removed.
+	Offset int
+	// Purge is removed before Insert is placed, such as mechanisms older
+	// versions of Crypt added. Insert is always removed as well.
+	Purge []string
+	// After and Before are patterns, as used by path.Match, of mechanisms
+	// Insert must come after and before, such as other plugins' mechanisms.
+	// They override the placement from Anchor and Offset.
+	After  []string
+	Before []string
+}
+
+// SpecFromConfig returns the MechanismSpec set by the AuthMechs preferences.
+func SpecFromConfig(cfg pref.Config) MechanismSpec {
+	return MechanismSpec{
+		Insert:    cfg.AuthMechsInsert,
+		Anchor:    cfg.AuthMechsAnchor,
+		Placement: cfg.AuthMechsPlacement,
+		Offset:    cfg.AuthMechsOffset,
+		Purge:     cfg.AuthMechsPurge,
+		After:     cfg.AuthMechsAfter,
+		Before:    cfg.AuthMechsBefore,
+	}
+}
+
+// Validate checks the spec can be placed.
+func (s MechanismSpec) Validate() error {
+	if len(s.Insert) == 0 {
+		return errors.New("AuthMechsInsert has no mechanisms")
+	}
+	if s.Anchor == "" {
+		return errors.New("AuthMechsAnchor cannot be empty")
+	}
+	if indexOf(s.removals(), s.Anchor) >= 0 {
+		return fmt.Errorf("AuthMechsAnchor %q would be removed by AuthMechsInsert or AuthMechsPurge", s.Anchor)
+	}
+	switch s.Placement {
+	case "", pref.PlacementBefore, pref.PlacementAfter:
+	default:
+		return fmt.Errorf("AuthMechsPlacement must be %q or %q, got %q", pref.PlacementBefore, pref.PlacementAfter, s.Placement)
+	}
+	for _, pattern := range append(append([]string{}, s.After...), s.Before...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid mechanism pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// constraint returns pref.PlacementAfter if Insert must come after mech,
+// pref.PlacementBefore if it must come before it, or "" if mech isn't
+// constrained.
+func (s MechanismSpec) constraint(mech string) string {
+	if matchesAny(s.After, mech) {
+		return pref.PlacementAfter
+	}
+	if matchesAny(s.Before, mech) {
+		return pref.PlacementBefore
+	}
+	return ""
+}
+
+func matchesAny(patterns []string, mech string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mech); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removals returns every mechanism removed before Insert is placed.
+func (s MechanismSpec) removals() []string {
+	return append(append([]string{}, s.Insert...), s.Purge...)
+}
+
+// place returns mechs as the spec wants them: with Insert and Purge removed,
+// then Insert placed next to Anchor and moved, if needed, to come after every
+// mechanism matching After and before every one matching Before. Check, Set
+// and Ensure all compare against this, so they always agree.
+func (s MechanismSpec) place(mechs []string) ([]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	purged := removeMechs(mechs, s.removals())
+	anchor := indexOf(purged, s.Anchor)
+	if anchor < 0 {
+		return nil, fmt.Errorf("anchor mechanism %q is not in system.login.console", s.Anchor)
+	}
+
+	pos := anchor + s.Offset
+	if s.Placement == pref.PlacementAfter {
+		pos++
+	}
+	if pos < 0 || pos > len(purged) {
+		return nil, fmt.Errorf("AuthMechsOffset %d places the mechanisms outside system.login.console", s.Offset)
+	}
+
+	// the range of positions that satisfies After and Before
+	lo, hi := 0, len(purged)
+	for i, mech := range purged {
+		switch s.constraint(mech) {
+		case pref.PlacementAfter:
+			lo = i + 1
+		case pref.PlacementBefore:
+			if hi == len(purged) {
+				hi = i
+			}
+		}
+	}
+	if lo > hi {
+		return nil, fmt.Errorf("mechanisms cannot come after %s and before %s, which comes first", purged[lo-1], purged[hi])
+	}
+	if pos < lo {
+		pos = lo
+	} else if pos > hi {
+		pos = hi
+	}
+
+	return insertMechsAtPosition(purged, s.Insert, pos), nil
+}
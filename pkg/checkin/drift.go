@@ -0,0 +1,202 @@
+package checkin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb"
+	"github.com/grahamgilbert/crypt/pkg/authmechs"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// driftHistoryLimit is how many drift events are kept in the state.
+const driftHistoryLimit = 50
+
+// errAuthDBDrift is returned when Crypt's mechanisms have been found removed
+// from system.login.console AuthMechsDriftThreshold times within
+// AuthMechsDriftWindow.
+var errAuthDBDrift = errors.New("Crypt's mechanisms keep being removed from system.login.console")
+
+// EnsureAuthMechs puts Crypt's mechanisms back in system.login.console if
+// they are not as configured, and records the drift in the state.
+//
+// Parameters:
+//   - r: The runner used to run security and sw_vers.
+//   - cfg: The configuration describing the mechanisms and drift threshold.
+//   - st: The state store the drift is recorded in.
+//
+// Returns:
+//   - error: errAuthDBDrift if the mechanisms have drifted too often, or an
+//     error if they could not be checked or put back.
+func EnsureAuthMechs(r utils.Runner, cfg pref.Config, st *state.Store) error {
+	return ensureAuthMechs(r, authdb.New(r), cfg, st, time.Now())
+}
+
+// ensureAuthMechs is EnsureAuthMechs with the authorization database and
+// time given. Placing the mechanisms for the first time, or after the
+// AuthMechs preferences changed, is not drift, as nothing else moved them.
+func ensureAuthMechs(r utils.Runner, c *authdb.Client, cfg pref.Config, st *state.Store, now time.Time) error {
+	spec := authmechs.SpecFromConfig(cfg)
+	hash, err := specHash(spec)
+	if err != nil {
+		return err
+	}
+	s, err := st.Load()
+	if err != nil {
+		return errors.Wrap(err, "failed to load state")
+	}
+
+	drift, err := authmechs.Ensure(c, spec)
+	if err != nil {
+		return errors.Wrap(err, "failed to ensure auth mechs")
+	}
+
+	if s.AuthMechsSpec != hash {
+		if drift != nil {
+			log.Println("Placed Crypt's mechanisms with the current AuthMechs preferences for the first time, not counting it as drift")
+		}
+		err := st.Update(func(s *state.State) error {
+			s.AuthMechsSpec = hash
+			return nil
+		})
+		return errors.Wrap(err, "failed to record the AuthMechs preferences")
+	}
+	if drift == nil {
+		return nil
+	}
+	return recordDrift(r, cfg, st, drift, now)
+}
+
+// specHash returns a hash of spec, to tell whether the mechanisms were placed
+// with the same preferences before.
+func specHash(spec authmechs.MechanismSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode the AuthMechs preferences")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordDrift adds drift to the state and checks it against the threshold.
+//
+// Parameters:
+//   - r: The runner used to get the macOS build.
+//   - cfg: The configuration holding the drift threshold and window.
+//   - st: The state store the drift is recorded in.
+//   - drift: The drift Ensure corrected.
+//   - now: When the drift was found.
+//
+// Returns:
+//   - error: errAuthDBDrift if the threshold is reached, or an error if the
+//     state could not be updated.
+func recordDrift(r utils.Runner, cfg pref.Config, st *state.Store, drift *authmechs.Drift, now time.Time) error {
+	build, err := utils.GetOSBuild(r.Runner)
+	if err != nil {
+		log.Printf("Failed to get the macOS build: %v", err)
+	}
+	event := state.DriftEvent{Time: now, OSBuild: build, Before: drift.Before, After: drift.After}
+
+	var count int
+	err = st.Update(func(s *state.State) error {
+		s.AuthDBDrift = append(s.AuthDBDrift, event)
+		if extra := len(s.AuthDBDrift) - driftHistoryLimit; extra > 0 {
+			s.AuthDBDrift = s.AuthDBDrift[extra:]
+		}
+		count = countDrift(s.AuthDBDrift, cfg.AuthMechsDriftWindow, now)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to record AuthDB drift")
+	}
+
+	log.Printf("Crypt's mechanisms were not as configured in system.login.console, %d time(s) in the last %d hour(s)", count, cfg.AuthMechsDriftWindow)
+	if cfg.AuthMechsDriftThreshold > 0 && count >= cfg.AuthMechsDriftThreshold {
+		return errors.Wrapf(errAuthDBDrift, "%d times in the last %d hour(s)", count, cfg.AuthMechsDriftWindow)
+	}
+	return nil
+}
+
+// countDrift returns how many events happened within windowHours of now.
+func countDrift(events []state.DriftEvent, windowHours int, now time.Time) int {
+	since := now.Add(-time.Duration(windowHours) * time.Hour)
+	count := 0
+	for _, e := range events {
+		if e.Time.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// DriftStatus summarises the AuthDB drift recorded in the state.
+type DriftStatus struct {
+	WindowHours int `json:"window_hours"`
+	Threshold   int `json:"threshold"`
+	// InWindow is how many events happened within the window.
+	InWindow int `json:"in_window"`
+	// Failing is whether InWindow has reached the threshold.
+	Failing bool               `json:"failing"`
+	Events  []state.DriftEvent `json:"events"`
+}
+
+// GetDriftStatus reads the AuthDB drift from the state.
+//
+// Parameters:
+//   - st: The state store the drift is recorded in.
+//   - cfg: The configuration holding the drift threshold and window.
+//   - now: The time the window ends at.
+//
+// Returns:
+//   - DriftStatus: The drift recorded and whether it has reached the threshold.
+//   - error: An error if the state could not be loaded.
+func GetDriftStatus(st *state.Store, cfg pref.Config, now time.Time) (DriftStatus, error) {
+	s, err := st.Load()
+	if err != nil {
+		return DriftStatus{}, err
+	}
+	status := DriftStatus{
+		WindowHours: cfg.AuthMechsDriftWindow,
+		Threshold:   cfg.AuthMechsDriftThreshold,
+		InWindow:    countDrift(s.AuthDBDrift, cfg.AuthMechsDriftWindow, now),
+		Events:      s.AuthDBDrift,
+	}
+	if status.Events == nil {
+		status.Events = []state.DriftEvent{}
+	}
+	status.Failing = status.Threshold > 0 && status.InWindow >= status.Threshold
+	return status, nil
+}
+
+// Print writes the drift status to w as text, latest event first.
+func (s DriftStatus) Print(w io.Writer) error {
+	threshold := "never fails"
+	if s.Threshold > 0 {
+		threshold = fmt.Sprintf("fails at %d", s.Threshold)
+	}
+	fmt.Fprintf(w, "AuthDB drift: %d time(s) in the last %d hour(s), %s\n", s.InWindow, s.WindowHours, threshold)
+	for i := len(s.Events) - 1; i >= 0; i-- {
+		e := s.Events[i]
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%s  macOS %s\n", e.Time.Local().Format(time.RFC3339), utils.OrDash(e.OSBuild))
+		fmt.Fprintf(w, "  Before: %s\n", strings.Join(e.Before, ", "))
+		fmt.Fprintf(w, "  After:  %s\n", strings.Join(e.After, ", "))
+	}
+	return nil
+}
+
+// PrintJSON writes the drift status to w as a JSON object.
+func (s DriftStatus) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
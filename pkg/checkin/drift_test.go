@@ -0,0 +1,155 @@
+package checkin
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/authdb/authdbtest"
+	"github.com/grahamgilbert/crypt/pkg/authmechs"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordDrift(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state.json"))
+	r := utils.Runner{Runner: utils.MockCmdRunner{Output: "23E224\n"}}
+	cfg := pref.Config{AuthMechsDriftThreshold: 3, AuthMechsDriftWindow: 24}
+	drift := &authmechs.Drift{
+		Before: []string{"loginwindow:done"},
+		After:  []string{"Crypt:Check,privileged", "loginwindow:done"},
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// an old drift is outside the window
+	require.NoError(t, recordDrift(r, cfg, st, drift, now.Add(-48*time.Hour)))
+	require.NoError(t, recordDrift(r, cfg, st, drift, now.Add(-2*time.Hour)))
+	require.NoError(t, recordDrift(r, cfg, st, drift, now.Add(-time.Hour)))
+	err := recordDrift(r, cfg, st, drift, now)
+	assert.True(t, errors.Is(err, errAuthDBDrift))
+	assert.Contains(t, err.Error(), "3 times in the last 24 hour(s)")
+
+	s, err := st.Load()
+	require.NoError(t, err)
+	require.Len(t, s.AuthDBDrift, 4)
+	assert.Equal(t, state.DriftEvent{Time: now, OSBuild: "23E224", Before: drift.Before, After: drift.After}, s.AuthDBDrift[3])
+
+	// a threshold of 0 never fails
+	cfg.AuthMechsDriftThreshold = 0
+	assert.NoError(t, recordDrift(r, cfg, st, drift, now))
+}
+
+const testLoginConsole = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>class</key>
+	<string>evaluate-mechanisms</string>
+	<key>mechanisms</key>
+	<array>
+		<string>builtin:prelogin</string>
+		<string>loginwindow:done</string>
+	</array>
+</dict>
+</plist>
+`
+
+func TestEnsureAuthMechs(t *testing.T) {
+	fake := authdbtest.New(map[string]string{authmechs.RightName: testLoginConsole})
+	c := fake.Client(t)
+	r := utils.Runner{Runner: utils.MockCmdRunner{Output: "23E224\n"}}
+	st := state.New(filepath.Join(t.TempDir(), "state.json"))
+	cfg := testConfig(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// first install
+	require.NoError(t, ensureAuthMechs(r, c, cfg, st, now))
+	s, err := st.Load()
+	require.NoError(t, err)
+	assert.Empty(t, s.AuthDBDrift)
+	assert.NotEmpty(t, s.AuthMechsSpec)
+	assert.Equal(t, 1, fake.Writes[authmechs.RightName])
+
+	// nothing moved
+	require.NoError(t, ensureAuthMechs(r, c, cfg, st, now))
+	assert.Equal(t, 1, fake.Writes[authmechs.RightName])
+
+	// something else removed the mechanisms
+	fake.Rights[authmechs.RightName] = testLoginConsole
+	require.NoError(t, ensureAuthMechs(r, c, cfg, st, now))
+	s, err = st.Load()
+	require.NoError(t, err)
+	require.Len(t, s.AuthDBDrift, 1)
+	assert.Equal(t, []string{"builtin:prelogin", "loginwindow:done"}, s.AuthDBDrift[0].Before)
+	assert.Equal(t, "23E224", s.AuthDBDrift[0].OSBuild)
+
+	// the preferences changed
+	hash := s.AuthMechsSpec
+	cfg.AuthMechsPlacement = "after"
+	require.NoError(t, ensureAuthMechs(r, c, cfg, st, now))
+	assert.Equal(t, 3, fake.Writes[authmechs.RightName])
+	s, err = st.Load()
+	require.NoError(t, err)
+	assert.Len(t, s.AuthDBDrift, 1)
+	assert.NotEqual(t, hash, s.AuthMechsSpec)
+}
+
+func TestRecordDriftLimit(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state.json"))
+	// the build is left out if sw_vers fails
+	r := utils.Runner{Runner: utils.MockCmdRunner{Err: errors.New("sw_vers failed")}}
+	cfg := pref.Config{AuthMechsDriftWindow: 24}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < driftHistoryLimit+5; i++ {
+		require.NoError(t, recordDrift(r, cfg, st, &authmechs.Drift{}, start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	s, err := st.Load()
+	require.NoError(t, err)
+	require.Len(t, s.AuthDBDrift, driftHistoryLimit)
+	assert.Equal(t, start.Add(5*time.Minute), s.AuthDBDrift[0].Time)
+	assert.Empty(t, s.AuthDBDrift[0].OSBuild)
+}
+
+func TestGetDriftStatus(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state.json"))
+	cfg := pref.Config{AuthMechsDriftThreshold: 2, AuthMechsDriftWindow: 24}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	status, err := GetDriftStatus(st, cfg, now)
+	require.NoError(t, err)
+	assert.False(t, status.Failing)
+	assert.Empty(t, status.Events)
+
+	require.NoError(t, st.Save(state.State{AuthDBDrift: []state.DriftEvent{
+		{Time: now.Add(-3 * time.Hour), OSBuild: "23E224", Before: []string{"loginwindow:done"}, After: []string{"Crypt:Check,privileged", "loginwindow:done"}},
+		{Time: now.Add(-time.Hour), Before: []string{"a"}, After: []string{"b"}},
+	}}))
+	status, err = GetDriftStatus(st, cfg, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, status.InWindow)
+	assert.True(t, status.Failing)
+
+	var buf bytes.Buffer
+	require.NoError(t, status.Print(&buf))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "AuthDB drift: 2 time(s) in the last 24 hour(s), fails at 2\n"))
+	assert.Contains(t, out, "macOS 23E224\n  Before: loginwindow:done\n  After:  Crypt:Check,privileged, loginwindow:done\n")
+	// latest first
+	assert.Less(t, strings.Index(out, "macOS -"), strings.Index(out, "macOS 23E224"))
+
+	buf.Reset()
+	require.NoError(t, status.PrintJSON(&buf))
+	var decoded DriftStatus
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.True(t, decoded.Failing)
+	assert.Len(t, decoded.Events, 2)
+}
@@ -9,12 +9,15 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/googleapis/enterprise-certificate-proxy/darwin"
-	"github.com/grahamgilbert/crypt/pkg/authmechs"
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
 	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
 	"github.com/grahamgilbert/crypt/pkg/utils"
 	"github.com/groob/plist"
 	"github.com/hashicorp/go-version"
@@ -29,118 +32,185 @@ type CryptData struct {
 	EscrowSuccess bool      `plist:"escrow_success"`
 	HardwareUUID  string    `plist:"HardwareUUID"`
 	EnabledDate   string    `plist:"EnabledDate"`
+	// LVUUID, PVUUID and LVGUUID identify the encrypted volume, its physical
+	// store and its volume group, so the server can tell keys for different
+	// volumes of the same Mac apart.
+	LVUUID  string `plist:"LVUUID"`
+	PVUUID  string `plist:"PVUUID"`
+	LVGUUID string `plist:"LVGUUID"`
+	// KeyTypes is which recovery keys FileVault has, or nil if unknown. It
+	// is checked on every run rather than kept in the plist.
+	KeyTypes *recoveryKeyTypes `plist:"-"`
 }
 
-// RunEscrow manages the process of escrowing a FileVault recovery key to a server.
+// RunEscrow manages the process of escrowing a FileVault recovery key to a
+// server, and records what it did in the journal.
 // Parameters:
 //   - r: Runner interface for executing system commands
-//   - p: PrefInterface for accessing configuration preferences
+//   - p: PrefInterface used to import a LastEscrow date left in preferences
+//   - cfg: Config snapshot of the preferences for this run
+//   - st: Store holding the runtime state, such as the last escrow date
+//   - secrets: SecretStore holding the recovery key when using the keychain
+//   - j: Journal the outcome of the run is appended to
 //
 // Returns:
 //   - error: Any error encountered during the escrow process
-func RunEscrow(r utils.Runner, p pref.PrefInterface) error {
-	// Get preferences early
-	useKeychain, err := p.GetBool("StoreRecoveryKeyInKeychain")
-	if err != nil {
-		return errors.Wrap(err, "failed to get StoreRecoveryKeyInKeychain preference")
-	}
-
-	manageAuthMechs, err := p.GetBool("ManageAuthMechs")
-	if err != nil {
-		return errors.Wrap(err, "failed to get manage auth mechs preference")
-	}
+func RunEscrow(r utils.Runner, p pref.PrefInterface, cfg pref.Config, st *state.Store, secrets utils.SecretStore, j *journal.Journal) error {
+	start := time.Now()
+	entry := journal.Entry{Time: start}
+	err := runEscrow(r, p, cfg, st, secrets, &entry)
+	recordJournal(j, &entry, start, err)
+	return err
+}
 
-	if manageAuthMechs {
-		if err := authmechs.Ensure(r); err != nil {
-			return errors.Wrap(err, "failed to ensure auth mechs")
+// runEscrow implements RunEscrow, filling in entry as it goes.
+func runEscrow(r utils.Runner, p pref.PrefInterface, cfg pref.Config, st *state.Store, secrets utils.SecretStore, entry *journal.Entry) (err error) {
+	useKeychain := cfg.StoreRecoveryKeyInKeychain
+	plistPath := cfg.OutputPath
+
+	if err := importLegacyLastEscrow(p, st); err != nil {
+		return errors.Wrap(err, "failed to import last escrow date")
+	}
+
+	if cfg.ManageAuthMechs {
+		driftErr := EnsureAuthMechs(r, cfg, st)
+		if errors.Is(driftErr, errAuthDBDrift) {
+			// escrow anyway, but fail the run so monitoring sees the drift
+			defer func() {
+				if err == nil {
+					err = driftErr
+				}
+			}()
+		} else if driftErr != nil {
+			return driftErr
 		}
 	}
 
-	removePlist, err := p.GetBool("RemovePlist")
-	if err != nil {
-		return errors.Wrap(err, "failed to get remove plist preference")
+	if cfg.RotateUsedKey && cfg.ValidateKey && !cfg.RemovePlist {
+		log.Println("Checking that current key is valid.")
+		if err := rotateInvalidKey(plistPath, r, cfg, secrets); err != nil {
+			return errors.Wrap(err, "rotateInvalidKey")
+		}
 	}
 
-	plistPath, err := p.GetString("OutputPath")
+	keyTypes, err := checkRecoveryKeyTypes(r, cfg, entry)
 	if err != nil {
-		return errors.Wrap(err, "failed to get output path")
+		return err
 	}
 
-	rotateUsedKey, err := p.GetBool("RotateUsedKey")
-	if err != nil {
-		return errors.Wrap(err, "failed to get rotate used key preference")
-	}
+	var cryptData CryptData
+	history := keyhistory.New(secrets, cfg.KeyHistoryLimit)
 
-	validateKey, err := p.GetBool("ValidateKey")
+	runState, err := st.Load()
 	if err != nil {
-		return errors.Wrap(err, "failed to get validate key preference")
+		return errors.Wrap(err, "failed to load state")
 	}
 
-	if rotateUsedKey && validateKey && !removePlist {
-		log.Println("Checking that current key is valid.")
-		if err := rotateInvalidKey(plistPath, r, p); err != nil {
-			return errors.Wrap(err, "rotateInvalidKey")
-		}
-	}
-
-	var cryptData CryptData
-
 	if useKeychain {
 		log.Println("Configured to use keychain for recovery key storage.")
-		recoveryKey, err := utils.GetSecret()
+		secret, err := secrets.GetSecret(utils.RecoveryKeySecret)
 		if err != nil {
 			return errors.Wrap(err, "failed to get recovery key from keychain.")
 		}
 
+		fingerprint, err := history.Fingerprint(secret.Value)
+		if err != nil {
+			return errors.Wrap(err, "failed to fingerprint recovery key")
+		}
+
 		// create our cryptData from current system information since we don't have it in the plist
-		cryptData, err = buildCryptData(p, r)
+		cryptData, err = buildCryptData(cfg, r, lastEscrowForKey(runState.LastEscrow, secret, fingerprint))
 		if err != nil {
 			return errors.Wrap(err, "failed to build crypt data")
 		}
-		cryptData.RecoveryKey = recoveryKey
+		cryptData.RecoveryKey = secret.Value
 	} else {
 		// Not using keychain, gather the cryptData from the plist on disk.
 		// Check if plist exists
 		if _, err := os.Stat(plistPath); os.IsNotExist(err) {
+			entry.Decision = journal.NoKey
 			return nil
 		} else if err != nil {
 			return errors.Wrap(err, "failed to check if plist exists")
 		}
 
-		cryptData, err = parsePlist(plistPath)
+		cryptData, err = parsePlist(plistPath, secrets)
 		if err != nil {
 			return errors.Wrap(err, "failed to parse plist")
 		}
+		if err := encryptPlistAtRest(plistPath, cryptData, cfg, secrets); err != nil {
+			return err
+		}
+		addVolumeIdentifiers(&cryptData, r)
+	}
+
+	cryptData.KeyTypes = keyTypes
+
+	fingerprint, err := history.Fingerprint(cryptData.RecoveryKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to fingerprint recovery key")
+	}
+	// keep a copy of the key so it survives being rotated before the next
+	// key has been escrowed. The history lives in the keychain, so it is only
+	// kept when the key is stored there, otherwise removing the plist would
+	// still leave the key behind.
+	if useKeychain {
+		if _, err := history.Add(cryptData.RecoveryKey); err != nil {
+			return errors.Wrap(err, "failed to add recovery key to history")
+		}
 	}
+	entry.Fingerprint = fingerprint
+	log.Printf("Recovery key fingerprint: %s", keyhistory.Short(fingerprint))
 
-	escrowRequired, err := escrowRequired(cryptData, p)
+	escrowRequired, err := escrowRequired(cryptData, cfg, runState.LastEscrowFingerprint, fingerprint)
 	if err != nil {
 		return errors.Wrap(err, "failed to check if escrow is required")
 	}
 
 	if !escrowRequired {
 		log.Printf("Escrow not required")
+		entry.Decision = journal.Skipped
 		return nil
 	}
 
 	// Handle escrow
-	var keyRotated bool
-	mTLScommonName, err := p.GetString("CommonNameForEscrow")
-	if err != nil {
-		return errors.Wrap(err, "failed to get mTLS common name for escrow")
+	server, err := buildCheckinURL(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to build checkin URL")
+	}
+	entry.Destination = server
+	keyRotated, err := escrowKey(cryptData, r, cfg, secrets)
+	if err == nil {
+		entry.Decision = journal.Escrowed
+		// sendRequest only succeeds on a 200, curl doesn't report the status
+		// of a request that succeeded
+		if cfg.CommonNameForEscrow != "" {
+			entry.HTTPStatus = http.StatusOK
+		}
+		if keyRotated {
+			entry.Rotation = journal.RotationServer
+		}
+	}
+	if recordErr := recordEscrow(st, server, err, keyRotated, fingerprint); recordErr != nil {
+		if err == nil {
+			return errors.Wrap(recordErr, "failed to record last escrow date")
+		}
+		log.Printf("Failed to record escrow failure: %v", recordErr)
 	}
-
-	keyRotated, err = escrowKey(cryptData, r, p, mTLScommonName)
 	if err != nil {
 		return errors.Wrap(err, "escrow operation failed")
 	}
 
-	// if using the keychain and the key wasn't rotated, update the preference last escrow date and return
-	if useKeychain && !keyRotated {
-		// write the last escrow date to preferences if using keychain.
-		err = p.SetDate("LastEscrow", time.Now())
-		if err != nil {
-			return errors.Wrap(err, "failed to set last escrow date")
+	// if using the keychain the last escrow date is all we need to keep,
+	// in the state, the key history and on the keychain item itself
+	if useKeychain {
+		if err := history.MarkEscrowed(cryptData.RecoveryKey, server); err != nil {
+			log.Printf("Failed to record escrow in key history: %v", err)
+		}
+		if !keyRotated {
+			if err := recordKeyMetadata(secrets, cryptData, fingerprint, server); err != nil {
+				log.Printf("Failed to record escrow on keychain item: %v", err)
+			}
 		}
 		return nil
 	}
@@ -149,12 +219,12 @@ func RunEscrow(r utils.Runner, p pref.PrefInterface) error {
 	if !keyRotated {
 		cryptData.LastRun = time.Now()
 		cryptData.EscrowSuccess = true
-		if err := writePlist(cryptData, plistPath); err != nil {
+		if err := writePlist(cryptData, plistPath, cfg, secrets); err != nil {
 			return errors.Wrap(err, "failed to write plist")
 		}
 	}
 
-	if removePlist {
+	if cfg.RemovePlist {
 		if err := os.Remove(plistPath); err != nil {
 			return errors.Wrap(err, "failed to remove plist")
 		}
@@ -165,13 +235,14 @@ func RunEscrow(r utils.Runner, p pref.PrefInterface) error {
 
 // buildCryptData constructs a CryptData structure with current system information.
 // Parameters:
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
 //   - r: Runner interface for executing system commands
+//   - lastEscrow: When the key was last escrowed, from the state store
 //
 // Returns:
 //   - CryptData: Populated structure with system information
 //   - error: Any error encountered during data collection
-func buildCryptData(p pref.PrefInterface, r utils.Runner) (CryptData, error) {
+func buildCryptData(cfg pref.Config, r utils.Runner, lastEscrow time.Time) (CryptData, error) {
 	var cryptData CryptData
 	var err error
 
@@ -186,43 +257,47 @@ func buildCryptData(p pref.PrefInterface, r utils.Runner) (CryptData, error) {
 
 	// Handle skipped users
 	if userShouldBeSkipped(cryptData.EnabledUser) || cryptData.EnabledUser == "" {
-		cryptData.EnabledUser, err = getEnabledUser(p, r)
+		cryptData.EnabledUser, err = getEnabledUser(cfg, r)
 		if err != nil {
 			return CryptData{}, errors.Wrap(err, "failed to get enabled user")
 		}
 	}
 
 	// Get last run time
-	lastRun, err := p.GetDate("LastEscrow")
-	if err != nil {
-		return CryptData{}, errors.Wrap(err, "failed to get last escrow date")
-	}
-	if lastRun != (time.Time{}) {
-		cryptData.LastRun = lastRun
+	if !lastEscrow.IsZero() {
+		cryptData.LastRun = lastEscrow
 	}
 
+	addVolumeIdentifiers(&cryptData, r)
+
 	return cryptData, nil
 }
 
 // escrowRequired determines if a key needs to be escrowed based on the last escrow
-// time and the configured escrow interval.
+// time and the configured escrow interval. A key that is not the one last
+// escrowed is escrowed straight away, whatever the interval.
 // Parameters:
 //   - cryptData: CryptData containing the last escrow time
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
+//   - escrowedFingerprint: Fingerprint of the key last escrowed, empty if unknown
+//   - fingerprint: Fingerprint of the current key
 //
 // Returns:
 //   - bool: True if escrow is required, false otherwise
 //   - error: Any error encountered during the check
-func escrowRequired(cryptData CryptData, p pref.PrefInterface) (bool, error) {
+func escrowRequired(cryptData CryptData, cfg pref.Config, escrowedFingerprint string, fingerprint string) (bool, error) {
 	if cryptData.LastRun.IsZero() {
 		return true, nil
 	}
 
-	escrowInterval, err := p.GetInt("KeyEscrowInterval")
-	if err != nil {
-		return false, errors.Wrap(err, "failed to get escrow interval")
+	if escrowedFingerprint != "" && escrowedFingerprint != fingerprint {
+		log.Printf("Recovery key %s is not the key last escrowed (%s). Escrowing now.",
+			keyhistory.Short(fingerprint), keyhistory.Short(escrowedFingerprint))
+		return true, nil
 	}
 
+	escrowInterval := cfg.KeyEscrowInterval
+
 	now := time.Now()
 	nowMinusInterval := now.Add(-time.Duration(escrowInterval) * time.Hour)
 
@@ -247,42 +322,57 @@ func userShouldBeSkipped(user string) bool {
 }
 
 // parsePlist reads and unmarshals a property list file into a CryptData structure.
+// The file must be owned by root and not writable by anyone else. An encrypted
+// RecoveryKey is decrypted, and one that isn't is returned as is.
 // Parameters:
 //   - plistPath: String path to the plist file
+//   - secrets: SecretStore holding the key the RecoveryKey is encrypted with
 //
 // Returns:
 //   - CryptData: Unmarshaled data structure
 //   - error: Any error encountered during parsing
-func parsePlist(plistPath string) (CryptData, error) {
+func parsePlist(plistPath string, secrets utils.SecretStore) (CryptData, error) {
 	var cryptData CryptData
-	plistBytes, err := os.ReadFile(plistPath)
+	err := readPlist(plistPath, &cryptData)
 	if err != nil {
-		return cryptData, errors.Wrap(err, "failed to read plist file")
+		return CryptData{}, err
 	}
 
-	err = plist.Unmarshal(plistBytes, &cryptData)
+	cryptData.RecoveryKey, err = decryptRecoveryKey(cryptData.RecoveryKey, secrets)
 	if err != nil {
-		return cryptData, errors.Wrap(err, "failed to unmarshal plist")
+		return CryptData{}, err
 	}
 
 	return cryptData, nil
 }
 
 // writePlist marshals CryptData into a property list format and writes it to the
-// specified file path.
+// specified file path. The file is replaced atomically, owned by root:wheel and
+// only readable by root. If EncryptRecoveryKeyPlist is set the RecoveryKey is
+// encrypted first.
 // Parameters:
 //   - cryptData: CryptData to be written
 //   - plistPath: String path where the plist should be written
+//   - cfg: Config snapshot of the preferences for this run
+//   - secrets: SecretStore holding the key the RecoveryKey is encrypted with
 //
 // Returns:
 //   - error: Any error encountered during writing
-func writePlist(cryptData CryptData, plistPath string) error {
+func writePlist(cryptData CryptData, plistPath string, cfg pref.Config, secrets utils.SecretStore) error {
+	if cfg.EncryptRecoveryKeyPlist {
+		var err error
+		cryptData.RecoveryKey, err = encryptRecoveryKey(cryptData.RecoveryKey, secrets)
+		if err != nil {
+			return err
+		}
+	}
+
 	plistBytes, err := plist.Marshal(cryptData)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal plist")
 	}
 
-	err = os.WriteFile(plistPath, plistBytes, 0644)
+	err = utils.WriteFileAtomicOwned(plistPath, plistBytes, 0600, plistUID, plistGID)
 	if err != nil {
 		return errors.Wrap(err, "failed to write plist")
 	}
@@ -295,11 +385,12 @@ func writePlist(cryptData CryptData, plistPath string) error {
 // Parameters:
 //   - plistPath: String path to the plist file
 //   - r: Runner interface for executing system commands
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
+//   - secrets: SecretStore holding the recovery key when using the keychain
 //
 // Returns:
 //   - error: Any error encountered during rotation
-func rotateInvalidKey(plistPath string, r utils.Runner, p pref.PrefInterface) error {
+func rotateInvalidKey(plistPath string, r utils.Runner, cfg pref.Config, secrets utils.SecretStore) error {
 	_, err := utils.GetConsoleUser()
 	if err != nil {
 		// a work aroud for https://github.com/grahamgilbert/crypt/issues/68
@@ -321,17 +412,14 @@ func rotateInvalidKey(plistPath string, r utils.Runner, p pref.PrefInterface) er
 		return nil
 	}
 
-	useKeychain, err := p.GetBool("StoreRecoveryKeyInKeychain")
-	if err != nil {
-		return errors.Wrap(err, "failed to get StoreRecoveryKeyInKeychain preference")
-	}
+	useKeychain := cfg.StoreRecoveryKeyInKeychain
 
 	_, err = os.Stat(plistPath)
 	if !useKeychain && os.IsNotExist(err) {
 		return nil
 	}
 
-	recoveryKey, err := getRecoveryKey(plistPath, p)
+	recoveryKey, err := getRecoveryKey(plistPath, cfg, secrets)
 	if err != nil {
 		return errors.Wrap(err, "failed to get recovery key")
 	}
@@ -345,34 +433,41 @@ func rotateInvalidKey(plistPath string, r utils.Runner, p pref.PrefInterface) er
 		return nil
 	}
 
-	err = removeInvalidKey(plistPath, useKeychain)
+	if useKeychain {
+		if _, err := keyhistory.New(secrets, cfg.KeyHistoryLimit).Add(recoveryKey); err != nil {
+			return errors.Wrap(err, "failed to add recovery key to history")
+		}
+	}
+
+	err = removeInvalidKey(plistPath, useKeychain, secrets)
 	if err != nil {
 		return err
 	}
 
-	err = postRunCommand(r, p)
+	err = postRunCommand(r, cfg)
 	if err != nil {
 		return errors.Wrap(err, "postRunCommand")
 	}
 
-	return errors.New("Removed invalid key")
+	return errInvalidKeyRemoved
 }
 
 // removeInvalidKey removes an invalid key either from the keychain or from a specified plist file.
-// If usingKeychain is true, it attempts to delete the key from the keychain using utils.DeleteSecret().
+// If usingKeychain is true, it attempts to delete the key from the secret store.
 // If usingKeychain is false, it attempts to remove the key from the specified plist file path.
 //
 // Parameters:
 // - plistPath: The path to the plist file from which the key should be removed if not using the keychain.
 // - usingKeychain: A boolean indicating whether to remove the key from the keychain (true) or from the plist file (false).
+// - secrets: The SecretStore holding the key when using the keychain.
 //
 // Returns:
 // - An error if the key removal operation fails, otherwise nil.
-func removeInvalidKey(plistPath string, usingKeychain bool) error {
+func removeInvalidKey(plistPath string, usingKeychain bool, secrets utils.SecretStore) error {
 	var err error
 	if usingKeychain {
 		log.Println("Removing invalid recovery key from keychain.")
-		err = utils.DeleteSecret()
+		err = secrets.Delete(utils.RecoveryKeySecret)
 		if err != nil {
 			return errors.Wrap(err, "failed to delete recovery key from keychain")
 		}
@@ -432,17 +527,14 @@ func validateRecoveryKey(recoveryKey string, r utils.Runner) (bool, error) {
 // getEnabledUser retrieves the first enabled FileVault user that isn't in the
 // skip users list.
 // Parameters:
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
 //   - r: Runner interface for executing system commands
 //
 // Returns:
 //   - string: Username of the first valid enabled user
 //   - error: Any error encountered during the search
-func getEnabledUser(p pref.PrefInterface, r utils.Runner) (string, error) {
-	skipUsers, err := p.GetArray("SkipUsers")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get skip users")
-	}
+func getEnabledUser(cfg pref.Config, r utils.Runner) (string, error) {
+	skipUsers := cfg.SkipUsers
 	fdeUsers, err := r.Runner.RunCmd("/usr/bin/fdesetup", "list")
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get fdeUsers")
@@ -460,7 +552,9 @@ func getEnabledUser(p pref.PrefInterface, r utils.Runner) (string, error) {
 	return "", nil
 }
 
-// buildData constructs the form data for the escrow request.
+// buildData constructs the form data for the escrow request. The volume
+// identifiers and which recovery keys are present are only sent when they are
+// known.
 // Parameters:
 //   - cryptData: CryptData containing the information to be sent
 //   - runner: Runner interface for executing system commands
@@ -479,21 +573,31 @@ func buildData(cryptData CryptData, runner utils.Runner) (string, error) {
 	data.Set("recovery_password", cryptData.RecoveryKey)
 	data.Set("username", cryptData.EnabledUser)
 	data.Set("macname", computerName)
+	if cryptData.LVUUID != "" {
+		data.Set("lv_uuid", cryptData.LVUUID)
+	}
+	if cryptData.PVUUID != "" {
+		data.Set("pv_uuid", cryptData.PVUUID)
+	}
+	if cryptData.LVGUUID != "" {
+		data.Set("lvg_uuid", cryptData.LVGUUID)
+	}
+	if cryptData.KeyTypes != nil {
+		data.Set("personal_recovery_key", strconv.FormatBool(cryptData.KeyTypes.Personal))
+		data.Set("institutional_recovery_key", strconv.FormatBool(cryptData.KeyTypes.Institutional))
+	}
 	return data.Encode(), nil
 }
 
 // buildCheckinURL constructs the complete URL for the escrow check-in endpoint.
 // Parameters:
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
 //
 // Returns:
 //   - string: Complete checkin URL
 //   - error: Any error encountered during URL construction
-func buildCheckinURL(p pref.PrefInterface) (string, error) {
-	serverURL, err := p.GetString("ServerURL")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get server URL")
-	}
+func buildCheckinURL(cfg pref.Config) (string, error) {
+	serverURL := cfg.ServerURL
 	if !strings.HasSuffix(serverURL, "/") {
 		serverURL = serverURL + "/"
 	}
@@ -504,12 +608,12 @@ func buildCheckinURL(p pref.PrefInterface) (string, error) {
 // Parameters:
 //   - configFile: String containing curl configuration
 //   - r: Runner interface for executing system commands
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
 //
 // Returns:
 //   - string: Command output
 //   - error: Any error encountered during execution
-func runCurl(configFile string, r utils.Runner, p pref.PrefInterface) (string, error) {
+func runCurl(configFile string, r utils.Runner, cfg pref.Config) (string, error) {
 	// --fail: Fail silently (no output at all) on server errors.
 	// --silent: Silent mode. Don't show progress meter or error messages.
 	// --show-error: When used with silent, it makes curl show an error message
@@ -522,11 +626,8 @@ func runCurl(configFile string, r utils.Runner, p pref.PrefInterface) (string, e
 	// command line.
 	cmd := "/usr/bin/curl"
 	args := []string{"--fail", "--silent", "--show-error", "--location"}
-	additionalCurlOpts, err := p.GetArray("AdditionalCurlOpts")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get additional curl options")
-	}
-	if additionalCurlOpts != nil {
+	additionalCurlOpts := cfg.AdditionalCurlOpts
+	if len(additionalCurlOpts) > 0 {
 		log.Println("Additional curl options found.. Adding to curl command")
 		args = append(args, additionalCurlOpts...)
 	}
@@ -534,7 +635,7 @@ func runCurl(configFile string, r utils.Runner, p pref.PrefInterface) (string, e
 
 	out, err := r.Runner.RunCmdWithStdin(cmd, configFile, args...)
 	if err != nil {
-		theErr := fmt.Errorf("stdout: %s err: %s", out, err)
+		theErr := newCurlError(fmt.Sprintf("stdout: %s err: %s", out, err), err.Error())
 		return "", errors.Wrap(theErr, "failed to run curl")
 	}
 	return string(out), nil
@@ -547,16 +648,18 @@ func runCurl(configFile string, r utils.Runner, p pref.PrefInterface) (string, e
 // Parameters:
 //   - plist: CryptData containing the data to be sent
 //   - r: utils.Runner interface for executing commands
-//   - p: pref.PrefInterface for accessing preferences
-//   - mTLScommonName: Optional common name for mTLS authentication. If empty, curl will be used.
+//   - cfg: Config snapshot of the preferences for this run. If CommonNameForEscrow
+//     is empty, curl will be used instead of mTLS.
+//   - secrets: SecretStore holding the recovery key when using the keychain
 //
 // Returns:
 //   - bool: Indicates if the key was rotated as part of the escrow process
 //   - error: Any error encountered during the process
-func escrowKey(plist CryptData, r utils.Runner, p pref.PrefInterface, mTLScommonName string) (bool, error) {
+func escrowKey(plist CryptData, r utils.Runner, cfg pref.Config, secrets utils.SecretStore) (bool, error) {
 	log.Println("Attempting to Escrow Key...")
+	mTLScommonName := cfg.CommonNameForEscrow
 
-	theURL, err := buildCheckinURL(p)
+	theURL, err := buildCheckinURL(cfg)
 	if err != nil {
 		return false, errors.Wrap(err, "failed to build checkin URL")
 	}
@@ -580,7 +683,7 @@ func escrowKey(plist CryptData, r utils.Runner, p pref.PrefInterface, mTLScommon
 	} else {
 		log.Println("Using curl for escrow")
 		configFile := utils.BuildCurlConfigFile(map[string]string{"url": theURL, "data": data})
-		output, err := runCurl(configFile, r, p)
+		output, err := runCurl(configFile, r, cfg)
 		if err != nil {
 			return false, errors.Wrap(err, "failed to run curl")
 		}
@@ -589,7 +692,7 @@ func escrowKey(plist CryptData, r utils.Runner, p pref.PrefInterface, mTLScommon
 
 	log.Println("Key escrow successful.")
 
-	keyRotated, err := serverInitiatedRotation(responseBody, r, p)
+	keyRotated, err := serverInitiatedRotation(responseBody, r, cfg, secrets)
 	if err != nil {
 		return false, errors.Wrap(err, "serverInitiatedRotation")
 	}
@@ -601,12 +704,13 @@ func escrowKey(plist CryptData, r utils.Runner, p pref.PrefInterface, mTLScommon
 // Parameters:
 //   - output: String containing server response
 //   - r: Runner interface for executing system commands
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
+//   - secrets: SecretStore holding the recovery key when using the keychain
 //
 // Returns:
 //   - bool: Whether rotation was completed
 //   - error: Any error encountered during rotation
-func serverInitiatedRotation(output string, r utils.Runner, p pref.PrefInterface) (bool, error) {
+func serverInitiatedRotation(output string, r utils.Runner, cfg pref.Config, secrets utils.SecretStore) (bool, error) {
 	var rotation struct {
 		RotationRequired bool `json:"rotation_required"`
 	}
@@ -616,28 +720,12 @@ func serverInitiatedRotation(output string, r utils.Runner, p pref.PrefInterface
 	if err != nil {
 		return rotationCompleted, errors.Wrap(err, "failed to unmarshal output")
 	}
-	rotateUsedKey, err := p.GetBool("RotateUsedKey")
-	if err != nil {
-		return rotationCompleted, errors.Wrap(err, "failed to get rotate used key preference")
-	}
-
-	removePlist, err := p.GetBool("RemovePlist")
-	if err != nil {
-		return rotationCompleted, errors.Wrap(err, "failed to get remove plist preference")
-	}
-	if !rotateUsedKey || removePlist {
-		return rotationCompleted, nil
-	}
-
-	useKeychain, err := p.GetBool("StoreRecoveryKeyInKeychain")
-	if err != nil {
+	if !cfg.RotateUsedKey || cfg.RemovePlist {
 		return rotationCompleted, nil
 	}
 
-	outputPath, err := p.GetString("OutputPath")
-	if err != nil {
-		return rotationCompleted, errors.Wrap(err, "failed to get output path preference")
-	}
+	useKeychain := cfg.StoreRecoveryKeyInKeychain
+	outputPath := cfg.OutputPath
 
 	if !useKeychain {
 		_, err = os.Stat(outputPath)
@@ -648,14 +736,14 @@ func serverInitiatedRotation(output string, r utils.Runner, p pref.PrefInterface
 
 	if rotation.RotationRequired {
 		log.Println("Found server initiated key rotation. Removing used/invalid key.")
-		err = removeInvalidKey(outputPath, useKeychain)
+		err = removeInvalidKey(outputPath, useKeychain, secrets)
 		if err != nil {
 			return rotationCompleted, errors.Wrap(err, "failed to remove invalid key")
 		}
 		rotationCompleted = true
 	}
 
-	err = postRunCommand(r, p)
+	err = postRunCommand(r, cfg)
 	if err != nil {
 		return rotationCompleted, errors.Wrap(err, "postRunCommand")
 	}
@@ -663,52 +751,16 @@ func serverInitiatedRotation(output string, r utils.Runner, p pref.PrefInterface
 	return rotationCompleted, nil
 }
 
-// getCommand retrieves and formats the post-run command from preferences.
-// Parameters:
-//   - p: PrefInterface for accessing configuration preferences
-//
-// Returns:
-//   - string: Formatted command string
-//   - error: Any error encountered during retrieval
-func getCommand(p pref.PrefInterface) (string, error) {
-	var command string
-
-	postRunCommand, err := p.Get("PostRunCommand")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get post run command")
-	}
-
-	switch v := postRunCommand.(type) {
-	case string:
-		command = v
-	case []string:
-		command = strings.Join(v, " ")
-	case nil:
-		return "", nil
-	default:
-		return "", errors.New("PostRunCommand is neither a string nor an array of strings")
-	}
-
-	return command, nil
-}
-
 // postRunCommand executes a configured command after the escrow process.
 // Parameters:
 //   - r: Runner interface for executing system commands
-//   - p: PrefInterface for accessing configuration preferences
+//   - cfg: Config snapshot of the preferences for this run
 //
 // Returns:
 //   - error: Any error encountered during command execution
-func postRunCommand(r utils.Runner, p pref.PrefInterface) error {
-	command, err := getCommand(p)
-	if err != nil {
-		return err
-	}
-
-	outputPlist, err := p.GetString("OutputPath")
-	if err != nil {
-		return errors.Wrap(err, "failed to get output path")
-	}
+func postRunCommand(r utils.Runner, cfg pref.Config) error {
+	command := cfg.PostRunCommand
+	outputPlist := cfg.OutputPath
 
 	if command != "" {
 		_, err := os.Stat(outputPlist)
@@ -729,26 +781,23 @@ func postRunCommand(r utils.Runner, p pref.PrefInterface) error {
 //
 // Parameters:
 //   - keyLocation: The file path to the plist file containing the recovery key.
-//   - p: An implementation of the PrefInterface used to get user preferences.
+//   - cfg: Config snapshot of the preferences for this run.
+//   - secrets: The SecretStore holding the recovery key when using the keychain.
 //
 // Returns:
 //   - A string containing the recovery key.
 //   - An error if there is any issue retrieving the recovery key.
 //
-// The function first checks the user preference "StoreRecoveryKeyInKeychain" to determine where to retrieve the recovery key from.
-// If the preference is set to true, it attempts to get the recovery key from the keychain using utils.GetSecret().
+// The function first checks the "StoreRecoveryKeyInKeychain" setting to determine where to retrieve the recovery key from.
+// If the preference is set to true, it attempts to get the recovery key from the secret store.
 // If the keychain retrieval fails or the key is empty, an error is returned.
-// If the preference is set to false, it reads the recovery key from the specified plist file.
+// If the preference is set to false, it reads the recovery key from the specified plist file,
+// decrypting it if it was written with EncryptRecoveryKeyPlist set.
 // If reading the plist file or unmarshalling its contents fails, an error is returned.
-func getRecoveryKey(keyLocation string, p pref.PrefInterface) (string, error) {
-	useKeychain, err := p.GetBool("StoreRecoveryKeyInKeychain")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get StoreRecoveryKeyInKeychain preference")
-	}
-
-	if useKeychain {
+func getRecoveryKey(keyLocation string, cfg pref.Config, secrets utils.SecretStore) (string, error) {
+	if cfg.StoreRecoveryKeyInKeychain {
 		log.Println("Using keychain to get recovery key.")
-		keychainRecoveryKey, err := utils.GetSecret()
+		keychainRecoveryKey, err := secrets.Get(utils.RecoveryKeySecret)
 		if err != nil {
 			return "", errors.Wrap(err, "failed to get recovery key from keychain")
 		}
@@ -767,20 +816,12 @@ func getRecoveryKey(keyLocation string, p pref.PrefInterface) (string, error) {
 		RecoveryKey string `plist:"RecoveryKey"`
 	}
 
-	// Read file to bytes
-	plistBytes, err := os.ReadFile(keyLocation)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to read plist file")
-	}
-
-	// Unmarshal bytes to struct
 	var key keyPlist
-	err = plist.Unmarshal(plistBytes, &key)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to unmarshal plist")
+	if err := readPlist(keyLocation, &key); err != nil {
+		return "", err
 	}
 
-	return key.RecoveryKey, nil
+	return decryptRecoveryKey(key.RecoveryKey, secrets)
 }
 
 // sendRequest sends an HTTP POST request to the specified URL with the given data
@@ -854,8 +895,7 @@ func sendRequest(url string, data string, commonName string) ([]byte, error) {
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("server returned non-200 status: %d, body: %s",
-			resp.StatusCode, string(body))
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return body, nil
 }
@@ -4,102 +4,41 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/state"
 	"github.com/grahamgilbert/crypt/pkg/utils"
 	"github.com/groob/plist"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-type MockPref struct{}
+// testConfig returns the Config the tests in this package run against.
+func testConfig(t testing.TB, opts ...preftest.Option) pref.Config {
+	t.Helper()
+	p := preftest.New(append([]preftest.Option{
+		preftest.WithServer("http://test.com"),
+		preftest.PlistMode("/path/to/output.plist", false),
+		preftest.WithValue("SkipUsers", []string{"test_user1", "test_user2"}),
+		preftest.WithValue("PostRunCommand", []string{"test", "command"}),
+	}, opts...)...)
 
-func (m *MockPref) GetBool(key string) (bool, error) {
-	switch key {
-	case "RotateUsedKey":
-		return true, nil
-	case "RemovePlist":
-		return false, nil
-	default:
-		return false, nil
-	}
-}
-
-func (m *MockPref) SetBool(key string, value bool) error {
-	return nil
-}
-
-func (m *MockPref) GetString(key string) (string, error) {
-	if key == "OutputPath" {
-		return "/path/to/output.plist", nil
-	}
-	if key == "ServerURL" {
-		return "http://test.com", nil
-	}
-	return "", nil
-}
-
-func (m *MockPref) SetString(key string, value string) error {
-	return nil
-}
-
-func (m *MockPref) GetInt(key string) (int, error) {
-	if key == "KeyEscrowInterval" {
-		return 1, nil
-	}
-	return 0, nil
-}
-
-func (m *MockPref) SetInt(key string, value int) error {
-	return nil
-}
-
-func (m *MockPref) GetArray(key string) ([]string, error) {
-	if key == "SkipUsers" {
-		return []string{"test_user1", "test_user2"}, nil
-	}
-	return nil, nil
-}
-
-func (m *MockPref) SetArray(key string, value []string) error {
-	return nil
-}
-
-func (m *MockPref) Get(key string) (interface{}, error) {
-	if key == "PostRunCommand" {
-		return []string{"test", "command"}, nil
-	}
-	return nil, nil
-}
-
-func (m *MockPref) Set(key string, value interface{}) error {
-	return nil
-}
-
-func (m *MockPref) Delete(key string) error {
-	return nil
-}
-
-func (m *MockPref) GetDate(key string) (time.Time, error) {
-	return time.Now(), nil
-}
-
-func (m *MockPref) SetDate(key string, value time.Time) error {
-	return nil
-}
-
-func TestGetCommand(t *testing.T) {
-	p := &MockPref{}
-
-	command, err := getCommand(p)
-	assert.NoError(t, err)
-	assert.Equal(t, "test command", command)
+	cfg, err := pref.Load(p)
+	require.NoError(t, err)
+	return cfg
 }
 
 func TestBuildCheckinURL(t *testing.T) {
-	p := &MockPref{}
+	cfg := testConfig(t)
 
-	url, err := buildCheckinURL(p)
+	url, err := buildCheckinURL(cfg)
 	assert.Nil(t, err)
 	assert.Equal(t, "http://test.com/checkin/", url)
 
@@ -109,16 +48,26 @@ func TestEscrowRequired(t *testing.T) {
 	cryptData := CryptData{
 		LastRun: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
 	}
-	p := &MockPref{}
+	cfg := testConfig(t)
 
 	// Test when escrow is required
-	required, err := escrowRequired(cryptData, p)
+	required, err := escrowRequired(cryptData, cfg, "abc", "abc")
 	assert.NoError(t, err)
 	assert.True(t, required)
 
 	// Test when escrow is not required
 	cryptData.LastRun = time.Now()
-	required, err = escrowRequired(cryptData, p)
+	required, err = escrowRequired(cryptData, cfg, "abc", "abc")
+	assert.NoError(t, err)
+	assert.False(t, required)
+
+	// the key changed since it was escrowed
+	required, err = escrowRequired(cryptData, cfg, "abc", "def")
+	assert.NoError(t, err)
+	assert.True(t, required)
+
+	// state written before fingerprints were recorded
+	required, err = escrowRequired(cryptData, cfg, "", "def")
 	assert.NoError(t, err)
 	assert.False(t, required)
 }
@@ -142,7 +91,7 @@ func TestWritePlist(t *testing.T) {
 	}
 	defer os.Remove(tempFile.Name()) // clean up
 
-	err = writePlist(cryptData, tempFile.Name())
+	err = writePlist(cryptData, tempFile.Name(), testConfig(t), utils.NewMemorySecretStore())
 	assert.Nil(t, err)
 
 	plistBytes, err := os.ReadFile(tempFile.Name())
@@ -214,7 +163,7 @@ func TestValidateRecoveryKey(t *testing.T) {
 }
 
 func TestGetEnabledUser(t *testing.T) {
-	p := &MockPref{}
+	cfg := testConfig(t)
 	// Test no enabled users
 	runner := utils.MockCmdRunner{
 		Output: "test_user1,19F18F252-781C-4754-820D-C49346C386C4\ntest_user2,4A4E62FE-D022-4964-A3B7-CF4CE0C91650",
@@ -222,7 +171,7 @@ func TestGetEnabledUser(t *testing.T) {
 	}
 	r := utils.Runner{}
 	r.Runner = runner
-	user, err := getEnabledUser(p, r)
+	user, err := getEnabledUser(cfg, r)
 	assert.NoError(t, err)
 	assert.Equal(t, "", user)
 	runner = utils.MockCmdRunner{
@@ -230,7 +179,7 @@ func TestGetEnabledUser(t *testing.T) {
 		Err:    nil,
 	}
 	r.Runner = runner
-	user, err = getEnabledUser(p, r)
+	user, err = getEnabledUser(cfg, r)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_user3", user)
 }
@@ -261,7 +210,7 @@ func TestBuildData(t *testing.T) {
 
 func TestServerInitiatedRotation(t *testing.T) {
 	output := `{"rotation_required": true}`
-	p := &MockPref{}
+	cfg := testConfig(t)
 
 	runner := utils.MockCmdRunner{
 		Output: "",
@@ -269,7 +218,7 @@ func TestServerInitiatedRotation(t *testing.T) {
 	}
 	r := utils.Runner{}
 	r.Runner = runner
-	keyRotated, err := serverInitiatedRotation(output, r, p)
+	keyRotated, err := serverInitiatedRotation(output, r, cfg, utils.NewMemorySecretStore())
 	assert.Nil(t, err)
 	assert.False(t, keyRotated)
 }
@@ -280,7 +229,7 @@ func TestGetRecoveryKey(t *testing.T) {
 	}
 
 	key := keyPlist{RecoveryKey: "test_recovery_key"}
-	p := &MockPref{}
+	cfg := testConfig(t)
 
 	tmpFile, err := os.CreateTemp(os.TempDir(), "crypt-testing-")
 	assert.NoError(t, err)
@@ -292,7 +241,7 @@ func TestGetRecoveryKey(t *testing.T) {
 	err = os.WriteFile(tmpFile.Name(), plistBytes, 0644)
 	assert.NoError(t, err)
 
-	out, err := getRecoveryKey(tmpFile.Name(), p)
+	out, err := getRecoveryKey(tmpFile.Name(), cfg, utils.NewMemorySecretStore())
 	if err != nil {
 		t.Fatalf("getRecoveryKey failed with error: %v", err)
 	}
@@ -311,9 +260,6 @@ func TestEscrowKeySignatureCheck(t *testing.T) {
 }
 
 func TestBuildCryptData(t *testing.T) {
-	// Create a mock PrefInterface that returns specific values for testing
-	mockPref := &MockPref{}
-
 	// Create a mock runner that returns specific values for system commands
 	mockRunner := utils.MockCmdRunner{
 		Output: "enabled_user,19F18F252-781C-4754-820D-C49346C386C4",
@@ -323,7 +269,7 @@ func TestBuildCryptData(t *testing.T) {
 	r.Runner = mockRunner
 
 	// Test building CryptData
-	cryptData, err := buildCryptData(mockPref, r)
+	cryptData, err := buildCryptData(testConfig(t), r, time.Time{})
 	assert.NoError(t, err)
 	assert.NotEmpty(t, cryptData.SerialNumber)
 	// GetConsoleUser returns the actual current user, so we just verify it's not empty
@@ -342,7 +288,7 @@ func TestRemoveInvalidKey(t *testing.T) {
 		assert.NoError(t, err)
 
 		// Remove the invalid key (should delete the file)
-		err = removeInvalidKey(tempFile.Name(), false)
+		err = removeInvalidKey(tempFile.Name(), false, utils.NewMemorySecretStore())
 		assert.NoError(t, err)
 
 		// Verify the file was deleted
@@ -351,97 +297,41 @@ func TestRemoveInvalidKey(t *testing.T) {
 	})
 
 	t.Run("remove from keychain", func(t *testing.T) {
-		// Test removing from keychain - this will fail on systems without keychain setup
-		// but we can test that the function calls the correct utility function
-		err := removeInvalidKey("", true)
-		// We expect this to potentially fail since we don't have a keychain setup in tests
-		// but we're testing that the function path is correct
-		assert.Error(t, err) // Expected to fail in test environment
-	})
-}
-
-// MockKeychainPref is a mock preference that indicates keychain usage
-type MockKeychainPref struct {
-	MockPref
-}
-
-func (m *MockKeychainPref) GetBool(key string) (bool, error) {
-	if key == "StoreRecoveryKeyInKeychain" {
-		return true, nil
-	}
-	return m.MockPref.GetBool(key)
-}
-
-func TestGetRecoveryKeyWithKeychain(t *testing.T) {
-	// Create a mock pref that indicates keychain usage
-	mockPref := &MockKeychainPref{}
-
-	// This test will fail in most environments since we don't have the keychain set up
-	// but it tests the code path
-	_, err := getRecoveryKey("", mockPref)
-	assert.Error(t, err) // Expected to fail since no keychain entry exists
-}
-
-// MockExtendedPref extends MockPref to support additional functionality for testing
-type MockExtendedPref struct {
-	MockPref
-	stringValues map[string]string
-	boolValues   map[string]bool
-	intValues    map[string]int
-	arrayValues  map[string][]string
-	dateValues   map[string]time.Time
-}
+		secrets := utils.NewMemorySecretStore()
+		assert.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
 
-func NewMockExtendedPref() *MockExtendedPref {
-	return &MockExtendedPref{
-		stringValues: make(map[string]string),
-		boolValues:   make(map[string]bool),
-		intValues:    make(map[string]int),
-		arrayValues:  make(map[string][]string),
-		dateValues:   make(map[string]time.Time),
-	}
-}
+		err := removeInvalidKey("", true, secrets)
+		assert.NoError(t, err)
 
-func (m *MockExtendedPref) GetString(key string) (string, error) {
-	if val, ok := m.stringValues[key]; ok {
-		return val, nil
-	}
-	return m.MockPref.GetString(key)
-}
+		_, err = secrets.Get(utils.RecoveryKeySecret)
+		assert.ErrorIs(t, err, utils.ErrSecretNotFound)
+	})
 
-func (m *MockExtendedPref) GetBool(key string) (bool, error) {
-	if val, ok := m.boolValues[key]; ok {
-		return val, nil
-	}
-	return m.MockPref.GetBool(key)
+	t.Run("nothing to remove from keychain", func(t *testing.T) {
+		err := removeInvalidKey("", true, utils.NewMemorySecretStore())
+		assert.Error(t, err)
+	})
 }
 
-func (m *MockExtendedPref) GetInt(key string) (int, error) {
-	if val, ok := m.intValues[key]; ok {
-		return val, nil
-	}
-	return m.MockPref.GetInt(key)
-}
+func TestGetRecoveryKeyWithKeychain(t *testing.T) {
+	// Use a config that indicates keychain usage
+	cfg := testConfig(t, preftest.KeychainMode())
 
-func (m *MockExtendedPref) GetArray(key string) ([]string, error) {
-	if val, ok := m.arrayValues[key]; ok {
-		return val, nil
-	}
-	return m.MockPref.GetArray(key)
-}
+	secrets := utils.NewMemorySecretStore()
+	_, err := getRecoveryKey("", cfg, secrets)
+	assert.ErrorIs(t, err, utils.ErrSecretNotFound)
 
-func (m *MockExtendedPref) GetDate(key string) (time.Time, error) {
-	if val, ok := m.dateValues[key]; ok {
-		return val, nil
-	}
-	return m.MockPref.GetDate(key)
+	assert.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+	key, err := getRecoveryKey("", cfg, secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", key)
 }
 
 func TestBuildCryptDataWithSkippedUser(t *testing.T) {
 	// Test buildCryptData when we get date information
-	mockPref := NewMockExtendedPref()
-	mockPref.arrayValues["SkipUsers"] = []string{"test_user"}
-	mockPref.dateValues["LastEscrow"] = time.Now().Add(-2 * time.Hour)
+	lastEscrow := time.Now().Add(-2 * time.Hour)
+	cfg := testConfig(t)
+	cfg.SkipUsers = []string{"test_user"}
 
 	// Mock runner that returns enabled users for getEnabledUser fallback
 	mockRunner := utils.MockCmdRunner{
@@ -451,12 +341,12 @@ func TestBuildCryptDataWithSkippedUser(t *testing.T) {
 	r := utils.Runner{}
 	r.Runner = mockRunner
 
-	cryptData, err := buildCryptData(mockPref, r)
+	cryptData, err := buildCryptData(cfg, r, lastEscrow)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, cryptData.SerialNumber)
 	// GetConsoleUser returns the actual current user, so we just verify it's not empty
 	assert.NotEmpty(t, cryptData.EnabledUser)
-	assert.NotZero(t, cryptData.LastRun)
+	assert.Equal(t, lastEscrow, cryptData.LastRun)
 }
 
 func TestSendRequestErrorCases(t *testing.T) {
@@ -472,8 +362,8 @@ func TestSendRequestErrorCases(t *testing.T) {
 
 func TestEscrowKeyConditionalBehavior(t *testing.T) {
 	// Test that escrowKey properly chooses between mTLS and curl
-	mockPref := NewMockExtendedPref()
-	mockPref.stringValues["ServerURL"] = "https://test.example.com"
+	cfg := testConfig(t)
+	cfg.ServerURL = "https://test.example.com"
 
 	mockRunner := utils.MockCmdRunner{
 		Output: "test_computer_name",
@@ -490,17 +380,67 @@ func TestEscrowKeyConditionalBehavior(t *testing.T) {
 
 	t.Run("with mTLS common name", func(t *testing.T) {
 		// This should attempt mTLS path but will fail due to missing keychain setup
-		_, err := escrowKey(cryptData, r, mockPref, "test-common-name")
+		mTLSConfig := cfg
+		mTLSConfig.CommonNameForEscrow = "test-common-name"
+		_, err := escrowKey(cryptData, r, mTLSConfig, utils.NewMemorySecretStore())
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "failed to send request with mTLS")
 	})
 
 	t.Run("without mTLS common name", func(t *testing.T) {
 		// This should attempt curl path
-		_, err := escrowKey(cryptData, r, mockPref, "")
+		_, err := escrowKey(cryptData, r, cfg, utils.NewMemorySecretStore())
 		assert.Error(t, err)
 		// The exact error depends on what curl returns, but we expect some error
 		// since we're not actually making real network calls
 		assert.NotNil(t, err)
 	})
 }
+
+func TestRunEscrowKeyChanged(t *testing.T) {
+	dir := t.TempDir()
+	plistPath := filepath.Join(dir, "crypt_output.plist")
+	cfg := testConfig(t,
+		preftest.PlistMode(plistPath, false),
+		preftest.WithValue("ManageAuthMechs", false),
+		preftest.WithValue("ValidateKey", false),
+	)
+	st := state.New(filepath.Join(dir, "state.json"))
+	secrets := utils.NewMemorySecretStore()
+	j := journal.New(filepath.Join(dir, "journal.jsonl"))
+	r := utils.Runner{Runner: utils.MockCmdRunner{Output: `{"rotation_required": false}`}}
+
+	// the old key was escrowed a moment ago, then the key was changed
+	require.NoError(t, st.Update(func(s *state.State) error {
+		s.LastEscrow = time.Now()
+		s.LastEscrowFingerprint = strings.Repeat("0", 64)
+		return nil
+	}))
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH", LastRun: time.Now(), EscrowSuccess: true}, plistPath, cfg, secrets))
+
+	require.NoError(t, RunEscrow(r, preftest.New(), cfg, st, secrets, j))
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, journal.Escrowed, entries[0].Decision)
+	assert.Equal(t, "http://test.com/checkin/", entries[0].Destination)
+	// curl doesn't report the status of a request that succeeded
+	assert.Zero(t, entries[0].HTTPStatus)
+
+	s, err := st.Load()
+	require.NoError(t, err)
+	assert.Equal(t, entries[0].Fingerprint, s.LastEscrowFingerprint)
+
+	// the same key again is within the interval
+	require.NoError(t, RunEscrow(r, preftest.New(), cfg, st, secrets, j))
+	entries, err = j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, journal.Skipped, entries[1].Decision)
+
+	// the key history is only kept when the key is stored in the keychain
+	history, err := keyhistory.New(secrets, cfg.KeyHistoryLimit).Entries()
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
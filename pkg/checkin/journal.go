@@ -0,0 +1,152 @@
+package checkin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// errInvalidKeyRemoved is returned when the recovery key failed validation and
+// was removed so a new one is generated at the next login.
+var errInvalidKeyRemoved = errors.New("Removed invalid key")
+
+// httpStatusError is returned when the server answers an escrow request with
+// anything but 200.
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("server returned non-200 status: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// curlError is returned when curl fails. curl reports why in its exit code and,
+// with --fail, the HTTP status in its error message.
+type curlError struct {
+	msg        string
+	ExitCode   int
+	StatusCode int
+}
+
+var (
+	curlExitCode   = regexp.MustCompile(`curl: \((\d+)\)`)
+	curlHTTPStatus = regexp.MustCompile(`returned error: (\d{3})`)
+)
+
+// newCurlError returns a curlError with message msg, reading the exit code and
+// HTTP status from curl's stderr.
+func newCurlError(msg string, stderr string) *curlError {
+	e := &curlError{msg: msg}
+	if m := curlExitCode.FindStringSubmatch(stderr); m != nil {
+		e.ExitCode, _ = strconv.Atoi(m[1])
+	}
+	if m := curlHTTPStatus.FindStringSubmatch(stderr); m != nil {
+		e.StatusCode, _ = strconv.Atoi(m[1])
+	}
+	return e
+}
+
+func (e *curlError) Error() string {
+	return e.msg
+}
+
+// curl exit codes, see https://curl.se/libcurl/c/libcurl-errors.html
+var (
+	curlNetworkExitCodes = []int{5, 6, 7, 28, 52, 55, 56}
+	curlTLSExitCodes     = []int{35, 51, 53, 54, 58, 59, 60, 64, 66, 77, 80, 82, 83, 90, 91}
+)
+
+// classifyError returns the journal error class of err, and the HTTP status
+// the server answered with if there was one.
+//
+// Parameters:
+//   - err: The error RunEscrow failed with
+//
+// Returns:
+//   - string: The error class, such as "network" or "http"
+//   - int: The HTTP status, or 0 if the server didn't answer
+func classifyError(err error) (string, int) {
+	var statusErr *httpStatusError
+	var curlErr *curlError
+	var certErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errInvalidKeyRemoved):
+		return "invalid_key", 0
+	case errors.As(err, &statusErr):
+		return "http", statusErr.StatusCode
+	case errors.As(err, &curlErr):
+		switch {
+		case curlErr.StatusCode != 0:
+			return "http", curlErr.StatusCode
+		case containsInt(curlNetworkExitCodes, curlErr.ExitCode):
+			return "network", 0
+		case containsInt(curlTLSExitCodes, curlErr.ExitCode):
+			return "tls", 0
+		}
+		return "curl", 0
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &recordErr):
+		return "tls", 0
+	case errors.As(err, &netErr):
+		return "network", 0
+	case errors.Is(err, errAuthDBDrift):
+		return "authdb", 0
+	case errors.Is(err, utils.ErrSecretNotFound), errors.Is(err, utils.ErrInsecureFile), errors.Is(err, errPersonalKeyMissing):
+		return "key", 0
+	}
+	return "other", 0
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// recordJournal completes entry with the duration and outcome of the run and
+// appends it to j. Failing to write the journal is logged rather than
+// returned, so it never stops a key being escrowed.
+//
+// Parameters:
+//   - j: Journal to append to
+//   - entry: The entry filled in by the run
+//   - start: When the run started
+//   - err: The error the run failed with, or nil
+func recordJournal(j *journal.Journal, entry *journal.Entry, start time.Time, err error) {
+	entry.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		// a run can fail after the key was escrowed, which is still recorded
+		if entry.Decision == "" {
+			entry.Decision = journal.Failed
+		}
+		entry.Error = err.Error()
+		var status int
+		entry.ErrorClass, status = classifyError(err)
+		if status != 0 {
+			entry.HTTPStatus = status
+		}
+		if errors.Is(err, errInvalidKeyRemoved) {
+			entry.Rotation = journal.RotationInvalidKey
+		}
+	}
+
+	if err := j.Append(*entry); err != nil {
+		log.Printf("Failed to write escrow journal: %v", err)
+	}
+}
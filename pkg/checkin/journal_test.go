@@ -0,0 +1,144 @@
+package checkin
+
+import (
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantClass  string
+		wantStatus int
+	}{
+		{
+			name:      "invalid key",
+			err:       errors.Wrap(errInvalidKeyRemoved, "rotateInvalidKey"),
+			wantClass: "invalid_key",
+		},
+		{
+			name:      "authdb drift",
+			err:       errors.Wrap(errAuthDBDrift, "3 times in the last 24 hour(s)"),
+			wantClass: "authdb",
+		},
+		{
+			name:       "mTLS status",
+			err:        errors.Wrap(&httpStatusError{StatusCode: 503}, "failed to send request with mTLS"),
+			wantClass:  "http",
+			wantStatus: 503,
+		},
+		{
+			name:       "curl status",
+			err:        errors.Wrap(newCurlError("failed", "curl: (22) The requested URL returned error: 500"), "failed to run curl"),
+			wantClass:  "http",
+			wantStatus: 500,
+		},
+		{
+			name:      "curl cannot resolve host",
+			err:       newCurlError("failed", "curl: (6) Could not resolve host: crypt.example.com"),
+			wantClass: "network",
+		},
+		{
+			name:      "curl certificate problem",
+			err:       newCurlError("failed", "curl: (60) SSL certificate problem: unable to get local issuer certificate"),
+			wantClass: "tls",
+		},
+		{
+			name:      "curl other",
+			err:       newCurlError("failed", "curl: (26) Failed to open/read local data"),
+			wantClass: "curl",
+		},
+		{
+			name:      "mTLS unknown authority",
+			err:       errors.Wrap(x509.UnknownAuthorityError{}, "failed to execute request"),
+			wantClass: "tls",
+		},
+		{
+			name:      "mTLS connection refused",
+			err:       errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "failed to execute request"),
+			wantClass: "network",
+		},
+		{
+			name:      "key missing",
+			err:       errors.Wrap(utils.ErrSecretNotFound, "failed to get recovery key from keychain."),
+			wantClass: "key",
+		},
+		{
+			name:      "other",
+			err:       errors.New("failed to build crypt data"),
+			wantClass: "other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, status := classifyError(tt.err)
+			assert.Equal(t, tt.wantClass, class)
+			assert.Equal(t, tt.wantStatus, status)
+		})
+	}
+}
+
+func TestRecordJournal(t *testing.T) {
+	j := journal.New(filepath.Join(t.TempDir(), "journal.jsonl"))
+	start := time.Now()
+
+	recordJournal(j, &journal.Entry{Time: start, Decision: journal.Skipped}, start, nil)
+	recordJournal(j, &journal.Entry{Time: start}, start, errors.Wrap(errInvalidKeyRemoved, "rotateInvalidKey"))
+	// the key was escrowed, but the plist could not be written afterwards
+	recordJournal(j, &journal.Entry{Time: start, Decision: journal.Escrowed, HTTPStatus: 200}, start, errors.New("failed to write plist"))
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, journal.Skipped, entries[0].Decision)
+	assert.Empty(t, entries[0].Error)
+
+	assert.Equal(t, journal.Failed, entries[1].Decision)
+	assert.Equal(t, "invalid_key", entries[1].ErrorClass)
+	assert.Equal(t, journal.RotationInvalidKey, entries[1].Rotation)
+
+	assert.Equal(t, journal.Escrowed, entries[2].Decision)
+	assert.Equal(t, 200, entries[2].HTTPStatus)
+	assert.Equal(t, "failed to write plist", entries[2].Error)
+}
+
+func TestRunEscrowJournal(t *testing.T) {
+	dir := t.TempDir()
+	plistPath := filepath.Join(dir, "crypt_output.plist")
+	cfg := testConfig(t,
+		preftest.PlistMode(plistPath, false),
+		preftest.WithValue("ManageAuthMechs", false),
+		preftest.WithValue("ValidateKey", false),
+	)
+	st := state.New(filepath.Join(dir, "state.json"))
+	secrets := utils.NewMemorySecretStore()
+	j := journal.New(filepath.Join(dir, "journal.jsonl"))
+	r := utils.Runner{Runner: utils.MockCmdRunner{}}
+
+	// no plist yet
+	require.NoError(t, RunEscrow(r, preftest.New(), cfg, st, secrets, j))
+
+	// escrowed within KeyEscrowInterval
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH", LastRun: time.Now()}, plistPath, cfg, secrets))
+	require.NoError(t, RunEscrow(r, preftest.New(), cfg, st, secrets, j))
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, journal.NoKey, entries[0].Decision)
+	assert.Equal(t, journal.Skipped, entries[1].Decision)
+	assert.Len(t, entries[1].Fingerprint, 64)
+}
@@ -0,0 +1,218 @@
+package checkin
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// MigrateStorage moves the recovery key to wherever StoreRecoveryKeyInKeychain
+// says it should be: from the plist at OutputPath to the keychain, or from the
+// keychain to the plist. The key is validated, written to the new location and
+// read back before the old copy is removed, and when it was last escrowed is
+// carried over. If there is nothing to migrate it does nothing, so it is safe
+// to run on every checkin.
+//
+// Parameters:
+//   - r: Runner interface for executing system commands
+//   - cfg: Config snapshot of the preferences for this run
+//   - st: Store holding the runtime state, such as the last escrow date
+//   - secrets: SecretStore holding the recovery key when using the keychain
+//
+// Returns:
+//   - error: Any error encountered during the migration. The old copy of the
+//     key is left in place if anything fails.
+func MigrateStorage(r utils.Runner, cfg pref.Config, st *state.Store, secrets utils.SecretStore) error {
+	if cfg.StoreRecoveryKeyInKeychain {
+		return migrateToKeychain(r, cfg, st, secrets)
+	}
+	return migrateToPlist(r, cfg, st, secrets)
+}
+
+// migrateToKeychain moves the recovery key from the plist at OutputPath into
+// the secret store.
+func migrateToKeychain(r utils.Runner, cfg pref.Config, st *state.Store, secrets utils.SecretStore) error {
+	plistPath := cfg.OutputPath
+	if _, err := os.Stat(plistPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to check if plist exists")
+	}
+
+	cryptData, err := parsePlist(plistPath, secrets)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse plist")
+	}
+	if cryptData.RecoveryKey == "" {
+		return errors.Errorf("%s does not contain a recovery key", plistPath)
+	}
+
+	existing, err := secrets.Get(utils.RecoveryKeySecret)
+	if err != nil && !errors.Is(err, utils.ErrSecretNotFound) {
+		return errors.Wrap(err, "failed to check keychain for a recovery key")
+	}
+	if existing != "" && existing != cryptData.RecoveryKey {
+		return errors.Errorf("keychain already holds a different recovery key, leaving %s in place", plistPath)
+	}
+
+	log.Printf("Migrating recovery key from %s to the keychain.", plistPath)
+	if err := validateForMigration(cryptData.RecoveryKey, r); err != nil {
+		return err
+	}
+
+	if existing == "" {
+		if err := secrets.Set(utils.RecoveryKeySecret, cryptData.RecoveryKey); err != nil {
+			return errors.Wrap(err, "failed to add recovery key to keychain")
+		}
+	}
+	stored, err := secrets.Get(utils.RecoveryKeySecret)
+	if err != nil {
+		return errors.Wrap(err, "failed to read recovery key back from keychain")
+	}
+	if stored != cryptData.RecoveryKey {
+		return errors.New("recovery key read back from keychain does not match")
+	}
+
+	history := keyhistory.New(secrets, cfg.KeyHistoryLimit)
+	entry, err := history.Add(cryptData.RecoveryKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to add recovery key to history")
+	}
+
+	var lastEscrow time.Time
+	if cryptData.EscrowSuccess {
+		lastEscrow = cryptData.LastRun
+	}
+	err = st.Update(func(s *state.State) error {
+		s.LastEscrow = lastEscrow
+		s.LastEscrowFingerprint = ""
+		if !lastEscrow.IsZero() {
+			s.LastEscrowFingerprint = entry.Fingerprint
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to carry over last escrow date")
+	}
+
+	metadata := utils.SecretMetadata{
+		Fingerprint: entry.Fingerprint,
+		EnabledUser: cryptData.EnabledUser,
+		EnabledDate: cryptData.EnabledDate,
+		LastEscrow:  lastEscrow,
+	}
+	if !lastEscrow.IsZero() {
+		runState, err := st.Load()
+		if err != nil {
+			return errors.Wrap(err, "failed to load state")
+		}
+		metadata.LastEscrowServer = runState.LastEscrowServer
+	}
+	if err := secrets.SetMetadata(utils.RecoveryKeySecret, metadata); err != nil {
+		return errors.Wrap(err, "failed to record metadata on keychain item")
+	}
+
+	if err := os.Remove(plistPath); err != nil {
+		return errors.Wrap(err, "failed to remove plist")
+	}
+	log.Println("Recovery key migrated to the keychain.")
+	return nil
+}
+
+// migrateToPlist moves the recovery key from the secret store into the plist
+// at OutputPath.
+func migrateToPlist(r utils.Runner, cfg pref.Config, st *state.Store, secrets utils.SecretStore) error {
+	plistPath := cfg.OutputPath
+	secret, err := secrets.GetSecret(utils.RecoveryKeySecret)
+	if errors.Is(err, utils.ErrSecretNotFound) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get recovery key from keychain")
+	}
+
+	var existing CryptData
+	if _, err := os.Stat(plistPath); err == nil {
+		existing, err = parsePlist(plistPath, secrets)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse plist")
+		}
+		if existing.RecoveryKey != "" && existing.RecoveryKey != secret.Value {
+			return errors.Errorf("%s already holds a different recovery key, leaving the keychain item in place", plistPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to check if plist exists")
+	}
+
+	log.Printf("Migrating recovery key from the keychain to %s.", plistPath)
+	if err := validateForMigration(secret.Value, r); err != nil {
+		return err
+	}
+
+	// the key is leaving the keychain, so it isn't added to the key history
+	history := keyhistory.New(secrets, cfg.KeyHistoryLimit)
+	fingerprint, err := history.Fingerprint(secret.Value)
+	if err != nil {
+		return errors.Wrap(err, "failed to fingerprint recovery key")
+	}
+
+	if existing.RecoveryKey == "" {
+		runState, err := st.Load()
+		if err != nil {
+			return errors.Wrap(err, "failed to load state")
+		}
+		lastEscrow := lastEscrowForKey(runState.LastEscrow, secret, fingerprint)
+
+		cryptData, err := buildCryptData(cfg, r, lastEscrow)
+		if err != nil {
+			return errors.Wrap(err, "failed to build crypt data")
+		}
+		cryptData.RecoveryKey = secret.Value
+		cryptData.EscrowSuccess = !lastEscrow.IsZero()
+		if secret.Metadata.EnabledUser != "" {
+			cryptData.EnabledUser = secret.Metadata.EnabledUser
+		}
+		if secret.Metadata.EnabledDate != "" {
+			cryptData.EnabledDate = secret.Metadata.EnabledDate
+		}
+		if err := writePlist(cryptData, plistPath, cfg, secrets); err != nil {
+			return err
+		}
+	}
+
+	written, err := parsePlist(plistPath, secrets)
+	if err != nil {
+		return errors.Wrap(err, "failed to read plist back")
+	}
+	if written.RecoveryKey != secret.Value {
+		return errors.New("recovery key read back from plist does not match")
+	}
+
+	if err := secrets.Delete(utils.RecoveryKeySecret); err != nil {
+		return errors.Wrap(err, "failed to delete recovery key from keychain")
+	}
+	// nor are copies of previous keys left behind
+	if err := history.Purge(); err != nil {
+		return errors.Wrap(err, "failed to remove key history from keychain")
+	}
+	log.Printf("Recovery key migrated to %s.", plistPath)
+	return nil
+}
+
+// validateForMigration checks that recoveryKey unlocks this Mac before it is
+// moved, so an invalid key is never copied over a location.
+func validateForMigration(recoveryKey string, r utils.Runner) error {
+	valid, err := validateRecoveryKey(recoveryKey, r)
+	if err != nil {
+		return errors.Wrap(err, "failed to validate recovery key")
+	}
+	if !valid {
+		return errors.New("recovery key is not valid, not migrating it")
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package checkin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validKeyRunner() utils.Runner {
+	return utils.Runner{Runner: utils.MockCmdRunner{Output: "true"}}
+}
+
+func migrateConfig(t *testing.T, keychain bool) (pref.Config, *state.Store) {
+	dir := t.TempDir()
+	opts := []preftest.Option{preftest.PlistMode(filepath.Join(dir, "crypt_output.plist"), false)}
+	if keychain {
+		opts = append(opts, preftest.KeychainMode())
+	}
+	return testConfig(t, opts...), state.New(filepath.Join(dir, "state.json"))
+}
+
+func TestMigrateStorageToKeychain(t *testing.T) {
+	cfg, st := migrateConfig(t, true)
+	secrets := utils.NewMemorySecretStore()
+	lastRun := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, writePlist(CryptData{
+		RecoveryKey:   "ABCD-EFGH",
+		EnabledUser:   "jappleseed",
+		EnabledDate:   "2024-01-02 03:04:05 +0000",
+		LastRun:       lastRun,
+		EscrowSuccess: true,
+	}, cfg.OutputPath, cfg, secrets))
+
+	require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+
+	_, err := os.Stat(cfg.OutputPath)
+	assert.True(t, os.IsNotExist(err))
+
+	secret, err := secrets.GetSecret(utils.RecoveryKeySecret)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", secret.Value)
+	assert.Equal(t, "jappleseed", secret.Metadata.EnabledUser)
+	assert.True(t, lastRun.Equal(secret.Metadata.LastEscrow))
+	assert.NotEmpty(t, secret.Metadata.Fingerprint)
+
+	runState, err := st.Load()
+	require.NoError(t, err)
+	assert.True(t, lastRun.Equal(runState.LastEscrow))
+
+	entries, err := keyhistory.New(secrets, cfg.KeyHistoryLimit).Entries()
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// running again has nothing to do
+	require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+}
+
+func TestMigrateStorageToKeychainNotEscrowed(t *testing.T) {
+	cfg, st := migrateConfig(t, true)
+	secrets := utils.NewMemorySecretStore()
+	require.NoError(t, st.Update(func(s *state.State) error {
+		s.LastEscrow = time.Now()
+		return nil
+	}))
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH", LastRun: time.Now()}, cfg.OutputPath, cfg, secrets))
+
+	require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+
+	// the key in the plist was never escrowed, so it must be escrowed next run
+	runState, err := st.Load()
+	require.NoError(t, err)
+	assert.True(t, runState.LastEscrow.IsZero())
+}
+
+func TestMigrateStorageToKeychainFailures(t *testing.T) {
+	t.Run("invalid key", func(t *testing.T) {
+		cfg, st := migrateConfig(t, true)
+		secrets := utils.NewMemorySecretStore()
+		require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, cfg.OutputPath, cfg, secrets))
+
+		r := utils.Runner{Runner: utils.MockCmdRunner{Output: "false"}}
+		assert.Error(t, MigrateStorage(r, cfg, st, secrets))
+
+		assert.FileExists(t, cfg.OutputPath)
+		_, err := secrets.Get(utils.RecoveryKeySecret)
+		assert.ErrorIs(t, err, utils.ErrSecretNotFound)
+	})
+
+	t.Run("different key in keychain", func(t *testing.T) {
+		cfg, st := migrateConfig(t, true)
+		secrets := utils.NewMemorySecretStore()
+		require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "WXYZ-WXYZ"))
+		require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, cfg.OutputPath, cfg, secrets))
+
+		assert.Error(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+		assert.FileExists(t, cfg.OutputPath)
+		key, err := secrets.Get(utils.RecoveryKeySecret)
+		require.NoError(t, err)
+		assert.Equal(t, "WXYZ-WXYZ", key)
+	})
+
+	t.Run("same key in keychain finishes the migration", func(t *testing.T) {
+		cfg, st := migrateConfig(t, true)
+		secrets := utils.NewMemorySecretStore()
+		require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+		require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, cfg.OutputPath, cfg, secrets))
+
+		require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+		assert.NoFileExists(t, cfg.OutputPath)
+	})
+}
+
+func TestMigrateStorageToPlist(t *testing.T) {
+	cfg, st := migrateConfig(t, false)
+	secrets := utils.NewMemorySecretStore()
+	require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+	escrowed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := keyhistory.New(secrets, cfg.KeyHistoryLimit)
+	fingerprint, err := history.Fingerprint("ABCD-EFGH")
+	require.NoError(t, err)
+	// keys kept while the keychain was in use
+	previous, err := history.Add("IJKL-MNOP")
+	require.NoError(t, err)
+	require.NoError(t, history.MarkEscrowed("ABCD-EFGH", "crypt"))
+	require.NoError(t, secrets.SetMetadata(utils.RecoveryKeySecret, utils.SecretMetadata{
+		Fingerprint: fingerprint,
+		EnabledUser: "jappleseed",
+		EnabledDate: "2024-01-02 03:04:05 +0000",
+		LastEscrow:  escrowed,
+	}))
+
+	require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+
+	_, err = secrets.Get(utils.RecoveryKeySecret)
+	assert.ErrorIs(t, err, utils.ErrSecretNotFound)
+
+	cryptData, err := parsePlist(cfg.OutputPath, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", cryptData.RecoveryKey)
+	assert.Equal(t, "jappleseed", cryptData.EnabledUser)
+	assert.Equal(t, "2024-01-02 03:04:05 +0000", cryptData.EnabledDate)
+	assert.True(t, escrowed.Equal(cryptData.LastRun))
+	assert.True(t, cryptData.EscrowSuccess)
+
+	// no copy of any key is left behind in the history
+	entries, err := history.Entries()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	for _, name := range []string{
+		keyhistory.IndexSecret + "." + previous.Short(),
+		keyhistory.IndexSecret + "." + keyhistory.Short(fingerprint),
+		keyhistory.IndexSecret,
+		keyhistory.FingerprintKeySecret,
+	} {
+		_, err = secrets.Get(name)
+		assert.ErrorIs(t, err, utils.ErrSecretNotFound, name)
+	}
+
+	// running again has nothing to do
+	require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+	assert.FileExists(t, cfg.OutputPath)
+}
+
+func TestMigrateStorageToPlistFailures(t *testing.T) {
+	t.Run("invalid key", func(t *testing.T) {
+		cfg, st := migrateConfig(t, false)
+		secrets := utils.NewMemorySecretStore()
+		require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+
+		r := utils.Runner{Runner: utils.MockCmdRunner{Output: "false"}}
+		assert.Error(t, MigrateStorage(r, cfg, st, secrets))
+		assert.NoFileExists(t, cfg.OutputPath)
+		_, err := secrets.Get(utils.RecoveryKeySecret)
+		assert.NoError(t, err)
+	})
+
+	t.Run("different key in plist", func(t *testing.T) {
+		cfg, st := migrateConfig(t, false)
+		secrets := utils.NewMemorySecretStore()
+		require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+		require.NoError(t, writePlist(CryptData{RecoveryKey: "WXYZ-WXYZ"}, cfg.OutputPath, cfg, secrets))
+
+		assert.Error(t, MigrateStorage(validKeyRunner(), cfg, st, secrets))
+		_, err := secrets.Get(utils.RecoveryKeySecret)
+		assert.NoError(t, err)
+	})
+
+	t.Run("nothing to migrate", func(t *testing.T) {
+		cfg, st := migrateConfig(t, false)
+		require.NoError(t, MigrateStorage(validKeyRunner(), cfg, st, utils.NewMemorySecretStore()))
+		assert.NoFileExists(t, cfg.OutputPath)
+	})
+}
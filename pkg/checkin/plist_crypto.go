@@ -0,0 +1,159 @@
+package checkin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"strings"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// encryptedKeyPrefix marks a RecoveryKey in the plist that has been
+	// encrypted. The rest of the value is the base64 encoded nonce followed by
+	// the sealed key.
+	encryptedKeyPrefix = "crypt-aesgcm:v1:"
+
+	// plistKeySecret is the name of the secret holding the AES-256 key used to
+	// encrypt the RecoveryKey in the plist.
+	plistKeySecret = utils.RecoveryKeySecret + ".plist"
+
+	// plistKeyAAD is authenticated with the sealed key so a value cannot be
+	// moved to another field.
+	plistKeyAAD = "RecoveryKey"
+)
+
+// isEncryptedRecoveryKey reports whether value is an encrypted RecoveryKey.
+func isEncryptedRecoveryKey(value string) bool {
+	return strings.HasPrefix(value, encryptedKeyPrefix)
+}
+
+// encryptRecoveryKey encrypts recoveryKey with AES-256-GCM for storing in the
+// plist. The AES key is kept in secrets and generated the first time it is
+// needed.
+//
+// Parameters:
+//   - recoveryKey: The recovery key to encrypt
+//   - secrets: SecretStore holding the AES key
+//
+// Returns:
+//   - string: The encrypted value, prefixed with encryptedKeyPrefix
+//   - error: Any error encountered while encrypting
+func encryptRecoveryKey(recoveryKey string, secrets utils.SecretStore) (string, error) {
+	if recoveryKey == "" || isEncryptedRecoveryKey(recoveryKey) {
+		return recoveryKey, nil
+	}
+
+	aead, err := plistCipher(secrets, true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(recoveryKey), []byte(plistKeyAAD))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptRecoveryKey returns the recovery key from a RecoveryKey read from the
+// plist. Values that are not encrypted, such as those written by older
+// versions or the authorization plugin, are returned unchanged.
+//
+// Parameters:
+//   - value: The RecoveryKey from the plist
+//   - secrets: SecretStore holding the AES key
+//
+// Returns:
+//   - string: The recovery key
+//   - error: Any error encountered while decrypting
+func decryptRecoveryKey(value string, secrets utils.SecretStore) (string, error) {
+	if !isEncryptedRecoveryKey(value) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedKeyPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode encrypted recovery key")
+	}
+	aead, err := plistCipher(secrets, false)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted recovery key is truncated")
+	}
+	recoveryKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(plistKeyAAD))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt recovery key")
+	}
+	return string(recoveryKey), nil
+}
+
+// plistCipher returns the AEAD for the plist key in secrets, generating the
+// key first if create is true and there isn't one yet.
+func plistCipher(secrets utils.SecretStore, create bool) (cipher.AEAD, error) {
+	encoded, err := secrets.Get(plistKeySecret)
+	if errors.Is(err, utils.ErrSecretNotFound) && create {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrap(err, "failed to generate plist key")
+		}
+		encoded = hex.EncodeToString(b)
+		if err := secrets.Set(plistKeySecret, encoded); err != nil {
+			return nil, errors.Wrap(err, "failed to save plist key")
+		}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read plist key")
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode plist key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPlistAtRest rewrites the plist with the RecoveryKey encrypted if
+// EncryptRecoveryKeyPlist is set and it is still in plain text, for example
+// because the authorization plugin or an older version wrote it.
+//
+// Parameters:
+//   - plistPath: String path to the plist file
+//   - cryptData: The decrypted contents of the plist
+//   - cfg: Config snapshot of the preferences for this run
+//   - secrets: SecretStore holding the AES key
+//
+// Returns:
+//   - error: Any error encountered while rewriting the plist
+func encryptPlistAtRest(plistPath string, cryptData CryptData, cfg pref.Config, secrets utils.SecretStore) error {
+	if !cfg.EncryptRecoveryKeyPlist {
+		return nil
+	}
+
+	var stored struct {
+		RecoveryKey string `plist:"RecoveryKey"`
+	}
+	if err := readPlist(plistPath, &stored); err != nil {
+		return err
+	}
+	if stored.RecoveryKey == "" || isEncryptedRecoveryKey(stored.RecoveryKey) {
+		return nil
+	}
+
+	log.Println("Encrypting the recovery key in the plist.")
+	if err := writePlist(cryptData, plistPath, cfg, secrets); err != nil {
+		return errors.Wrap(err, "failed to encrypt plist")
+	}
+	return nil
+}
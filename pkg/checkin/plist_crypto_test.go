@@ -0,0 +1,120 @@
+package checkin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/groob/plist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptRecoveryKey(t *testing.T) {
+	secrets := utils.NewMemorySecretStore()
+
+	encrypted, err := encryptRecoveryKey("ABCD-EFGH", secrets)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, encryptedKeyPrefix))
+	assert.NotContains(t, encrypted, "ABCD-EFGH")
+
+	again, err := encryptRecoveryKey("ABCD-EFGH", secrets)
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, again, "each encryption uses a fresh nonce")
+
+	decrypted, err := decryptRecoveryKey(encrypted, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", decrypted)
+
+	// already encrypted values are left alone
+	same, err := encryptRecoveryKey(encrypted, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, same)
+}
+
+func TestDecryptRecoveryKey(t *testing.T) {
+	secrets := utils.NewMemorySecretStore()
+	encrypted, err := encryptRecoveryKey("ABCD-EFGH", secrets)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		value   string
+		secrets utils.SecretStore
+		want    string
+		wantErr bool
+	}{
+		{name: "plain text", value: "ABCD-EFGH", secrets: utils.NewMemorySecretStore(), want: "ABCD-EFGH"},
+		{name: "encrypted", value: encrypted, secrets: secrets, want: "ABCD-EFGH"},
+		{name: "missing key", value: encrypted, secrets: utils.NewMemorySecretStore(), wantErr: true},
+		{name: "tampered", value: encrypted[:len(encrypted)-4] + "AAAA", secrets: secrets, wantErr: true},
+		{name: "not base64", value: encryptedKeyPrefix + "!!!", secrets: secrets, wantErr: true},
+		{name: "truncated", value: encryptedKeyPrefix + "AAAA", secrets: secrets, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptRecoveryKey(tt.value, tt.secrets)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEncryptedPlist(t *testing.T) {
+	plistPath := filepath.Join(t.TempDir(), "crypt_output.plist")
+	cfg := testConfig(t, preftest.PlistMode(plistPath, false), preftest.WithValue("EncryptRecoveryKeyPlist", true))
+	secrets := utils.NewMemorySecretStore()
+
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH", EnabledUser: "jappleseed"}, plistPath, cfg, secrets))
+
+	stored := readStoredRecoveryKey(t, plistPath)
+	assert.True(t, isEncryptedRecoveryKey(stored))
+
+	cryptData, err := parsePlist(plistPath, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", cryptData.RecoveryKey)
+	assert.Equal(t, "jappleseed", cryptData.EnabledUser)
+
+	key, err := getRecoveryKey(plistPath, cfg, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", key)
+}
+
+func TestEncryptPlistAtRest(t *testing.T) {
+	plistPath := filepath.Join(t.TempDir(), "crypt_output.plist")
+	secrets := utils.NewMemorySecretStore()
+	plain := testConfig(t, preftest.PlistMode(plistPath, false))
+	cryptData := CryptData{RecoveryKey: "ABCD-EFGH"}
+
+	// a plist written by an older version
+	require.NoError(t, writePlist(cryptData, plistPath, plain, secrets))
+	require.NoError(t, encryptPlistAtRest(plistPath, cryptData, plain, secrets))
+	assert.Equal(t, "ABCD-EFGH", readStoredRecoveryKey(t, plistPath))
+
+	encrypt := testConfig(t, preftest.PlistMode(plistPath, false), preftest.WithValue("EncryptRecoveryKeyPlist", true))
+	require.NoError(t, encryptPlistAtRest(plistPath, cryptData, encrypt, secrets))
+	stored := readStoredRecoveryKey(t, plistPath)
+	assert.True(t, isEncryptedRecoveryKey(stored))
+
+	// already encrypted, so it isn't written again
+	require.NoError(t, encryptPlistAtRest(plistPath, cryptData, encrypt, secrets))
+	assert.Equal(t, stored, readStoredRecoveryKey(t, plistPath))
+}
+
+func readStoredRecoveryKey(t *testing.T, plistPath string) string {
+	t.Helper()
+	plistBytes, err := os.ReadFile(plistPath)
+	require.NoError(t, err)
+	var stored struct {
+		RecoveryKey string `plist:"RecoveryKey"`
+	}
+	require.NoError(t, plist.Unmarshal(plistBytes, &stored))
+	return stored.RecoveryKey
+}
@@ -0,0 +1,66 @@
+package checkin
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/groob/plist"
+	"github.com/pkg/errors"
+)
+
+// The output plist is written owned by root:wheel, and must be owned by root to
+// be read. They are variables so tests can run as another user.
+var (
+	plistUID = 0 // nolint:gochecknoglobals
+	plistGID = 0 // nolint:gochecknoglobals
+)
+
+// launchd starts checkin as soon as the output plist changes, which can be
+// while the authorization plugin is still writing it, so a plist that cannot
+// be parsed is read again a few times before giving up.
+var (
+	plistReadAttempts = 5                      // nolint:gochecknoglobals
+	plistReadDelay    = 200 * time.Millisecond // nolint:gochecknoglobals
+)
+
+// readPlist reads the plist at plistPath into v. The file is refused if it is
+// a symlink, is not owned by root or is writable by anyone else. Reads that
+// fail for any other reason are retried briefly.
+//
+// Parameters:
+//   - plistPath: String path to the plist file
+//   - v: Pointer to the value to unmarshal the plist into
+//
+// Returns:
+//   - error: Any error encountered reading or parsing the plist
+func readPlist(plistPath string, v interface{}) error {
+	var err error
+	for attempt := 1; attempt <= plistReadAttempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Could not read %s, retrying: %v", plistPath, err)
+			time.Sleep(plistReadDelay)
+		}
+
+		var plistBytes []byte
+		plistBytes, err = utils.ReadFileSecure(plistPath, plistUID)
+		if errors.Is(err, utils.ErrInsecureFile) || os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to read plist file")
+		} else if err != nil {
+			err = errors.Wrap(err, "failed to read plist file")
+			continue
+		}
+		if len(plistBytes) == 0 {
+			err = errors.New("plist file is empty")
+			continue
+		}
+
+		err = plist.Unmarshal(plistBytes, v)
+		if err == nil {
+			return nil
+		}
+		err = errors.Wrap(err, "failed to unmarshal plist")
+	}
+	return err
+}
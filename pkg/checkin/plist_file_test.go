@@ -0,0 +1,99 @@
+package checkin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// the tests write and read plists as whoever runs them, not root
+	plistUID, plistGID = os.Getuid(), os.Getgid()
+	plistReadDelay = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestWritePlistPermissions(t *testing.T) {
+	dir := t.TempDir()
+	plistPath := filepath.Join(dir, "crypt_output.plist")
+	secrets := utils.NewMemorySecretStore()
+
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, plistPath, testConfig(t), secrets))
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "WXYZ-WXYZ"}, plistPath, testConfig(t), secrets))
+
+	info, err := os.Stat(plistPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	cryptData, err := parsePlist(plistPath, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "WXYZ-WXYZ", cryptData.RecoveryKey)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestReadPlistRefusesInsecureFiles(t *testing.T) {
+	dir := t.TempDir()
+	plistPath := filepath.Join(dir, "crypt_output.plist")
+	secrets := utils.NewMemorySecretStore()
+	require.NoError(t, writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, plistPath, testConfig(t), secrets))
+
+	link := filepath.Join(dir, "link.plist")
+	require.NoError(t, os.Symlink(plistPath, link))
+	_, err := parsePlist(link, secrets)
+	assert.ErrorIs(t, err, utils.ErrInsecureFile)
+
+	require.NoError(t, os.Chmod(plistPath, 0666))
+	_, err = parsePlist(plistPath, secrets)
+	assert.ErrorIs(t, err, utils.ErrInsecureFile)
+
+	require.NoError(t, os.Chmod(plistPath, 0600))
+	uid := plistUID
+	plistUID = uid + 1
+	defer func() { plistUID = uid }()
+	_, err = getRecoveryKey(plistPath, testConfig(t), secrets)
+	assert.ErrorIs(t, err, utils.ErrInsecureFile)
+}
+
+func TestReadPlistRetriesPartialWrites(t *testing.T) {
+	plistPath := filepath.Join(t.TempDir(), "crypt_output.plist")
+	secrets := utils.NewMemorySecretStore()
+
+	attempts := plistReadAttempts
+	plistReadAttempts = 50
+	defer func() { plistReadAttempts = attempts }()
+
+	// the plugin has only written part of the plist so far
+	require.NoError(t, os.WriteFile(plistPath, []byte("<?xml version=\"1.0\""), 0600))
+	cfg := testConfig(t)
+	done := make(chan error)
+	go func() {
+		time.Sleep(plistReadDelay + plistReadDelay/2)
+		done <- writePlist(CryptData{RecoveryKey: "ABCD-EFGH"}, plistPath, cfg, secrets)
+	}()
+
+	cryptData, err := parsePlist(plistPath, secrets)
+	require.NoError(t, <-done)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", cryptData.RecoveryKey)
+}
+
+func TestReadPlistGivesUp(t *testing.T) {
+	plistPath := filepath.Join(t.TempDir(), "crypt_output.plist")
+	require.NoError(t, os.WriteFile(plistPath, nil, 0600))
+
+	_, err := parsePlist(plistPath, utils.NewMemorySecretStore())
+	assert.Error(t, err)
+
+	_, err = parsePlist(filepath.Join(t.TempDir(), "missing.plist"), utils.NewMemorySecretStore())
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+}
@@ -0,0 +1,86 @@
+package checkin
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// errPersonalKeyMissing is returned when FileVault only has an institutional
+// recovery key and MissingPersonalKeyAction is "fail".
+var errPersonalKeyMissing = errors.New("no personal recovery key, only an institutional recovery key")
+
+// recoveryKeyTypes records which kinds of recovery key FileVault has.
+type recoveryKeyTypes struct {
+	Personal      bool
+	Institutional bool
+}
+
+// getRecoveryKeyTypes asks fdesetup whether FileVault has a personal and an
+// institutional recovery key.
+// Parameters:
+//   - r: Runner interface for executing system commands
+//
+// Returns:
+//   - recoveryKeyTypes: Which recovery keys are present
+//   - error: Any error encountered running fdesetup
+func getRecoveryKeyTypes(r utils.Runner) (recoveryKeyTypes, error) {
+	var keys recoveryKeyTypes
+	var err error
+	if keys.Personal, err = fdesetupBool(r, "haspersonalrecoverykey"); err != nil {
+		return recoveryKeyTypes{}, err
+	}
+	if keys.Institutional, err = fdesetupBool(r, "hasinstitutionalrecoverykey"); err != nil {
+		return recoveryKeyTypes{}, err
+	}
+	return keys, nil
+}
+
+// fdesetupBool runs an fdesetup verb that answers true or false.
+func fdesetupBool(r utils.Runner, verb string) (bool, error) {
+	out, err := r.Runner.RunCmd("/usr/bin/fdesetup", verb)
+	if err != nil {
+		return false, errors.Wrapf(err, "fdesetup %s", verb)
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected output from fdesetup %s: %q", verb, strings.TrimSpace(string(out)))
+}
+
+// checkRecoveryKeyTypes records which recovery keys FileVault has in entry,
+// and acts on MissingPersonalKeyAction if there is only an institutional key.
+// Not being able to ask fdesetup is logged rather than returned.
+// Parameters:
+//   - r: Runner interface for executing system commands
+//   - cfg: Config snapshot of the preferences for this run
+//   - entry: Journal entry for this run
+//
+// Returns:
+//   - *recoveryKeyTypes: Which recovery keys are present, or nil if unknown
+//   - error: errPersonalKeyMissing if the run should stop
+func checkRecoveryKeyTypes(r utils.Runner, cfg pref.Config, entry *journal.Entry) (*recoveryKeyTypes, error) {
+	keys, err := getRecoveryKeyTypes(r)
+	if err != nil {
+		log.Printf("Could not check which recovery keys are present: %v", err)
+		return nil, nil
+	}
+	entry.PersonalKey = &keys.Personal
+	entry.InstitutionalKey = &keys.Institutional
+
+	if !keys.Personal && keys.Institutional {
+		if cfg.MissingPersonalKeyAction == pref.MissingPersonalKeyFail {
+			return nil, errPersonalKeyMissing
+		}
+		log.Println("Warning: FileVault has an institutional recovery key but no personal recovery key, so there is no personal key to escrow.")
+	}
+	return &keys, nil
+}
@@ -0,0 +1,115 @@
+package checkin
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/journal"
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fdesetupRunner answers fdesetup verbs from a map, and everything else like
+// the embedded MockCmdRunner.
+type fdesetupRunner struct {
+	utils.MockCmdRunner
+	verbs map[string]string
+}
+
+func (f fdesetupRunner) RunCmd(name string, arg ...string) ([]byte, error) {
+	if name == "/usr/bin/fdesetup" && len(arg) == 1 {
+		if out, ok := f.verbs[arg[0]]; ok {
+			return []byte(out + "\n"), nil
+		}
+	}
+	return f.MockCmdRunner.RunCmd(name, arg...)
+}
+
+func keyTypesRunner(personal, institutional string) utils.Runner {
+	return utils.Runner{Runner: fdesetupRunner{verbs: map[string]string{
+		"haspersonalrecoverykey":      personal,
+		"hasinstitutionalrecoverykey": institutional,
+	}}}
+}
+
+func TestCheckRecoveryKeyTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		personal      string
+		institutional string
+		action        string
+		want          *recoveryKeyTypes
+		wantErr       error
+	}{
+		{name: "personal only", personal: "true", institutional: "false", want: &recoveryKeyTypes{Personal: true}},
+		{name: "both", personal: "true", institutional: "true", action: pref.MissingPersonalKeyFail, want: &recoveryKeyTypes{Personal: true, Institutional: true}},
+		{name: "institutional only warns", personal: "false", institutional: "true", action: pref.MissingPersonalKeyWarn, want: &recoveryKeyTypes{Institutional: true}},
+		{name: "institutional only fails", personal: "false", institutional: "true", action: pref.MissingPersonalKeyFail, wantErr: errPersonalKeyMissing},
+		{name: "fdesetup not answering", personal: "maybe", institutional: "true", action: pref.MissingPersonalKeyFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &journal.Entry{}
+			cfg := pref.Config{MissingPersonalKeyAction: tt.action}
+
+			keys, err := checkRecoveryKeyTypes(keyTypesRunner(tt.personal, tt.institutional), cfg, entry)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, keys)
+			if tt.want == nil {
+				assert.Nil(t, entry.PersonalKey)
+				return
+			}
+			require.NotNil(t, entry.PersonalKey)
+			assert.Equal(t, tt.want.Personal, *entry.PersonalKey)
+			assert.Equal(t, tt.want.Institutional, *entry.InstitutionalKey)
+		})
+	}
+}
+
+func TestBuildDataKeyTypes(t *testing.T) {
+	r := utils.Runner{Runner: utils.MockCmdRunner{Output: "test_computer_name"}}
+
+	data, err := buildData(CryptData{RecoveryKey: "test_recovery_key"}, r)
+	require.NoError(t, err)
+	assert.NotContains(t, data, "recovery_key=")
+
+	data, err = buildData(CryptData{RecoveryKey: "test_recovery_key", KeyTypes: &recoveryKeyTypes{Personal: true, Institutional: true}}, r)
+	require.NoError(t, err)
+	values, err := url.ParseQuery(data)
+	require.NoError(t, err)
+	assert.Equal(t, "true", values.Get("personal_recovery_key"))
+	assert.Equal(t, "true", values.Get("institutional_recovery_key"))
+}
+
+func TestRunEscrowPersonalKeyMissing(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t,
+		preftest.PlistMode(filepath.Join(dir, "crypt_output.plist"), false),
+		preftest.WithValue("ManageAuthMechs", false),
+		preftest.WithValue("ValidateKey", false),
+		preftest.WithValue("MissingPersonalKeyAction", pref.MissingPersonalKeyFail),
+	)
+	j := journal.New(filepath.Join(dir, "journal.jsonl"))
+
+	err := RunEscrow(keyTypesRunner("false", "true"), preftest.New(), cfg, state.New(filepath.Join(dir, "state.json")), utils.NewMemorySecretStore(), j)
+	assert.True(t, errors.Is(err, errPersonalKeyMissing))
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, journal.Failed, entries[0].Decision)
+	assert.Equal(t, "key", entries[0].ErrorClass)
+	require.NotNil(t, entries[0].InstitutionalKey)
+	assert.True(t, *entries[0].InstitutionalKey)
+	assert.False(t, *entries[0].PersonalKey)
+}
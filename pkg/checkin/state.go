@@ -0,0 +1,149 @@
+package checkin
+
+import (
+	"log"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// importLegacyLastEscrow moves a LastEscrow date found in the preference domain
+// into the state store and removes it from preferences. Older versions of
+// checkin stored it there, and the authorization plugin still resets it to the
+// Unix epoch when it generates a new key so the key is escrowed at the next run.
+// A value that can't be removed, such as a managed one, is only imported once.
+//
+// Parameters:
+//   - p: PrefInterface to read and delete the LastEscrow preference from
+//   - st: Store holding the runtime state
+//
+// Returns:
+//   - error: Any error encountered while updating the state
+func importLegacyLastEscrow(p pref.PrefInterface, st *state.Store) error {
+	lastEscrow, err := p.GetDate("LastEscrow")
+	if err != nil {
+		return errors.Wrap(err, "failed to get LastEscrow preference")
+	}
+	if lastEscrow.IsZero() {
+		return nil
+	}
+
+	err = st.Update(func(s *state.State) error {
+		switch {
+		case lastEscrow.Equal(s.ImportedLastEscrow):
+			// imported on an earlier run, but could not be removed
+		case lastEscrow.Unix() == 0:
+			log.Println("A new recovery key was generated, it will be escrowed on this run.")
+			s.LastEscrow = time.Time{}
+		case s.LastEscrow.IsZero():
+			s.LastEscrow = lastEscrow
+		}
+		s.ImportedLastEscrow = lastEscrow
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to import LastEscrow into state")
+	}
+
+	if err := p.Delete("LastEscrow"); err != nil {
+		// A managed LastEscrow cannot be removed. The state store now holds the
+		// authoritative value and remembers it was imported, so this is not
+		// fatal.
+		log.Printf("Could not remove LastEscrow from preferences: %v", err)
+		return nil
+	}
+
+	// once removed, the plugin setting it again is a new key even if the
+	// value is the same
+	err = st.Update(func(s *state.State) error {
+		s.ImportedLastEscrow = time.Time{}
+		return nil
+	})
+	return errors.Wrap(err, "failed to import LastEscrow into state")
+}
+
+// recordEscrow stores the outcome of an escrow attempt in the state store.
+//
+// Parameters:
+//   - st: Store holding the runtime state
+//   - server: The URL the key was escrowed to
+//   - escrowErr: The error returned by the escrow attempt, or nil if it succeeded
+//   - keyRotated: Whether the escrowed key was removed for rotation afterwards
+//   - fingerprint: The fingerprint of the escrowed key
+//
+// Returns:
+//   - error: Any error encountered while saving the state
+func recordEscrow(st *state.Store, server string, escrowErr error, keyRotated bool, fingerprint string) error {
+	return st.Update(func(s *state.State) error {
+		now := time.Now()
+		s.LastEscrowAttempt = now
+		s.LastEscrowServer = server
+		s.EscrowAttempts++
+
+		if escrowErr != nil {
+			s.EscrowFailures++
+			s.ConsecutiveFailures++
+			s.LastEscrowError = escrowErr.Error()
+			return nil
+		}
+
+		s.ConsecutiveFailures = 0
+		s.LastEscrowError = ""
+		if keyRotated {
+			// The escrowed key is gone, the next key must be escrowed straight away.
+			s.LastEscrow = time.Time{}
+			s.LastEscrowFingerprint = ""
+		} else {
+			s.LastEscrow = now
+			s.LastEscrowFingerprint = fingerprint
+		}
+		return nil
+	})
+}
+
+// lastEscrowForKey returns the last escrow date to use for the recovery key in
+// secret. The state store is authoritative, but if it has no date, for example
+// because it was removed, the date recorded on the keychain item is used as
+// long as it was recorded for the same key.
+//
+// Parameters:
+//   - stateLastEscrow: The last escrow date from the state store
+//   - secret: The recovery key and its keychain item metadata
+//   - fingerprint: The fingerprint of the recovery key
+//
+// Returns:
+//   - time.Time: The last escrow date, zero if the key has not been escrowed
+func lastEscrowForKey(stateLastEscrow time.Time, secret utils.Secret, fingerprint string) time.Time {
+	if !stateLastEscrow.IsZero() {
+		return stateLastEscrow
+	}
+	if secret.Metadata.Fingerprint != fingerprint || secret.Metadata.LastEscrow.IsZero() {
+		return stateLastEscrow
+	}
+	log.Println("Using the last escrow date recorded on the keychain item.")
+	return secret.Metadata.LastEscrow
+}
+
+// recordKeyMetadata records a successful escrow on the recovery key's keychain
+// item so the item describes itself.
+//
+// Parameters:
+//   - secrets: SecretStore holding the recovery key
+//   - cryptData: The data that was escrowed
+//   - fingerprint: The fingerprint of the escrowed key
+//   - server: The URL the key was escrowed to
+//
+// Returns:
+//   - error: Any error encountered while updating the item
+func recordKeyMetadata(secrets utils.SecretStore, cryptData CryptData, fingerprint string, server string) error {
+	return secrets.SetMetadata(utils.RecoveryKeySecret, utils.SecretMetadata{
+		Fingerprint:      fingerprint,
+		EnabledUser:      cryptData.EnabledUser,
+		EnabledDate:      cryptData.EnabledDate,
+		LastEscrow:       time.Now(),
+		LastEscrowServer: server,
+	})
+}
@@ -0,0 +1,148 @@
+package checkin
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/grahamgilbert/crypt/pkg/state"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lastEscrowPref(lastEscrow time.Time) *preftest.Fake {
+	if lastEscrow.IsZero() {
+		return preftest.New()
+	}
+	return preftest.New(preftest.WithValue("LastEscrow", lastEscrow))
+}
+
+func TestImportLegacyLastEscrow(t *testing.T) {
+	previous := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("nothing to import", func(t *testing.T) {
+		st := state.New(filepath.Join(t.TempDir(), "state.json"))
+		p := lastEscrowPref(time.Time{})
+
+		require.NoError(t, importLegacyLastEscrow(p, st))
+		assert.Empty(t, p.CallsTo("Delete"))
+	})
+
+	t.Run("imports date from older version", func(t *testing.T) {
+		st := state.New(filepath.Join(t.TempDir(), "state.json"))
+		p := lastEscrowPref(previous)
+
+		require.NoError(t, importLegacyLastEscrow(p, st))
+		assert.Equal(t, []preftest.Call{{Method: "Delete", Name: "LastEscrow"}}, p.CallsTo("Delete"))
+		_, stillSet := p.Value("LastEscrow")
+		assert.False(t, stillSet)
+
+		s, err := st.Load()
+		require.NoError(t, err)
+		assert.True(t, previous.Equal(s.LastEscrow))
+	})
+
+	t.Run("epoch from the plugin resets the last escrow", func(t *testing.T) {
+		st := state.New(filepath.Join(t.TempDir(), "state.json"))
+		require.NoError(t, st.Save(state.State{LastEscrow: previous}))
+		p := lastEscrowPref(time.Unix(0, 0))
+
+		require.NoError(t, importLegacyLastEscrow(p, st))
+
+		s, err := st.Load()
+		require.NoError(t, err)
+		assert.True(t, s.LastEscrow.IsZero())
+		assert.True(t, s.ImportedLastEscrow.IsZero())
+	})
+
+	t.Run("epoch that can't be removed is only imported once", func(t *testing.T) {
+		st := state.New(filepath.Join(t.TempDir(), "state.json"))
+		p := preftest.New(preftest.Managed("LastEscrow", time.Unix(0, 0)))
+
+		require.NoError(t, importLegacyLastEscrow(p, st))
+		s, err := st.Load()
+		require.NoError(t, err)
+		assert.True(t, s.LastEscrow.IsZero())
+		_, stillSet := p.Value("LastEscrow")
+		assert.True(t, stillSet)
+
+		// the key is escrowed, and the next run leaves the escrow date alone
+		require.NoError(t, recordEscrow(st, "https://crypt.example.com/checkin/", nil, false, "fingerprint"))
+		require.NoError(t, importLegacyLastEscrow(p, st))
+		s, err = st.Load()
+		require.NoError(t, err)
+		assert.False(t, s.LastEscrow.IsZero())
+		assert.Len(t, p.CallsTo("Delete"), 2)
+	})
+}
+
+func TestRecordEscrow(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state.json"))
+	server := "https://crypt.example.com/checkin/"
+
+	require.NoError(t, recordEscrow(st, server, errors.New("server returned non-200 status: 500"), false, "abc"))
+	require.NoError(t, recordEscrow(st, server, errors.New("server returned non-200 status: 500"), false, "abc"))
+
+	s, err := st.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.EscrowAttempts)
+	assert.Equal(t, 2, s.EscrowFailures)
+	assert.Equal(t, 2, s.ConsecutiveFailures)
+	assert.Contains(t, s.LastEscrowError, "500")
+	assert.True(t, s.LastEscrow.IsZero())
+	assert.Empty(t, s.LastEscrowFingerprint)
+
+	require.NoError(t, recordEscrow(st, server, nil, false, "abc"))
+
+	s, err = st.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 3, s.EscrowAttempts)
+	assert.Equal(t, 0, s.ConsecutiveFailures)
+	assert.Empty(t, s.LastEscrowError)
+	assert.Equal(t, server, s.LastEscrowServer)
+	assert.False(t, s.LastEscrow.IsZero())
+	assert.Equal(t, "abc", s.LastEscrowFingerprint)
+
+	require.NoError(t, recordEscrow(st, server, nil, true, "abc"))
+
+	s, err = st.Load()
+	require.NoError(t, err)
+	assert.True(t, s.LastEscrow.IsZero())
+	assert.Empty(t, s.LastEscrowFingerprint)
+}
+
+func TestLastEscrowForKey(t *testing.T) {
+	escrowed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	recorded := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	secret := utils.Secret{
+		Value:    "ABCD-EFGH",
+		Metadata: utils.SecretMetadata{Fingerprint: "abc", LastEscrow: recorded},
+	}
+
+	assert.Equal(t, escrowed, lastEscrowForKey(escrowed, secret, "abc"))
+	assert.Equal(t, recorded, lastEscrowForKey(time.Time{}, secret, "abc"))
+	// recorded for a different key
+	assert.True(t, lastEscrowForKey(time.Time{}, secret, "def").IsZero())
+	assert.True(t, lastEscrowForKey(time.Time{}, utils.Secret{Value: "ABCD-EFGH"}, "abc").IsZero())
+}
+
+func TestRecordKeyMetadata(t *testing.T) {
+	secrets := utils.NewMemorySecretStore()
+	cryptData := CryptData{EnabledUser: "jappleseed", EnabledDate: "2024-01-02 03:04:05 +0000"}
+	server := "https://crypt.example.com/checkin/"
+
+	assert.Error(t, recordKeyMetadata(secrets, cryptData, "abc", server))
+
+	require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "ABCD-EFGH"))
+	require.NoError(t, recordKeyMetadata(secrets, cryptData, "abc", server))
+
+	secret, err := secrets.GetSecret(utils.RecoveryKeySecret)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", secret.Metadata.Fingerprint)
+	assert.Equal(t, "jappleseed", secret.Metadata.EnabledUser)
+	assert.Equal(t, server, secret.Metadata.LastEscrowServer)
+	assert.False(t, secret.Metadata.LastEscrow.IsZero())
+}
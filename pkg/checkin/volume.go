@@ -0,0 +1,196 @@
+package checkin
+
+import (
+	"log"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/groob/plist"
+	"github.com/pkg/errors"
+)
+
+// apfsList is the part of `diskutil apfs list -plist` needed to identify the
+// FileVault volume.
+type apfsList struct {
+	Containers []struct {
+		PhysicalStores []struct {
+			DeviceIdentifier string `plist:"DeviceIdentifier"`
+			DiskUUID         string `plist:"DiskUUID"`
+		} `plist:"PhysicalStores"`
+		Volumes []struct {
+			APFSVolumeUUID   string   `plist:"APFSVolumeUUID"`
+			DeviceIdentifier string   `plist:"DeviceIdentifier"`
+			FileVault        bool     `plist:"FileVault"`
+			Roles            []string `plist:"Roles"`
+		} `plist:"Volumes"`
+	} `plist:"Containers"`
+}
+
+// apfsVolumeGroups is the part of `diskutil apfs listVolumeGroups -plist`
+// needed to find the volume group of the FileVault volume.
+type apfsVolumeGroups struct {
+	Containers []struct {
+		VolumeGroups []struct {
+			APFSVolumeGroupUUID string `plist:"APFSVolumeGroupUUID"`
+			Volumes             []struct {
+				APFSVolumeUUID string `plist:"APFSVolumeUUID"`
+			} `plist:"Volumes"`
+		} `plist:"VolumeGroups"`
+	} `plist:"Containers"`
+}
+
+// volumeIdentifiers are the UUIDs fdesetup reports for the volume a recovery
+// key unlocks. On APFS the logical volume group is the volume group the
+// System and Data volumes belong to.
+type volumeIdentifiers struct {
+	LVUUID  string
+	PVUUID  string
+	LVGUUID string
+}
+
+// getVolumeIdentifiers returns the identifiers of a volume from diskutil.
+// Parameters:
+//   - r: Runner interface for executing system commands
+//   - volumeUUID: APFSVolumeUUID of the volume, or empty for the FileVault volume
+//
+// Returns:
+//   - volumeIdentifiers: The UUIDs of the volume, its physical store and volume group
+//   - error: Any error encountered running or parsing diskutil
+func getVolumeIdentifiers(r utils.Runner, volumeUUID string) (volumeIdentifiers, error) {
+	out, err := r.Runner.RunCmd("/usr/sbin/diskutil", "apfs", "list", "-plist")
+	if err != nil {
+		return volumeIdentifiers{}, errors.Wrap(err, "failed to list APFS volumes")
+	}
+	ids, err := parseAPFSList(out, volumeUUID)
+	if err != nil {
+		return volumeIdentifiers{}, err
+	}
+
+	// volume groups only exist on macOS 10.15 and later, so not finding one
+	// leaves LVGUUID empty rather than losing the other identifiers
+	out, err = r.Runner.RunCmd("/usr/sbin/diskutil", "apfs", "listVolumeGroups", "-plist")
+	if err != nil {
+		log.Printf("Could not list APFS volume groups: %v", err)
+		return ids, nil
+	}
+	ids.LVGUUID, err = parseAPFSVolumeGroups(out, ids.LVUUID)
+	if err != nil {
+		log.Printf("Could not get the APFS volume group: %v", err)
+	}
+	return ids, nil
+}
+
+// parseAPFSList finds a volume and the physical store of its container in
+// the output of `diskutil apfs list -plist`. Without a volumeUUID the
+// FileVault volume is found, preferring the Data volume, as on macOS 10.15
+// and later that is the volume FileVault encrypts.
+// Parameters:
+//   - data: Output of diskutil
+//   - volumeUUID: APFSVolumeUUID of the volume, or empty for the FileVault volume
+//
+// Returns:
+//   - volumeIdentifiers: The UUIDs of the volume and its physical store
+//   - error: Any error encountered parsing the output, or if the volume is not found
+func parseAPFSList(data []byte, volumeUUID string) (volumeIdentifiers, error) {
+	var list apfsList
+	if err := plist.Unmarshal(data, &list); err != nil {
+		return volumeIdentifiers{}, errors.Wrap(err, "failed to parse diskutil output")
+	}
+
+	var found *volumeIdentifiers
+	for _, container := range list.Containers {
+		for _, volume := range container.Volumes {
+			if volumeUUID != "" && volume.APFSVolumeUUID != volumeUUID {
+				continue
+			}
+			if volumeUUID == "" && !volume.FileVault {
+				continue
+			}
+			ids := volumeIdentifiers{LVUUID: volume.APFSVolumeUUID}
+			if len(container.PhysicalStores) > 0 {
+				ids.PVUUID = container.PhysicalStores[0].DiskUUID
+			}
+			if volumeUUID != "" || hasRole(volume.Roles, "Data") {
+				return ids, nil
+			}
+			if found == nil {
+				found = &ids
+			}
+		}
+	}
+	if volumeUUID != "" {
+		return volumeIdentifiers{}, errors.Errorf("no APFS volume has UUID %s", volumeUUID)
+	}
+	if found == nil {
+		return volumeIdentifiers{}, errors.New("no APFS volume has FileVault enabled")
+	}
+	return *found, nil
+}
+
+// parseAPFSVolumeGroups finds the volume group the volume with volumeUUID
+// belongs to in the output of `diskutil apfs listVolumeGroups -plist`.
+// Parameters:
+//   - data: Output of diskutil
+//   - volumeUUID: APFSVolumeUUID of the volume
+//
+// Returns:
+//   - string: The APFSVolumeGroupUUID of the volume group
+//   - error: Any error encountered parsing the output, or if the volume is in no group
+func parseAPFSVolumeGroups(data []byte, volumeUUID string) (string, error) {
+	var groups apfsVolumeGroups
+	if err := plist.Unmarshal(data, &groups); err != nil {
+		return "", errors.Wrap(err, "failed to parse diskutil output")
+	}
+	for _, container := range groups.Containers {
+		for _, group := range container.VolumeGroups {
+			for _, volume := range group.Volumes {
+				if volume.APFSVolumeUUID == volumeUUID {
+					return group.APFSVolumeGroupUUID, nil
+				}
+			}
+		}
+	}
+	return "", errors.Errorf("volume %s is not in an APFS volume group", volumeUUID)
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// addVolumeIdentifiers fills in any volume identifiers cryptData is missing
+// from diskutil. Values fdesetup already wrote to the plist are kept, and the
+// missing ones are looked up for the LVUUID it wrote so they all describe the
+// same volume. Without an LVUUID there is nothing to tie the others to, so
+// they are only filled in if all three are missing. Not being able to read
+// them is logged rather than returned, as the server can still match the key
+// by serial number.
+// Parameters:
+//   - cryptData: CryptData to fill in
+//   - r: Runner interface for executing system commands
+func addVolumeIdentifiers(cryptData *CryptData, r utils.Runner) {
+	if cryptData.LVUUID != "" && cryptData.PVUUID != "" && cryptData.LVGUUID != "" {
+		return
+	}
+	if cryptData.LVUUID == "" && (cryptData.PVUUID != "" || cryptData.LVGUUID != "") {
+		log.Println("Not adding volume identifiers, as the plist has some but no LVUUID")
+		return
+	}
+	ids, err := getVolumeIdentifiers(r, cryptData.LVUUID)
+	if err != nil {
+		log.Printf("Could not get volume identifiers: %v", err)
+		return
+	}
+	if cryptData.LVUUID == "" {
+		cryptData.LVUUID = ids.LVUUID
+	}
+	if cryptData.PVUUID == "" {
+		cryptData.PVUUID = ids.PVUUID
+	}
+	if cryptData.LVGUUID == "" {
+		cryptData.LVGUUID = ids.LVGUUID
+	}
+}
@@ -0,0 +1,251 @@
+package checkin
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apfsListOutput is trimmed from `diskutil apfs list -plist` on a Mac with a
+// second, unencrypted container.
+const apfsListOutput = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Containers</key>
+	<array>
+		<dict>
+			<key>APFSContainerUUID</key>
+			<string>11111111-1111-1111-1111-111111111111</string>
+			<key>PhysicalStores</key>
+			<array>
+				<dict>
+					<key>DeviceIdentifier</key>
+					<string>disk2s1</string>
+					<key>DiskUUID</key>
+					<string>22222222-2222-2222-2222-222222222222</string>
+				</dict>
+			</array>
+			<key>Volumes</key>
+			<array>
+				<dict>
+					<key>APFSVolumeUUID</key>
+					<string>33333333-3333-3333-3333-333333333333</string>
+					<key>DeviceIdentifier</key>
+					<string>disk3s1</string>
+					<key>FileVault</key>
+					<false/>
+					<key>Roles</key>
+					<array/>
+				</dict>
+			</array>
+		</dict>
+		<dict>
+			<key>APFSContainerUUID</key>
+			<string>A1B2C3D4-0000-0000-0000-000000000001</string>
+			<key>PhysicalStores</key>
+			<array>
+				<dict>
+					<key>DeviceIdentifier</key>
+					<string>disk0s2</string>
+					<key>DiskUUID</key>
+					<string>A1B2C3D4-0000-0000-0000-000000000002</string>
+				</dict>
+			</array>
+			<key>Volumes</key>
+			<array>
+				<dict>
+					<key>APFSVolumeUUID</key>
+					<string>A1B2C3D4-0000-0000-0000-000000000003</string>
+					<key>DeviceIdentifier</key>
+					<string>disk1s1</string>
+					<key>FileVault</key>
+					<true/>
+					<key>Roles</key>
+					<array>
+						<string>System</string>
+					</array>
+				</dict>
+				<dict>
+					<key>APFSVolumeUUID</key>
+					<string>A1B2C3D4-0000-0000-0000-000000000004</string>
+					<key>DeviceIdentifier</key>
+					<string>disk1s5</string>
+					<key>FileVault</key>
+					<true/>
+					<key>Roles</key>
+					<array>
+						<string>Data</string>
+					</array>
+				</dict>
+			</array>
+		</dict>
+	</array>
+</dict>
+</plist>`
+
+// apfsVolumeGroupsOutput is trimmed from `diskutil apfs listVolumeGroups
+// -plist` on the same Mac. The volume group UUID differs from the container's.
+const apfsVolumeGroupsOutput = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Containers</key>
+	<array>
+		<dict>
+			<key>APFSContainerUUID</key>
+			<string>A1B2C3D4-0000-0000-0000-000000000001</string>
+			<key>VolumeGroups</key>
+			<array>
+				<dict>
+					<key>APFSVolumeGroupUUID</key>
+					<string>A1B2C3D4-0000-0000-0000-000000000005</string>
+					<key>Volumes</key>
+					<array>
+						<dict>
+							<key>APFSVolumeUUID</key>
+							<string>A1B2C3D4-0000-0000-0000-000000000003</string>
+							<key>Role</key>
+							<string>System</string>
+						</dict>
+						<dict>
+							<key>APFSVolumeUUID</key>
+							<string>A1B2C3D4-0000-0000-0000-000000000004</string>
+							<key>Role</key>
+							<string>Data</string>
+						</dict>
+					</array>
+				</dict>
+			</array>
+		</dict>
+	</array>
+</dict>
+</plist>`
+
+// diskutilRunner answers diskutil apfs verbs from a map, and everything else
+// like the embedded MockCmdRunner.
+type diskutilRunner struct {
+	utils.MockCmdRunner
+	verbs map[string]string
+}
+
+func (d diskutilRunner) RunCmd(name string, arg ...string) ([]byte, error) {
+	if name == "/usr/sbin/diskutil" && len(arg) > 1 && arg[0] == "apfs" {
+		if out, ok := d.verbs[arg[1]]; ok {
+			return []byte(out), nil
+		}
+	}
+	return d.MockCmdRunner.RunCmd(name, arg...)
+}
+
+func TestParseAPFSList(t *testing.T) {
+	ids, err := parseAPFSList([]byte(apfsListOutput), "")
+	require.NoError(t, err)
+	assert.Equal(t, volumeIdentifiers{
+		LVUUID: "A1B2C3D4-0000-0000-0000-000000000004",
+		PVUUID: "A1B2C3D4-0000-0000-0000-000000000002",
+	}, ids)
+
+	// a given volume is found in any container, FileVault on or not
+	ids, err = parseAPFSList([]byte(apfsListOutput), "33333333-3333-3333-3333-333333333333")
+	require.NoError(t, err)
+	assert.Equal(t, volumeIdentifiers{
+		LVUUID: "33333333-3333-3333-3333-333333333333",
+		PVUUID: "22222222-2222-2222-2222-222222222222",
+	}, ids)
+
+	_, err = parseAPFSList([]byte(apfsListOutput), "44444444-4444-4444-4444-444444444444")
+	assert.Error(t, err)
+
+	_, err = parseAPFSList([]byte(`<plist version="1.0"><dict><key>Containers</key><array/></dict></plist>`), "")
+	assert.Error(t, err)
+
+	_, err = parseAPFSList([]byte("not a plist"), "")
+	assert.Error(t, err)
+}
+
+func TestParseAPFSVolumeGroups(t *testing.T) {
+	group, err := parseAPFSVolumeGroups([]byte(apfsVolumeGroupsOutput), "A1B2C3D4-0000-0000-0000-000000000004")
+	require.NoError(t, err)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000005", group)
+
+	_, err = parseAPFSVolumeGroups([]byte(apfsVolumeGroupsOutput), "33333333-3333-3333-3333-333333333333")
+	assert.Error(t, err)
+
+	_, err = parseAPFSVolumeGroups([]byte("not a plist"), "A1B2C3D4-0000-0000-0000-000000000004")
+	assert.Error(t, err)
+}
+
+func TestAddVolumeIdentifiers(t *testing.T) {
+	r := utils.Runner{Runner: diskutilRunner{verbs: map[string]string{
+		"list":             apfsListOutput,
+		"listVolumeGroups": apfsVolumeGroupsOutput,
+	}}}
+
+	// nothing written by fdesetup
+	cryptData := CryptData{}
+	addVolumeIdentifiers(&cryptData, r)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000004", cryptData.LVUUID)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000002", cryptData.PVUUID)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000005", cryptData.LVGUUID)
+
+	// the others are looked up for the LVUUID fdesetup wrote, and values it
+	// wrote are kept
+	cryptData = CryptData{LVUUID: "A1B2C3D4-0000-0000-0000-000000000003", LVGUUID: "FDESETUP-LVG"}
+	addVolumeIdentifiers(&cryptData, r)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000003", cryptData.LVUUID)
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000002", cryptData.PVUUID)
+	assert.Equal(t, "FDESETUP-LVG", cryptData.LVGUUID)
+
+	cryptData = CryptData{LVUUID: "33333333-3333-3333-3333-333333333333"}
+	addVolumeIdentifiers(&cryptData, r)
+	assert.Equal(t, "22222222-2222-2222-2222-222222222222", cryptData.PVUUID)
+	assert.Empty(t, cryptData.LVGUUID)
+
+	// an LVUUID diskutil doesn't know leaves the others empty
+	cryptData = CryptData{LVUUID: "44444444-4444-4444-4444-444444444444"}
+	addVolumeIdentifiers(&cryptData, r)
+	assert.Empty(t, cryptData.PVUUID)
+	assert.Empty(t, cryptData.LVGUUID)
+
+	// without an LVUUID, identifiers are not mixed with ones fdesetup wrote
+	cryptData = CryptData{PVUUID: "FDESETUP-PV"}
+	addVolumeIdentifiers(&cryptData, r)
+	assert.Equal(t, CryptData{PVUUID: "FDESETUP-PV"}, cryptData)
+
+	// without volume groups the other identifiers are still filled in
+	cryptData = CryptData{}
+	addVolumeIdentifiers(&cryptData, utils.Runner{Runner: diskutilRunner{
+		MockCmdRunner: utils.MockCmdRunner{Err: errors.New("unknown verb")},
+		verbs:         map[string]string{"list": apfsListOutput},
+	}})
+	assert.Equal(t, "A1B2C3D4-0000-0000-0000-000000000004", cryptData.LVUUID)
+	assert.Empty(t, cryptData.LVGUUID)
+
+	// diskutil failing leaves the fields empty
+	cryptData = CryptData{}
+	addVolumeIdentifiers(&cryptData, utils.Runner{Runner: utils.MockCmdRunner{Output: "true"}})
+	assert.Empty(t, cryptData.LVUUID)
+}
+
+func TestBuildDataVolumeIdentifiers(t *testing.T) {
+	r := utils.Runner{Runner: utils.MockCmdRunner{Output: "test_computer_name"}}
+	data, err := buildData(CryptData{
+		SerialNumber: "test_serial_number",
+		RecoveryKey:  "test_recovery_key",
+		LVUUID:       "lv",
+		PVUUID:       "pv",
+		LVGUUID:      "lvg",
+	}, r)
+	require.NoError(t, err)
+
+	values, err := url.ParseQuery(data)
+	require.NoError(t, err)
+	assert.Equal(t, "lv", values.Get("lv_uuid"))
+	assert.Equal(t, "pv", values.Get("pv_uuid"))
+	assert.Equal(t, "lvg", values.Get("lvg_uuid"))
+}
@@ -0,0 +1,296 @@
+// Package journal records the outcome of every checkin run as JSON lines, so
+// the escrow history of a Mac can be answered without reading the log.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/keyhistory"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPath is where checkin keeps its journal. Only root can read or
+	// write it.
+	DefaultPath = "/var/db/crypt/journal.jsonl"
+	// DefaultMaxSize is the size a journal file may grow to before it is
+	// rotated.
+	DefaultMaxSize = 512 * 1024
+	// DefaultMaxFiles is how many rotated files are kept besides the current
+	// one.
+	DefaultMaxFiles = 2
+)
+
+// Decision is what a checkin run did.
+type Decision string
+
+const (
+	// Escrowed means the recovery key was sent to the server.
+	Escrowed Decision = "escrowed"
+	// Skipped means the key was escrowed recently enough that nothing was sent.
+	Skipped Decision = "skipped"
+	// NoKey means there was no recovery key to escrow.
+	NoKey Decision = "no_key"
+	// Failed means the run stopped with an error.
+	Failed Decision = "failed"
+)
+
+// Rotation is what happened to the recovery key during a run.
+type Rotation string
+
+const (
+	// RotationNone means the key was kept.
+	RotationNone Rotation = ""
+	// RotationServer means the server asked for the key to be rotated and it
+	// was removed.
+	RotationServer Rotation = "server"
+	// RotationInvalidKey means the key failed validation and was removed.
+	RotationInvalidKey Rotation = "invalid_key"
+)
+
+// Entry is one checkin run.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Decision    Decision  `json:"decision"`
+	Destination string    `json:"destination,omitempty"`
+	HTTPStatus  int       `json:"http_status,omitempty"`
+	// DurationMS is how long the run took in milliseconds.
+	DurationMS int64 `json:"duration_ms"`
+	// ErrorClass groups failures, such as "network" or "http", so they can
+	// be counted without parsing Error.
+	ErrorClass  string   `json:"error_class,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Rotation    Rotation `json:"rotation,omitempty"`
+	// PersonalKey and InstitutionalKey are whether FileVault has a personal
+	// and an institutional recovery key, or nil if fdesetup couldn't say.
+	PersonalKey      *bool `json:"personal_key,omitempty"`
+	InstitutionalKey *bool `json:"institutional_key,omitempty"`
+}
+
+// Journal appends entries to a file, rotating it once it reaches MaxSize.
+type Journal struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+// New returns a Journal at path with the default limits.
+func New(path string) *Journal {
+	return &Journal{Path: path, MaxSize: DefaultMaxSize, MaxFiles: DefaultMaxFiles}
+}
+
+// Append adds e to the journal, creating the root-only directory that holds it
+// if needed.
+func (j *Journal) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode journal entry")
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create journal directory")
+	}
+	if err := j.rotate(int64(len(line))); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open journal")
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write journal")
+	}
+	return errors.Wrap(f.Close(), "failed to close journal")
+}
+
+// rotate moves the current file aside if adding size bytes would take it over
+// MaxSize, dropping the oldest rotated file.
+func (j *Journal) rotate(size int64) error {
+	info, err := os.Stat(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to check journal size")
+	}
+	if info.Size()+size <= j.MaxSize {
+		return nil
+	}
+
+	if j.MaxFiles < 1 {
+		return errors.Wrap(os.Remove(j.Path), "failed to truncate journal")
+	}
+	if err := os.Remove(j.rotatedPath(j.MaxFiles)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove oldest journal")
+	}
+	for n := j.MaxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(j.rotatedPath(n), j.rotatedPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate journal")
+		}
+	}
+	return errors.Wrap(os.Rename(j.Path, j.rotatedPath(1)), "failed to rotate journal")
+}
+
+func (j *Journal) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", j.Path, n)
+}
+
+// Entries returns every entry still in the journal, oldest first. Lines that
+// cannot be parsed, such as one cut short by a crash, are skipped.
+func (j *Journal) Entries() ([]Entry, error) {
+	entries := []Entry{}
+	for n := j.MaxFiles; n >= 0; n-- {
+		path := j.Path
+		if n > 0 {
+			path = j.rotatedPath(n)
+		}
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read journal")
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "failed to read journal")
+		}
+	}
+	return entries, nil
+}
+
+// Summary answers when a Mac last escrowed and what has gone wrong since.
+type Summary struct {
+	LastSuccess *Entry `json:"last_success,omitempty"`
+	// FailuresSince is how many runs have failed since LastSuccess.
+	FailuresSince int    `json:"failures_since"`
+	LastFailure   *Entry `json:"last_failure,omitempty"`
+	// PersonalKey and InstitutionalKey are from the latest entry that
+	// recorded them.
+	PersonalKey      *bool `json:"personal_key,omitempty"`
+	InstitutionalKey *bool `json:"institutional_key,omitempty"`
+}
+
+// Summarize returns the Summary of entries, which must be oldest first.
+func Summarize(entries []Entry) Summary {
+	var s Summary
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].PersonalKey != nil {
+			s.PersonalKey = entries[i].PersonalKey
+			s.InstitutionalKey = entries[i].InstitutionalKey
+			break
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Decision == Escrowed {
+			s.LastSuccess = &e
+			break
+		}
+		if e.Decision == Failed {
+			s.FailuresSince++
+			if s.LastFailure == nil {
+				s.LastFailure = &e
+			}
+		}
+	}
+	return s
+}
+
+// PrintTable writes the summary of entries followed by the entries, oldest
+// first, as a table.
+func PrintTable(w io.Writer, entries []Entry) error {
+	s := Summarize(entries)
+	if s.LastSuccess != nil {
+		fmt.Fprintf(w, "Last successful escrow: %s to %s\n", formatTime(s.LastSuccess.Time), s.LastSuccess.Destination)
+	} else {
+		fmt.Fprintln(w, "Last successful escrow: never")
+	}
+	fmt.Fprintf(w, "Failures since: %d\n", s.FailuresSince)
+	if s.LastFailure != nil {
+		fmt.Fprintf(w, "Last failure: %s %s\n", formatTime(s.LastFailure.Time), errorString(*s.LastFailure))
+	}
+	if s.PersonalKey != nil {
+		fmt.Fprintf(w, "Personal recovery key: %s, institutional recovery key: %s\n", yesNo(s.PersonalKey), yesNo(s.InstitutionalKey))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tDECISION\tDESTINATION\tSTATUS\tDURATION\tKEY\tROTATION\tERROR")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			formatTime(e.Time),
+			e.Decision,
+			utils.OrDash(e.Destination),
+			utils.OrDash(statusString(e.HTTPStatus)),
+			(time.Duration(e.DurationMS) * time.Millisecond).String(),
+			utils.OrDash(keyhistory.Short(e.Fingerprint)),
+			utils.OrDash(string(e.Rotation)),
+			utils.OrDash(errorString(e)),
+		)
+	}
+	return tw.Flush()
+}
+
+// PrintJSON writes the summary of entries and the entries as a JSON object.
+func PrintJSON(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Summary
+		Entries []Entry `json:"entries"`
+	}{Summarize(entries), entries})
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+func statusString(status int) string {
+	if status == 0 {
+		return ""
+	}
+	return fmt.Sprint(status)
+}
+
+func errorString(e Entry) string {
+	if e.Error == "" {
+		return ""
+	}
+	// keep the table to one line per entry
+	msg := strings.Join(strings.Fields(e.Error), " ")
+	if e.ErrorClass == "" {
+		return msg
+	}
+	return e.ErrorClass + ": " + msg
+}
+
+func yesNo(b *bool) string {
+	if b == nil {
+		return "unknown"
+	}
+	if *b {
+		return "yes"
+	}
+	return "no"
+}
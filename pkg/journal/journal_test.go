@@ -0,0 +1,149 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAndEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crypt", "journal.jsonl")
+	j := New(path)
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	first := Entry{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Decision: Escrowed, Destination: "https://crypt.example.com/checkin/", HTTPStatus: 200}
+	second := Entry{Time: first.Time.Add(time.Hour), Decision: Skipped}
+	require.NoError(t, j.Append(first))
+	require.NoError(t, j.Append(second))
+
+	entries, err = j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.True(t, first.Time.Equal(entries[0].Time))
+	assert.Equal(t, Escrowed, entries[0].Decision)
+	assert.Equal(t, Skipped, entries[1].Decision)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestEntriesSkipsPartialLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j := New(path)
+	require.NoError(t, j.Append(Entry{Decision: Escrowed}))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":"2024-05-01T12:00:00Z","deci`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	line, err := json.Marshal(Entry{Decision: Failed, Error: "x"})
+	require.NoError(t, err)
+	// room for two entries per file
+	j := &Journal{Path: path, MaxSize: int64(2 * (len(line) + 1)), MaxFiles: 2}
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, j.Append(Entry{Decision: Failed, Error: string(rune('a' + i))}))
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Error)
+	}
+	// two full rotated files and the current one, the oldest were dropped
+	assert.Equal(t, []string{"e", "f", "g", "h", "i"}, got)
+}
+
+func TestSummarize(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, Decision: Failed, ErrorClass: "network"},
+		{Time: start.Add(time.Hour), Decision: Escrowed, Destination: "https://crypt.example.com/checkin/"},
+		{Time: start.Add(2 * time.Hour), Decision: Skipped},
+		{Time: start.Add(3 * time.Hour), Decision: Failed, ErrorClass: "network"},
+		{Time: start.Add(4 * time.Hour), Decision: Failed, ErrorClass: "http", HTTPStatus: 503},
+	}
+
+	s := Summarize(entries)
+	require.NotNil(t, s.LastSuccess)
+	assert.True(t, start.Add(time.Hour).Equal(s.LastSuccess.Time))
+	assert.Equal(t, 2, s.FailuresSince)
+	require.NotNil(t, s.LastFailure)
+	assert.Equal(t, 503, s.LastFailure.HTTPStatus)
+
+	assert.Nil(t, s.PersonalKey)
+
+	yes, no := true, false
+	entries[2].PersonalKey, entries[2].InstitutionalKey = &no, &yes
+	s = Summarize(entries)
+	require.NotNil(t, s.PersonalKey)
+	assert.False(t, *s.PersonalKey)
+	assert.True(t, *s.InstitutionalKey)
+
+	s = Summarize(entries[:1])
+	assert.Nil(t, s.LastSuccess)
+	assert.Equal(t, 1, s.FailuresSince)
+
+	s = Summarize(nil)
+	assert.Nil(t, s.LastSuccess)
+	assert.Zero(t, s.FailuresSince)
+}
+
+func TestPrintTable(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	var buf bytes.Buffer
+	err := PrintTable(&buf, []Entry{
+		{Time: start, Decision: Escrowed, Destination: "https://crypt.example.com/checkin/", HTTPStatus: 200, DurationMS: 1500, Fingerprint: strings.Repeat("a", 64)},
+		{Time: start.Add(time.Hour), Decision: Failed, ErrorClass: "http", HTTPStatus: 503, Error: "server returned\nnon-200 status"},
+	})
+	require.NoError(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, "Last successful escrow: "+start.Format(time.RFC3339)+" to https://crypt.example.com/checkin/")
+	assert.Contains(t, out, "Failures since: 1")
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 7)
+	assert.True(t, strings.HasPrefix(lines[4], "TIME"))
+	assert.Contains(t, lines[5], "1.5s")
+	assert.Contains(t, lines[5], strings.Repeat("a", 16)+" ")
+	assert.Contains(t, lines[6], "http: server returned non-200 status")
+}
+
+func TestPrintJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, PrintJSON(&buf, []Entry{{Decision: Failed, ErrorClass: "network"}}))
+
+	var out struct {
+		FailuresSince int     `json:"failures_since"`
+		Entries       []Entry `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, 1, out.FailuresSince)
+	require.Len(t, out.Entries, 1)
+	assert.Equal(t, "network", out.Entries[0].ErrorClass)
+}
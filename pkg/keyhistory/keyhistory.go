@@ -0,0 +1,245 @@
+// Package keyhistory keeps copies of previous recovery keys in a SecretStore
+// so a key is not lost when it is rotated before its replacement has been
+// escrowed.
+package keyhistory
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// IndexSecret is the name of the secret holding the history metadata.
+	IndexSecret = utils.RecoveryKeySecret + ".history"
+	// FingerprintKeySecret is the name of the secret holding the HMAC key
+	// fingerprints are computed with.
+	FingerprintKeySecret = utils.RecoveryKeySecret + ".fingerprint"
+)
+
+// Entry describes a recovery key in the history. It never contains the key.
+type Entry struct {
+	// Fingerprint is an HMAC-SHA256 of the key, so entries can be matched to
+	// keys without storing anything that can be used to recover the key.
+	Fingerprint  string    `json:"fingerprint"`
+	Created      time.Time `json:"created"`
+	Escrowed     time.Time `json:"escrowed,omitempty"`
+	Destinations []string  `json:"destinations,omitempty"`
+}
+
+// History is the list of recovery keys Crypt has seen, newest last.
+type History struct {
+	secrets utils.SecretStore
+	limit   int
+	now     func() time.Time
+}
+
+// New returns a History stored in secrets that keeps up to limit keys.
+func New(secrets utils.SecretStore, limit int) *History {
+	return &History{secrets: secrets, limit: limit, now: time.Now}
+}
+
+// Entries returns the metadata of every key in the history, oldest first.
+func (h *History) Entries() ([]Entry, error) {
+	index, err := h.secrets.Get(IndexSecret)
+	if errors.Is(err, utils.ErrSecretNotFound) {
+		return []Entry{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read key history")
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal([]byte(index), &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to parse key history")
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// Fingerprint returns the fingerprint of key. The HMAC key is generated and
+// saved the first time it is needed.
+func (h *History) Fingerprint(key string) (string, error) {
+	hmacKey, err := h.secrets.Get(FingerprintKeySecret)
+	if errors.Is(err, utils.ErrSecretNotFound) {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", errors.Wrap(err, "failed to generate fingerprint key")
+		}
+		hmacKey = hex.EncodeToString(b)
+		if err := h.secrets.Set(FingerprintKeySecret, hmacKey); err != nil {
+			return "", errors.Wrap(err, "failed to save fingerprint key")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to read fingerprint key")
+	}
+
+	mac := hmac.New(sha256.New, []byte(hmacKey))
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Add saves a copy of key in the history if it isn't already there and
+// returns its entry.
+func (h *History) Add(key string) (Entry, error) {
+	if key == "" {
+		return Entry{}, errors.New("recovery key is empty")
+	}
+	fingerprint, err := h.Fingerprint(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	entries, err := h.Entries()
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, e := range entries {
+		if e.Fingerprint == fingerprint {
+			return e, nil
+		}
+	}
+
+	if err := h.secrets.Set(keySecret(fingerprint), key); err != nil {
+		return Entry{}, errors.Wrap(err, "failed to save recovery key to history")
+	}
+	entry := Entry{Fingerprint: fingerprint, Created: h.now()}
+	if err := h.save(append(entries, entry)); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// Key returns the recovery key with the given fingerprint.
+func (h *History) Key(fingerprint string) (string, error) {
+	key, err := h.secrets.Get(keySecret(fingerprint))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read key %s from history", Short(fingerprint))
+	}
+	return key, nil
+}
+
+// MarkEscrowed records that key was escrowed to destination, adding it to the
+// history first if needed. Now that a key is known to be escrowed, keys older
+// than it are pruned until no more than the limit remain.
+func (h *History) MarkEscrowed(key string, destination string) error {
+	entry, err := h.Add(key)
+	if err != nil {
+		return err
+	}
+	entries, err := h.Entries()
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		if entries[i].Fingerprint != entry.Fingerprint {
+			continue
+		}
+		entries[i].Escrowed = h.now()
+		if !utils.StringInSlice(destination, entries[i].Destinations) {
+			entries[i].Destinations = append(entries[i].Destinations, destination)
+		}
+	}
+
+	entries, err = h.prune(entries)
+	if err != nil {
+		return err
+	}
+	return h.save(entries)
+}
+
+// Purge removes every key in the history, the history itself and the
+// fingerprint key, for when recovery keys are no longer kept in secrets.
+func (h *History) Purge() error {
+	entries, err := h.Entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := h.secrets.Delete(keySecret(e.Fingerprint)); err != nil && !errors.Is(err, utils.ErrSecretNotFound) {
+			return errors.Wrapf(err, "failed to remove key %s from history", e.Short())
+		}
+	}
+	for _, name := range []string{IndexSecret, FingerprintKeySecret} {
+		if err := h.secrets.Delete(name); err != nil && !errors.Is(err, utils.ErrSecretNotFound) {
+			return errors.Wrapf(err, "failed to remove %s", name)
+		}
+	}
+	return nil
+}
+
+// prune removes the oldest entries over the limit, but only those created
+// before the newest escrowed key, so the only copy of a key that hasn't
+// been escrowed is never removed.
+func (h *History) prune(entries []Entry) ([]Entry, error) {
+	newestEscrowed := -1
+	for i, e := range entries {
+		if !e.Escrowed.IsZero() {
+			newestEscrowed = i
+		}
+	}
+
+	removable := newestEscrowed
+	for len(entries) > h.limit && removable > 0 {
+		if err := h.secrets.Delete(keySecret(entries[0].Fingerprint)); err != nil && !errors.Is(err, utils.ErrSecretNotFound) {
+			return nil, errors.Wrapf(err, "failed to remove key %s from history", Short(entries[0].Fingerprint))
+		}
+		entries = entries[1:]
+		removable--
+	}
+	return entries, nil
+}
+
+func (h *History) save(entries []Entry) error {
+	index, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode key history")
+	}
+	if err := h.secrets.Set(IndexSecret, string(index)); err != nil {
+		return errors.Wrap(err, "failed to save key history")
+	}
+	return nil
+}
+
+func keySecret(fingerprint string) string {
+	return IndexSecret + "." + Short(fingerprint)
+}
+
+// Short returns the abbreviated fingerprint used in names and output.
+func Short(fingerprint string) string {
+	if len(fingerprint) > 16 {
+		return fingerprint[:16]
+	}
+	return fingerprint
+}
+
+// Short returns the abbreviated form of e's fingerprint.
+func (e Entry) Short() string {
+	return Short(e.Fingerprint)
+}
+
+// PrintEntries writes entries to w as a table, oldest first.
+func PrintEntries(w io.Writer, entries []Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FINGERPRINT\tCREATED\tESCROWED\tDESTINATIONS")
+	for _, e := range entries {
+		escrowed := "never"
+		if !e.Escrowed.IsZero() {
+			escrowed = e.Escrowed.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Short(), e.Created.Local().Format(time.RFC3339), escrowed, utils.OrDash(strings.Join(e.Destinations, ", ")))
+	}
+	return tw.Flush()
+}
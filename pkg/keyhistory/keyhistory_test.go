@@ -0,0 +1,183 @@
+package keyhistory
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHistory(limit int) (*History, *utils.MemorySecretStore) {
+	secrets := utils.NewMemorySecretStore()
+	h := New(secrets, limit)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	return h, secrets
+}
+
+func TestFingerprint(t *testing.T) {
+	h, _ := newTestHistory(3)
+
+	a, err := h.Fingerprint("AAAA-AAAA")
+	require.NoError(t, err)
+	again, err := h.Fingerprint("AAAA-AAAA")
+	require.NoError(t, err)
+	b, err := h.Fingerprint("BBBB-BBBB")
+	require.NoError(t, err)
+
+	assert.Len(t, a, 64)
+	assert.Equal(t, a, again)
+	assert.NotEqual(t, a, b)
+
+	// a different HMAC key gives a different fingerprint
+	other, _ := newTestHistory(3)
+	otherA, err := other.Fingerprint("AAAA-AAAA")
+	require.NoError(t, err)
+	assert.NotEqual(t, a, otherA)
+}
+
+func TestAdd(t *testing.T) {
+	h, secrets := newTestHistory(3)
+
+	entry, err := h.Add("AAAA-AAAA")
+	require.NoError(t, err)
+	again, err := h.Add("AAAA-AAAA")
+	require.NoError(t, err)
+	assert.Equal(t, entry, again)
+
+	entries, err := h.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].Escrowed.IsZero())
+
+	key, err := h.Key(entry.Fingerprint)
+	require.NoError(t, err)
+	assert.Equal(t, "AAAA-AAAA", key)
+
+	// the index holds metadata only
+	index, err := secrets.Get(IndexSecret)
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(index, "AAAA-AAAA"))
+
+	_, err = h.Add("")
+	assert.Error(t, err)
+}
+
+func TestMarkEscrowed(t *testing.T) {
+	h, _ := newTestHistory(3)
+
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", "https://crypt.example.com/checkin/"))
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", "https://crypt.example.com/checkin/"))
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", "https://backup.example.com/checkin/"))
+
+	entries, err := h.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.False(t, entries[0].Escrowed.IsZero())
+	assert.Equal(t, []string{"https://crypt.example.com/checkin/", "https://backup.example.com/checkin/"}, entries[0].Destinations)
+}
+
+func TestPruneWaitsForEscrow(t *testing.T) {
+	h, _ := newTestHistory(2)
+	server := "https://crypt.example.com/checkin/"
+
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", server))
+	// keys rotated out but never escrowed
+	for _, key := range []string{"BBBB-BBBB", "CCCC-CCCC", "DDDD-DDDD"} {
+		_, err := h.Add(key)
+		require.NoError(t, err)
+	}
+
+	// nothing newer than the escrowed key has been escrowed, so nothing goes
+	entries, err := h.Entries()
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	// once the newest key is escrowed everything older is over the limit
+	require.NoError(t, h.MarkEscrowed("DDDD-DDDD", server))
+	entries, err = h.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	var keys []string
+	for _, e := range entries {
+		key, err := h.Key(e.Fingerprint)
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"CCCC-CCCC", "DDDD-DDDD"}, keys)
+
+	_, err = h.Key(mustFingerprint(t, h, "AAAA-AAAA"))
+	assert.ErrorIs(t, err, utils.ErrSecretNotFound)
+}
+
+func TestPruneKeepsUnescrowedNewerKeys(t *testing.T) {
+	h, _ := newTestHistory(1)
+	server := "https://crypt.example.com/checkin/"
+
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", server))
+	_, err := h.Add("BBBB-BBBB")
+	require.NoError(t, err)
+	// escrowing the older key again must not remove the newer one
+	require.NoError(t, h.MarkEscrowed("AAAA-AAAA", server))
+
+	entries, err := h.Entries()
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func mustFingerprint(t *testing.T, h *History, key string) string {
+	t.Helper()
+	fingerprint, err := h.Fingerprint(key)
+	require.NoError(t, err)
+	return fingerprint
+}
+
+func TestPurge(t *testing.T) {
+	h, secrets := newTestHistory(3)
+	a, err := h.Add("AAAA-AAAA")
+	require.NoError(t, err)
+	require.NoError(t, h.MarkEscrowed("BBBB-BBBB", "crypt"))
+	require.NoError(t, secrets.Set(utils.RecoveryKeySecret, "BBBB-BBBB"))
+
+	require.NoError(t, h.Purge())
+	for _, name := range []string{keySecret(a.Fingerprint), IndexSecret, FingerprintKeySecret} {
+		_, err := secrets.Get(name)
+		assert.ErrorIs(t, err, utils.ErrSecretNotFound, name)
+	}
+	entries, err := h.Entries()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	// the current key is left alone
+	key, err := secrets.Get(utils.RecoveryKeySecret)
+	require.NoError(t, err)
+	assert.Equal(t, "BBBB-BBBB", key)
+
+	// purging an empty history does nothing
+	assert.NoError(t, h.Purge())
+}
+
+func TestPrintEntries(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	var buf bytes.Buffer
+	err := PrintEntries(&buf, []Entry{
+		{Fingerprint: strings.Repeat("a", 64), Created: created, Escrowed: created.Add(time.Minute), Destinations: []string{"https://crypt.example.com/checkin/"}},
+		{Fingerprint: strings.Repeat("b", 64), Created: created.Add(time.Hour)},
+	})
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "FINGERPRINT"))
+	assert.Contains(t, lines[1], strings.Repeat("a", 16)+" ")
+	assert.NotContains(t, lines[1], strings.Repeat("a", 17))
+	assert.Contains(t, lines[1], "https://crypt.example.com/checkin/")
+	assert.Contains(t, lines[2], "never")
+}
@@ -0,0 +1,268 @@
+package pref
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Values of MissingPersonalKeyAction.
+const (
+	// MissingPersonalKeyWarn logs a warning and carries on.
+	MissingPersonalKeyWarn = "warn"
+	// MissingPersonalKeyFail stops the run with an error.
+	MissingPersonalKeyFail = "fail"
+)
+
+// Values of AuthMechsPlacement.
+const (
+	PlacementBefore = "before"
+	PlacementAfter  = "after"
+)
+
+// Config is a snapshot of the preferences Crypt needs for a single run. It is
+// loaded and validated once at startup so every part of the run sees the same
+// values and the preference domain is only consulted once per key.
+type Config struct {
+	ServerURL                  string
+	RemovePlist                bool
+	RotateUsedKey              bool
+	OutputPath                 string
+	ValidateKey                bool
+	KeyEscrowInterval          int
+	AdditionalCurlOpts         []string
+	ManageAuthMechs            bool
+	StoreRecoveryKeyInKeychain bool
+	EncryptRecoveryKeyPlist    bool
+	MissingPersonalKeyAction   string
+	CommonNameForEscrow        string
+	SkipUsers                  []string
+	PostRunCommand             string
+	KeyHistoryLimit            int
+	AuthMechsInsert            []string
+	AuthMechsAnchor            string
+	AuthMechsPlacement         string
+	AuthMechsOffset            int
+	AuthMechsPurge             []string
+	AuthMechsAfter             []string
+	AuthMechsBefore            []string
+	AuthMechsDriftThreshold    int
+	AuthMechsDriftWindow       int
+}
+
+// Load reads every preference Crypt uses from p and returns a validated Config.
+func Load(p PrefInterface) (Config, error) {
+	var cfg Config
+	if err := loadEscrow(p, &cfg); err != nil {
+		return Config{}, err
+	}
+	if err := loadAuthMechs(p, &cfg); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, errors.Wrap(err, "invalid configuration")
+	}
+
+	return cfg, nil
+}
+
+// LoadAuthMechs reads only the AuthMechs preferences from p and returns a
+// Config holding them, validated. It is for the modes that only touch the
+// AuthDB, so a bad escrow setting can't stop the mechanisms being removed or
+// restored.
+func LoadAuthMechs(p PrefInterface) (Config, error) {
+	var cfg Config
+	if err := loadAuthMechs(p, &cfg); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.validateAuthMechs(); err != nil {
+		return Config{}, errors.Wrap(err, "invalid configuration")
+	}
+
+	return cfg, nil
+}
+
+// loadEscrow reads the preferences used to store and escrow the key into cfg.
+func loadEscrow(p PrefInterface, cfg *Config) error {
+	var err error
+
+	if cfg.ServerURL, err = p.GetString("ServerURL"); err != nil {
+		return err
+	}
+	if cfg.RemovePlist, err = p.GetBool("RemovePlist"); err != nil {
+		return err
+	}
+	if cfg.RotateUsedKey, err = p.GetBool("RotateUsedKey"); err != nil {
+		return err
+	}
+	if cfg.OutputPath, err = p.GetString("OutputPath"); err != nil {
+		return err
+	}
+	if cfg.ValidateKey, err = p.GetBool("ValidateKey"); err != nil {
+		return err
+	}
+	if cfg.KeyEscrowInterval, err = p.GetInt("KeyEscrowInterval"); err != nil {
+		return err
+	}
+	if cfg.AdditionalCurlOpts, err = p.GetArray("AdditionalCurlOpts"); err != nil {
+		return err
+	}
+	if cfg.ManageAuthMechs, err = p.GetBool("ManageAuthMechs"); err != nil {
+		return err
+	}
+	if cfg.StoreRecoveryKeyInKeychain, err = p.GetBool("StoreRecoveryKeyInKeychain"); err != nil {
+		return err
+	}
+	if cfg.EncryptRecoveryKeyPlist, err = p.GetBool("EncryptRecoveryKeyPlist"); err != nil {
+		return err
+	}
+	if cfg.MissingPersonalKeyAction, err = p.GetString("MissingPersonalKeyAction"); err != nil {
+		return err
+	}
+	if cfg.CommonNameForEscrow, err = p.GetString("CommonNameForEscrow"); err != nil {
+		return err
+	}
+	if cfg.SkipUsers, err = p.GetArray("SkipUsers"); err != nil {
+		return err
+	}
+
+	if cfg.KeyHistoryLimit, err = p.GetInt("KeyHistoryLimit"); err != nil {
+		return err
+	}
+
+	postRunCommand, err := p.Get("PostRunCommand")
+	if err != nil {
+		return errors.Wrap(err, "failed to get preference PostRunCommand")
+	}
+	if cfg.PostRunCommand, err = commandString(postRunCommand); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadAuthMechs reads the preferences describing Crypt's mechanisms into cfg.
+func loadAuthMechs(p PrefInterface, cfg *Config) error {
+	var err error
+
+	if cfg.AuthMechsInsert, err = p.GetArray("AuthMechsInsert"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsAnchor, err = p.GetString("AuthMechsAnchor"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsPlacement, err = p.GetString("AuthMechsPlacement"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsOffset, err = p.GetInt("AuthMechsOffset"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsPurge, err = p.GetArray("AuthMechsPurge"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsAfter, err = p.GetArray("AuthMechsAfter"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsBefore, err = p.GetArray("AuthMechsBefore"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsDriftThreshold, err = p.GetInt("AuthMechsDriftThreshold"); err != nil {
+		return err
+	}
+	if cfg.AuthMechsDriftWindow, err = p.GetInt("AuthMechsDriftWindow"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate checks that the values in the Config can be acted on.
+func (c Config) Validate() error {
+	if err := c.validateEscrow(); err != nil {
+		return err
+	}
+	return c.validateAuthMechs()
+}
+
+// validateEscrow checks the preferences used to store and escrow the key.
+func (c Config) validateEscrow() error {
+	if c.ServerURL != "" {
+		u, err := url.Parse(c.ServerURL)
+		if err != nil {
+			return errors.Wrap(err, "ServerURL is not a valid URL")
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("ServerURL must use http or https, got %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return errors.New("ServerURL has no host")
+		}
+	}
+
+	if c.OutputPath == "" {
+		return errors.New("OutputPath cannot be empty")
+	}
+	if !filepath.IsAbs(c.OutputPath) {
+		return fmt.Errorf("OutputPath must be an absolute path, got %q", c.OutputPath)
+	}
+
+	if c.KeyEscrowInterval < 0 {
+		return fmt.Errorf("KeyEscrowInterval cannot be negative, got %d", c.KeyEscrowInterval)
+	}
+
+	switch c.MissingPersonalKeyAction {
+	case "", MissingPersonalKeyWarn, MissingPersonalKeyFail:
+	default:
+		return fmt.Errorf("MissingPersonalKeyAction must be %q or %q, got %q", MissingPersonalKeyWarn, MissingPersonalKeyFail, c.MissingPersonalKeyAction)
+	}
+
+	if c.KeyHistoryLimit < 1 {
+		return fmt.Errorf("KeyHistoryLimit must be at least 1, got %d", c.KeyHistoryLimit)
+	}
+
+	return nil
+}
+
+// validateAuthMechs checks the preferences describing Crypt's mechanisms.
+func (c Config) validateAuthMechs() error {
+	switch c.AuthMechsPlacement {
+	case "", PlacementBefore, PlacementAfter:
+	default:
+		return fmt.Errorf("AuthMechsPlacement must be %q or %q, got %q", PlacementBefore, PlacementAfter, c.AuthMechsPlacement)
+	}
+
+	for _, pattern := range append(append([]string{}, c.AuthMechsAfter...), c.AuthMechsBefore...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid mechanism pattern %q: %v", pattern, err)
+		}
+	}
+
+	if c.AuthMechsDriftThreshold < 0 {
+		return fmt.Errorf("AuthMechsDriftThreshold cannot be negative, got %d", c.AuthMechsDriftThreshold)
+	}
+	if c.AuthMechsDriftThreshold > 0 && c.AuthMechsDriftWindow < 1 {
+		return fmt.Errorf("AuthMechsDriftWindow must be at least 1 hour, got %d", c.AuthMechsDriftWindow)
+	}
+
+	return nil
+}
+
+// commandString converts the PostRunCommand preference, which may be either a
+// string or an array of strings, into a single command string.
+func commandString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []string:
+		return strings.Join(v, " "), nil
+	case nil:
+		return "", nil
+	default:
+		return "", errors.New("PostRunCommand is neither a string nor an array of strings")
+	}
+}
@@ -0,0 +1,159 @@
+package pref_test
+
+import (
+	"testing"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	p := preftest.New()
+
+	cfg, err := pref.Load(p)
+	assert.NoError(t, err)
+	assert.Equal(t, pref.Config{
+		RemovePlist:                true,
+		RotateUsedKey:              true,
+		OutputPath:                 "/private/var/root/crypt_output.plist",
+		ValidateKey:                true,
+		KeyEscrowInterval:          1,
+		AdditionalCurlOpts:         []string{},
+		ManageAuthMechs:            true,
+		StoreRecoveryKeyInKeychain: true,
+		MissingPersonalKeyAction:   "warn",
+		SkipUsers:                  []string{},
+		KeyHistoryLimit:            3,
+		AuthMechsInsert:            []string{"Crypt:Check,privileged"},
+		AuthMechsAnchor:            "loginwindow:done",
+		AuthMechsPlacement:         "before",
+		AuthMechsPurge:             []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+		AuthMechsAfter:             []string{},
+		AuthMechsBefore:            []string{},
+		AuthMechsDriftThreshold:    3,
+		AuthMechsDriftWindow:       24,
+	}, cfg)
+}
+
+func TestLoadReadsEachPreferenceOnce(t *testing.T) {
+	p := preftest.New(
+		preftest.WithServer("https://crypt.example.com"),
+		preftest.WithValue("SkipUsers", []string{"admin"}),
+		preftest.WithValue("PostRunCommand", []string{"/usr/local/bin/notify", "--logout"}),
+	)
+
+	cfg, err := pref.Load(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://crypt.example.com", cfg.ServerURL)
+	assert.Equal(t, []string{"admin"}, cfg.SkipUsers)
+	assert.Equal(t, "/usr/local/bin/notify --logout", cfg.PostRunCommand)
+
+	reads := map[string]int{}
+	for _, c := range p.Calls() {
+		reads[c.Name]++
+	}
+	assert.Len(t, reads, 24)
+	for name, count := range reads {
+		assert.Equal(t, 1, count, name)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	p := preftest.New(preftest.WithValue("KeyEscrowInterval", -1))
+
+	_, err := pref.Load(p)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "KeyEscrowInterval")
+}
+
+func TestLoadAuthMechs(t *testing.T) {
+	// escrow settings are neither read nor validated
+	p := preftest.New(
+		preftest.WithValue("KeyEscrowInterval", -1),
+		preftest.WithValue("OutputPath", "crypt_output.plist"),
+		preftest.WithValue("AuthMechsPlacement", "after"),
+	)
+	cfg, err := pref.LoadAuthMechs(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "after", cfg.AuthMechsPlacement)
+	assert.Equal(t, []string{"Crypt:Check,privileged"}, cfg.AuthMechsInsert)
+	assert.Empty(t, cfg.OutputPath)
+
+	_, err = pref.LoadAuthMechs(preftest.New(preftest.WithValue("AuthMechsPlacement", "instead")))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "AuthMechsPlacement")
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := pref.Config{ServerURL: "https://crypt.example.com", OutputPath: "/var/root/crypt_output.plist", KeyHistoryLimit: 3}
+
+	tests := []struct {
+		name    string
+		mutate  func(c *pref.Config)
+		wantErr bool
+	}{
+		{name: "valid", mutate: func(c *pref.Config) {}},
+		{name: "empty server URL", mutate: func(c *pref.Config) { c.ServerURL = "" }},
+		{name: "server URL without scheme", mutate: func(c *pref.Config) { c.ServerURL = "crypt.example.com" }, wantErr: true},
+		{name: "server URL with unsupported scheme", mutate: func(c *pref.Config) { c.ServerURL = "ftp://crypt.example.com" }, wantErr: true},
+		{name: "empty output path", mutate: func(c *pref.Config) { c.OutputPath = "" }, wantErr: true},
+		{name: "relative output path", mutate: func(c *pref.Config) { c.OutputPath = "crypt_output.plist" }, wantErr: true},
+		{name: "negative interval", mutate: func(c *pref.Config) { c.KeyEscrowInterval = -1 }, wantErr: true},
+		{name: "no key history", mutate: func(c *pref.Config) { c.KeyHistoryLimit = 0 }, wantErr: true},
+		{name: "fail on missing personal key", mutate: func(c *pref.Config) { c.MissingPersonalKeyAction = "fail" }},
+		{name: "mechanisms after anchor", mutate: func(c *pref.Config) { c.AuthMechsPlacement = "after" }},
+		{name: "unknown mechanism placement", mutate: func(c *pref.Config) { c.AuthMechsPlacement = "instead" }, wantErr: true},
+		{name: "mechanism patterns", mutate: func(c *pref.Config) { c.AuthMechsAfter = []string{"JamfConnectLogin:*"} }},
+		{name: "bad mechanism pattern", mutate: func(c *pref.Config) { c.AuthMechsBefore = []string{"XCreds:[login"} }, wantErr: true},
+		{name: "drift never fails", mutate: func(c *pref.Config) { c.AuthMechsDriftThreshold = 0 }},
+		{name: "drift threshold", mutate: func(c *pref.Config) { c.AuthMechsDriftThreshold = 3; c.AuthMechsDriftWindow = 24 }},
+		{name: "negative drift threshold", mutate: func(c *pref.Config) { c.AuthMechsDriftThreshold = -1 }, wantErr: true},
+		{name: "drift threshold without window", mutate: func(c *pref.Config) { c.AuthMechsDriftThreshold = 3 }, wantErr: true},
+		{name: "unknown missing personal key action", mutate: func(c *pref.Config) { c.MissingPersonalKeyAction = "ignore" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.mutate(&c)
+			err := c.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLoadPostRunCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{name: "string", value: "/usr/local/bin/logout", want: "/usr/local/bin/logout"},
+		{name: "array", value: []string{"test", "command"}, want: "test command"},
+		{name: "unset", value: nil, want: ""},
+		{name: "wrong type", value: 5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []preftest.Option
+			if tt.value != nil {
+				opts = append(opts, preftest.WithValue("PostRunCommand", tt.value))
+			}
+
+			cfg, err := pref.Load(preftest.New(opts...))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.PostRunCommand)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package pref
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the property list type a preference is stored as.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindBool
+	KindInt
+	KindArray
+	KindDate
+	// KindCommand is either a string or an array of strings that is joined
+	// with spaces, like PostRunCommand.
+	KindCommand
+)
+
+// String returns the name of the kind as used in log messages and usage text.
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindBool:
+		return "bool"
+	case KindInt:
+		return "int"
+	case KindArray:
+		return "array"
+	case KindDate:
+		return "date"
+	case KindCommand:
+		return "command"
+	default:
+		return "unknown"
+	}
+}
+
+// Definition describes a preference Crypt knows about.
+type Definition struct {
+	Name string
+	Kind Kind
+	// Default is the value of the preference when it is unset. A nil Default
+	// means there is no default.
+	Default interface{}
+	// SaveDefault writes Default to the preference domain the first time the
+	// preference is read and found to be unset. Only preferences that have
+	// always done so set it: a saved default hides any later change to it.
+	SaveDefault bool
+	// Description is a one line summary used in usage text.
+	Description string
+	// Internal preferences are written by Crypt itself rather than by an
+	// admin, so they are left out of generated profiles.
+	Internal bool
+}
+
+var definitions = []Definition{
+	{Name: "ServerURL", Kind: KindString,
+		Description: "URL of the Crypt Server to escrow keys to"},
+	{Name: "RemovePlist", Kind: KindBool, Default: true, SaveDefault: true,
+		Description: "remove the recovery key plist once it has been escrowed"},
+	{Name: "RotateUsedKey", Kind: KindBool, Default: true, SaveDefault: true,
+		Description: "rotate the recovery key once it has been used"},
+	{Name: "OutputPath", Kind: KindString, Default: "/private/var/root/crypt_output.plist", SaveDefault: true,
+		Description: "path the recovery key plist is written to"},
+	{Name: "ValidateKey", Kind: KindBool, Default: true, SaveDefault: true,
+		Description: "validate the recovery key stored on disk"},
+	{Name: "KeyEscrowInterval", Kind: KindInt, Default: 1, SaveDefault: true,
+		Description: "hours between escrows of the same key"},
+	{Name: "AdditionalCurlOpts", Kind: KindArray, Default: []string{}, SaveDefault: true,
+		Description: "additional options passed to curl when escrowing"},
+	{Name: "ManageAuthMechs", Kind: KindBool, Default: true, SaveDefault: true,
+		Description: "ensure the AuthDB mechanisms are set up"},
+	{Name: "StoreRecoveryKeyInKeychain", Kind: KindBool, Default: true, SaveDefault: true,
+		Description: "store the recovery key in the keychain rather than a plist"},
+	{Name: "EncryptRecoveryKeyPlist", Kind: KindBool,
+		Description: "encrypt the recovery key in the plist when not using the keychain"},
+	{Name: "MissingPersonalKeyAction", Kind: KindString, Default: "warn",
+		Description: "warn or fail when only an institutional recovery key is present"},
+	{Name: "CommonNameForEscrow", Kind: KindString, Default: "", SaveDefault: true,
+		Description: "issuer common name of the keychain certificate used for mTLS"},
+	{Name: "SkipUsers", Kind: KindArray,
+		Description: "users that are not forced to enable FileVault"},
+	{Name: "PostRunCommand", Kind: KindCommand,
+		Description: "command run when the user needs to log in again"},
+	{Name: "KeyHistoryLimit", Kind: KindInt, Default: 3,
+		Description: "number of recovery keys kept in the key history"},
+	{Name: "AuthMechsInsert", Kind: KindArray, Default: []string{"Crypt:Check,privileged"},
+		Description: "mechanisms Crypt adds to system.login.console, in order"},
+	{Name: "AuthMechsAnchor", Kind: KindString, Default: "loginwindow:done",
+		Description: "mechanism the AuthMechsInsert mechanisms are placed next to"},
+	{Name: "AuthMechsPlacement", Kind: KindString, Default: "before",
+		Description: "place the mechanisms before or after AuthMechsAnchor"},
+	{Name: "AuthMechsOffset", Kind: KindInt,
+		Description: "mechanisms to move the insertion point by from AuthMechsPlacement"},
+	{Name: "AuthMechsPurge", Kind: KindArray, Default: []string{"Crypt:Check,privileged", "Crypt:CryptGUI", "Crypt:Enablement,privileged"},
+		Description: "mechanisms removed from system.login.console before placing AuthMechsInsert"},
+	{Name: "AuthMechsAfter", Kind: KindArray,
+		Description: "patterns of mechanisms Crypt's mechanisms must come after, such as JamfConnectLogin:*"},
+	{Name: "AuthMechsBefore", Kind: KindArray,
+		Description: "patterns of mechanisms Crypt's mechanisms must come before"},
+	{Name: "AuthMechsDriftThreshold", Kind: KindInt, Default: 3,
+		Description: "times the mechanisms can be found removed within AuthMechsDriftWindow before checkin fails, or 0 to never fail"},
+	{Name: "AuthMechsDriftWindow", Kind: KindInt, Default: 24,
+		Description: "hours over which AuthMechsDriftThreshold is counted"},
+	{Name: "AppsAllowedToChangeKey", Kind: KindArray,
+		Description: "applications allowed to change the recovery key ACLs in the keychain"},
+	{Name: "AppsAllowedToReadKey", Kind: KindArray,
+		Description: "applications allowed to read the recovery key from the keychain"},
+	{Name: "InvisibleInKeychain", Kind: KindBool,
+		Description: "hide the recovery key in Keychain Access"},
+	{Name: "KeychainUIPromptDescription", Kind: KindString,
+		Description: "description shown when an application asks for the recovery key"},
+	{Name: "GenerateNewKey", Kind: KindBool,
+		Description: "generate a new recovery key at the next login"},
+	{Name: "LastEscrow", Kind: KindDate, Internal: true,
+		Description: "date set by the authorization plugin when it generates a key"},
+}
+
+// Definitions returns every preference Crypt knows about.
+func Definitions() []Definition {
+	defs := make([]Definition, len(definitions))
+	copy(defs, definitions)
+	return defs
+}
+
+// Lookup returns the definition for the named preference. Names are matched
+// case-insensitively so CRYPT_SERVERURL finds ServerURL.
+func Lookup(name string) (Definition, bool) {
+	for _, d := range definitions {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return Definition{}, false
+}
+
+// Parse converts a string given on the command line or in the environment
+// into a value of the preference's kind. Arrays are comma separated, or a JSON
+// array for items that contain commas such as Crypt:Check,privileged. Dates
+// are RFC 3339.
+func (d Definition) Parse(raw string) (interface{}, error) {
+	switch d.Kind {
+	case KindString, KindCommand:
+		return raw, nil
+	case KindBool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a bool, got %q", d.Name, raw)
+		}
+		return b, nil
+	case KindInt:
+		i, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an int, got %q", d.Name, raw)
+		}
+		return i, nil
+	case KindArray:
+		array := []string{}
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" {
+			return array, nil
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			if err := json.Unmarshal([]byte(trimmed), &array); err != nil {
+				return nil, fmt.Errorf("%s must be a JSON array of strings, got %q", d.Name, raw)
+			}
+			return array, nil
+		}
+		for _, item := range strings.Split(raw, ",") {
+			array = append(array, strings.TrimSpace(item))
+		}
+		return array, nil
+	case KindDate:
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 date, got %q", d.Name, raw)
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unsupported preference type for %s", d.Name)
+	}
+}
+
+// defaultValues builds the map of preference defaults from definitions.
+func defaultValues() map[string]Definition {
+	defaults := map[string]Definition{}
+	for _, d := range definitions {
+		if d.Default != nil {
+			defaults[d.Name] = d
+		}
+	}
+	return defaults
+}
@@ -0,0 +1,187 @@
+package pref
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EnvPrefix is the prefix of environment variables that override preferences,
+// e.g. CRYPT_SERVERURL or CRYPT_KEY_ESCROW_INTERVAL.
+const EnvPrefix = "CRYPT_"
+
+// Override is a preference value supplied for a single run. Overrides take
+// precedence over managed and local preferences and are never written back
+// to the preference domain.
+type Override struct {
+	Name   string
+	Value  interface{}
+	Source string
+}
+
+// ParseOverride parses a Key=Value pair into an Override for a known preference.
+func ParseOverride(pair string, source string) (Override, error) {
+	key, raw, ok := strings.Cut(pair, "=")
+	if !ok {
+		return Override{}, fmt.Errorf("override %q is not in Key=Value form", pair)
+	}
+
+	def, ok := Lookup(strings.TrimSpace(key))
+	if !ok {
+		return Override{}, fmt.Errorf("unknown preference %q", key)
+	}
+
+	value, err := def.Parse(raw)
+	if err != nil {
+		return Override{}, err
+	}
+
+	return Override{Name: def.Name, Value: value, Source: source}, nil
+}
+
+// OverridesFromEnv returns an Override for every CRYPT_ variable in environ,
+// which is in the form returned by os.Environ. Underscores in the variable
+// name are ignored when matching it to a preference.
+func OverridesFromEnv(environ []string) ([]Override, error) {
+	var overrides []Override
+	for _, kv := range environ {
+		name, raw, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+
+		prefName := strings.ReplaceAll(strings.TrimPrefix(name, EnvPrefix), "_", "")
+		if _, known := Lookup(prefName); !known {
+			log.Printf("Ignoring %s, it does not match a known preference", name)
+			continue
+		}
+
+		override, err := ParseOverride(prefName+"="+raw, "environment variable "+name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+		overrides = append(overrides, override)
+	}
+
+	return overrides, nil
+}
+
+// OverrideFlag collects repeated -set Key=Value command line flags.
+type OverrideFlag []Override
+
+// String implements flag.Value.
+func (f *OverrideFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for _, o := range *f {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", o.Name, o.Value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Set implements flag.Value.
+func (f *OverrideFlag) Set(pair string) error {
+	override, err := ParseOverride(pair, "-set flag")
+	if err != nil {
+		return err
+	}
+	*f = append(*f, override)
+	return nil
+}
+
+type overridePref struct {
+	PrefInterface
+	values map[string]interface{}
+}
+
+// WithOverrides returns a PrefInterface that answers from overrides before
+// falling back to p. Later overrides win over earlier ones, so flags should be
+// passed after environment variables. Each override is logged once.
+func WithOverrides(p PrefInterface, overrides []Override) PrefInterface {
+	if len(overrides) == 0 {
+		return p
+	}
+
+	values := map[string]interface{}{}
+	for _, o := range overrides {
+		log.Printf("Overriding preference %s with %v from %s for this run only", o.Name, o.Value, o.Source)
+		values[o.Name] = o.Value
+	}
+
+	return &overridePref{PrefInterface: p, values: values}
+}
+
+// Get returns the override for prefName if there is one.
+func (o *overridePref) Get(prefName string) (interface{}, error) {
+	if v, ok := o.values[prefName]; ok {
+		return v, nil
+	}
+	return o.PrefInterface.Get(prefName)
+}
+
+// GetString returns the override for prefName as a string if there is one.
+func (o *overridePref) GetString(prefName string) (string, error) {
+	v, ok := o.values[prefName]
+	if !ok {
+		return o.PrefInterface.GetString(prefName)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("override for %s is not a string", prefName)
+	}
+	return s, nil
+}
+
+// GetBool returns the override for prefName as a bool if there is one.
+func (o *overridePref) GetBool(prefName string) (bool, error) {
+	v, ok := o.values[prefName]
+	if !ok {
+		return o.PrefInterface.GetBool(prefName)
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("override for %s is not a bool", prefName)
+	}
+	return b, nil
+}
+
+// GetInt returns the override for prefName as an int if there is one.
+func (o *overridePref) GetInt(prefName string) (int, error) {
+	v, ok := o.values[prefName]
+	if !ok {
+		return o.PrefInterface.GetInt(prefName)
+	}
+	i, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("override for %s is not an int", prefName)
+	}
+	return i, nil
+}
+
+// GetArray returns the override for prefName as an array if there is one.
+func (o *overridePref) GetArray(prefName string) ([]string, error) {
+	v, ok := o.values[prefName]
+	if !ok {
+		return o.PrefInterface.GetArray(prefName)
+	}
+	a, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("override for %s is not an array", prefName)
+	}
+	return a, nil
+}
+
+// GetDate returns the override for prefName as a date if there is one.
+func (o *overridePref) GetDate(prefName string) (time.Time, error) {
+	v, ok := o.values[prefName]
+	if !ok {
+		return o.PrefInterface.GetDate(prefName)
+	}
+	d, ok := v.(time.Time)
+	if !ok {
+		return time.Time{}, fmt.Errorf("override for %s is not a date", prefName)
+	}
+	return d, nil
+}
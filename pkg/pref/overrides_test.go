@@ -0,0 +1,141 @@
+package pref_test
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefinitionParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		pref    string
+		raw     string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "string", pref: "ServerURL", raw: "https://crypt.example.com", want: "https://crypt.example.com"},
+		{name: "bool", pref: "RemovePlist", raw: "false", want: false},
+		{name: "invalid bool", pref: "RemovePlist", raw: "nope", wantErr: true},
+		{name: "int", pref: "KeyEscrowInterval", raw: "0", want: 0},
+		{name: "invalid int", pref: "KeyEscrowInterval", raw: "one", wantErr: true},
+		{name: "array", pref: "SkipUsers", raw: "admin, support", want: []string{"admin", "support"}},
+		{name: "empty array", pref: "AdditionalCurlOpts", raw: "", want: []string{}},
+		{name: "JSON array", pref: "AuthMechsInsert", raw: `["Crypt:Check,privileged", "Crypt:Enablement,privileged"]`, want: []string{"Crypt:Check,privileged", "Crypt:Enablement,privileged"}},
+		{name: "empty JSON array", pref: "AuthMechsAfter", raw: "[]", want: []string{}},
+		{name: "invalid JSON array", pref: "AuthMechsInsert", raw: `["Crypt:Check,privileged"`, wantErr: true},
+		{name: "date", pref: "LastEscrow", raw: "2024-01-02T03:04:05Z", want: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{name: "command", pref: "PostRunCommand", raw: "/usr/bin/true --now", want: "/usr/bin/true --now"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, ok := pref.Lookup(tt.pref)
+			assert.True(t, ok)
+			got, err := def.Parse(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDefinitionDefaults(t *testing.T) {
+	defaults := map[string]interface{}{}
+	for _, d := range pref.Definitions() {
+		defaults[d.Name] = d.Default
+	}
+	assert.Equal(t, true, defaults["RemovePlist"])
+	assert.Equal(t, 1, defaults["KeyEscrowInterval"])
+	assert.Equal(t, "", defaults["CommonNameForEscrow"])
+	assert.Nil(t, defaults["ServerURL"])
+}
+
+func TestParseOverride(t *testing.T) {
+	o, err := pref.ParseOverride("keyescrowinterval=0", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, pref.Override{Name: "KeyEscrowInterval", Value: 0, Source: "test"}, o)
+
+	_, err = pref.ParseOverride("KeyEscrowInterval", "test")
+	assert.Error(t, err)
+
+	_, err = pref.ParseOverride("NotAPreference=1", "test")
+	assert.Error(t, err)
+}
+
+func TestOverridesFromEnv(t *testing.T) {
+	overrides, err := pref.OverridesFromEnv([]string{
+		"PATH=/usr/bin",
+		"CRYPT_SERVERURL=https://lab.example.com",
+		"CRYPT_KEY_ESCROW_INTERVAL=0",
+		"CRYPT_NOT_A_PREFERENCE=1",
+		`CRYPT_AUTH_MECHS_INSERT=["Crypt:Check,privileged"]`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []pref.Override{
+		{Name: "ServerURL", Value: "https://lab.example.com", Source: "environment variable CRYPT_SERVERURL"},
+		{Name: "KeyEscrowInterval", Value: 0, Source: "environment variable CRYPT_KEY_ESCROW_INTERVAL"},
+		{Name: "AuthMechsInsert", Value: []string{"Crypt:Check,privileged"}, Source: "environment variable CRYPT_AUTH_MECHS_INSERT"},
+	}, overrides)
+
+	_, err = pref.OverridesFromEnv([]string{"CRYPT_REMOVEPLIST=maybe"})
+	assert.Error(t, err)
+}
+
+func TestOverrideFlag(t *testing.T) {
+	var overrides pref.OverrideFlag
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&overrides, "set", "")
+
+	err := fs.Parse([]string{"-set", "KeyEscrowInterval=0", "-set", "RemovePlist=false"})
+	assert.NoError(t, err)
+	assert.Len(t, overrides, 2)
+	assert.Equal(t, "KeyEscrowInterval=0 RemovePlist=false", overrides.String())
+
+	err = fs.Parse([]string{"-set", "Bogus=1"})
+	assert.Error(t, err)
+}
+
+func TestWithOverrides(t *testing.T) {
+	base := preftest.New(
+		preftest.WithServer("https://crypt.example.com"),
+		preftest.WithValue("KeyEscrowInterval", 4),
+	)
+
+	assert.Same(t, base, pref.WithOverrides(base, nil))
+
+	p := pref.WithOverrides(base, []pref.Override{
+		{Name: "KeyEscrowInterval", Value: 2, Source: "environment"},
+		{Name: "KeyEscrowInterval", Value: 0, Source: "flag"},
+		{Name: "SkipUsers", Value: []string{"admin"}, Source: "flag"},
+	})
+
+	interval, err := p.GetInt("KeyEscrowInterval")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, interval)
+
+	serverURL, err := p.GetString("ServerURL")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://crypt.example.com", serverURL)
+
+	cfg, err := pref.Load(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.KeyEscrowInterval)
+	assert.Equal(t, []string{"admin"}, cfg.SkipUsers)
+
+	// overrides are never written back to the underlying preferences
+	interval, _ = base.GetInt("KeyEscrowInterval")
+	assert.Equal(t, 4, interval)
+	_, written := base.Value("SkipUsers")
+	assert.False(t, written)
+
+	_, err = p.GetBool("KeyEscrowInterval")
+	assert.Error(t, err)
+}
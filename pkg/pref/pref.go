@@ -12,6 +12,10 @@ CFPropertyListRef GetPreference(CFStringRef key, CFStringRef applicationID) {
 
 
 
+Boolean SynchronizePreferences(CFStringRef applicationID) {
+	return CFPreferencesAppSynchronize(applicationID);
+}
+
 CFBooleanRef getTrue() {
     return kCFBooleanTrue;
 }
@@ -41,17 +45,7 @@ import (
 
 const BundleID = "com.grahamgilbert.crypt"
 
-var defaultPrefs = map[string]interface{}{
-	"RemovePlist":                true,
-	"RotateUsedKey":              true,
-	"OutputPath":                 "/private/var/root/crypt_output.plist",
-	"ValidateKey":                true,
-	"KeyEscrowInterval":          1,
-	"AdditionalCurlOpts":         []string{},
-	"ManageAuthMechs":            true,
-	"StoreRecoveryKeyInKeychain": true,
-	"CommonNameForEscrow":        "",
-}
+var defaultPrefs = defaultValues()
 
 func (p *Pref) Get(prefName string) (interface{}, error) {
 	cPrefName := C.CFStringCreateWithCStringNoCopy(
@@ -72,15 +66,17 @@ func (p *Pref) Get(prefName string) (interface{}, error) {
 
 	prefValue := C.GetPreference(cPrefName, cBundleID)
 	if unsafe.Pointer(prefValue) == nil {
-		defaultValue, ok := defaultPrefs[prefName]
+		d, ok := defaultPrefs[prefName]
 		if !ok {
 			return nil, nil
 		}
-		err := p.Set(prefName, defaultValue)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to set default preference")
+		if d.SaveDefault {
+			err := p.Set(prefName, d.Default)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to set default preference")
+			}
 		}
-		return defaultValue, nil
+		return d.Default, nil
 	}
 
 	// Handle different types of preferences
@@ -131,6 +127,24 @@ func (p *Pref) Get(prefName string) (interface{}, error) {
 	}
 }
 
+// Synchronize discards CoreFoundation's cached copy of Crypt's preferences so
+// the next Get sees changes made by another process, such as a configuration
+// profile being installed.
+func Synchronize() error {
+	cBundleID := C.CFStringCreateWithCStringNoCopy(
+		C.kCFAllocatorDefault,
+		C.CString(BundleID),
+		C.kCFStringEncodingUTF8,
+		C.kCFAllocatorDefault,
+	)
+	defer C.CFRelease(C.CFTypeRef(cBundleID))
+
+	if C.SynchronizePreferences(cBundleID) == C.false {
+		return errors.New("failed to synchronize preferences")
+	}
+	return nil
+}
+
 func isRoot() (bool, error) {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -143,20 +157,27 @@ func isRoot() (bool, error) {
 	return false, nil
 }
 
+// domainPath returns the preference domain defaults should write to. When
+// running as root this is the system-wide domain in /Library/Preferences.
+func domainPath() (string, error) {
+	isRoot, err := isRoot()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine if running as root")
+	}
+	if isRoot {
+		return fmt.Sprintf("/Library/Preferences/%s", BundleID), nil
+	}
+	return BundleID, nil
+}
+
 // Set sets the value of a preference
 // Why use defaults over cgo? It's simpler, and more reliable.
 func (p *Pref) Set(prefName string, prefValue interface{}) error {
-	isRoot, err := isRoot()
+	path, err := domainPath()
 	if err != nil {
-		return errors.Wrap(err, "failed to determine if running as root")
+		return err
 	}
 	cmd := "/usr/bin/defaults"
-	var path string
-	if isRoot {
-		path = fmt.Sprintf("/Library/Preferences/%s", BundleID)
-	} else {
-		path = BundleID
-	}
 
 	args := []string{"write", path, prefName}
 	switch v := prefValue.(type) {
@@ -36,7 +36,11 @@ func New() PrefInterface {
 
 // Delete removes a preference from the system
 func (p *Pref) Delete(prefName string) error {
-	_, err := p.Runner.RunCmd("/usr/bin/defaults", "delete", BundleID, prefName)
+	path, err := domainPath()
+	if err != nil {
+		return err
+	}
+	_, err = p.Runner.RunCmd("/usr/bin/defaults", "delete", path, prefName)
 	if err != nil {
 		return errors.Wrapf(err, "failed to delete preference %s", prefName)
 	}
@@ -1,72 +1,85 @@
-package pref
+package pref_test
 
 import (
 	"runtime"
 	"testing"
 
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestGetPrefString(t *testing.T) {
-	if runtime.GOOS != "darwin" {
-		t.Skip("skipping test on non-darwin system")
+// prefStores returns the PrefInterface implementations the round trip tests
+// run against: the preftest fake everywhere, so it is held to the same
+// behaviour as the real store, and the preference domain on darwin.
+func prefStores() map[string]pref.PrefInterface {
+	stores := map[string]pref.PrefInterface{"preftest": preftest.New()}
+	if runtime.GOOS == "darwin" {
+		stores["CFPreferences"] = pref.New()
 	}
-	prefName := "testString"
-	expectedValue := "testValue"
-	p := New()
-	defer p.Delete(prefName) //nolint:errcheck
-	err := p.SetString(prefName, expectedValue)
-	assert.NoError(t, err)
+	return stores
+}
+
+func TestGetPrefString(t *testing.T) {
+	for name, p := range prefStores() {
+		t.Run(name, func(t *testing.T) {
+			prefName := "testString"
+			expectedValue := "testValue"
+			defer p.Delete(prefName) //nolint:errcheck
+			err := p.SetString(prefName, expectedValue)
+			assert.NoError(t, err)
 
-	value, err := p.GetString(prefName)
-	assert.NoError(t, err)
-	assert.Equal(t, expectedValue, value)
+			value, err := p.GetString(prefName)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedValue, value)
+		})
+	}
 }
 
 func TestGetPrefBool(t *testing.T) {
-	if runtime.GOOS != "darwin" {
-		t.Skip("skipping test on non-darwin system")
-	}
-	prefName := "testBool"
-	expectedValue := true
-	p := New()
-	defer p.Delete(prefName) //nolint:errcheck
-	err := p.SetBool(prefName, expectedValue)
-	assert.NoError(t, err)
+	for name, p := range prefStores() {
+		t.Run(name, func(t *testing.T) {
+			prefName := "testBool"
+			expectedValue := true
+			defer p.Delete(prefName) //nolint:errcheck
+			err := p.SetBool(prefName, expectedValue)
+			assert.NoError(t, err)
 
-	value, err := p.GetBool(prefName)
-	assert.NoError(t, err)
-	assert.Equal(t, expectedValue, value)
+			value, err := p.GetBool(prefName)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedValue, value)
+		})
+	}
 }
 
 func TestGetPrefInt(t *testing.T) {
-	if runtime.GOOS != "darwin" {
-		t.Skip("skipping test on non-darwin system")
-	}
-	prefName := "testInt"
-	expectedValue := 123
-	p := New()
-	defer p.Delete(prefName) //nolint:errcheck
-	err := p.SetInt(prefName, expectedValue)
-	assert.NoError(t, err)
+	for name, p := range prefStores() {
+		t.Run(name, func(t *testing.T) {
+			prefName := "testInt"
+			expectedValue := 123
+			defer p.Delete(prefName) //nolint:errcheck
+			err := p.SetInt(prefName, expectedValue)
+			assert.NoError(t, err)
 
-	value, err := p.GetInt(prefName)
-	assert.NoError(t, err)
-	assert.Equal(t, expectedValue, value)
+			value, err := p.GetInt(prefName)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedValue, value)
+		})
+	}
 }
 
 func TestGetPrefArray(t *testing.T) {
-	if runtime.GOOS != "darwin" {
-		t.Skip("skipping test on non-darwin system")
-	}
-	prefName := "testArray"
-	expectedValue := []string{"value1", "value2", "value3"}
-	p := New()
-	defer p.Delete(prefName) //nolint:errcheck
-	err := p.SetArray(prefName, expectedValue)
-	assert.NoError(t, err)
+	for name, p := range prefStores() {
+		t.Run(name, func(t *testing.T) {
+			prefName := "testArray"
+			expectedValue := []string{"value1", "value2", "value3"}
+			defer p.Delete(prefName) //nolint:errcheck
+			err := p.SetArray(prefName, expectedValue)
+			assert.NoError(t, err)
 
-	value, err := p.GetArray(prefName)
-	assert.NoError(t, err)
-	assert.Equal(t, expectedValue, value)
+			value, err := p.GetArray(prefName)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedValue, value)
+		})
+	}
 }
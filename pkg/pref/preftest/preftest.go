@@ -0,0 +1,258 @@
+// Package preftest provides an in-memory pref.PrefInterface for tests of code
+// that reads Crypt's preferences.
+package preftest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+)
+
+// Call is a single method call made on a Fake.
+type Call struct {
+	Method string
+	Name   string
+	Value  interface{}
+}
+
+// Fake is a map-backed pref.PrefInterface. Like the real implementation,
+// reading an unset preference that has a default returns the default, and
+// stores it if the definition saves its default. Reading one without a
+// default returns the zero value.
+type Fake struct {
+	mu      sync.Mutex
+	values  map[string]interface{}
+	managed map[string]bool
+	calls   []Call
+}
+
+// Option configures a Fake.
+type Option func(f *Fake)
+
+// New returns a Fake with opts applied in order.
+func New(opts ...Option) *Fake {
+	f := &Fake{values: map[string]interface{}{}, managed: map[string]bool{}}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// WithValue sets a single preference.
+func WithValue(name string, value interface{}) Option {
+	return func(f *Fake) {
+		f.values[name] = value
+	}
+}
+
+// Managed sets a preference as a configuration profile would, so setting or
+// deleting it fails.
+func Managed(name string, value interface{}) Option {
+	return func(f *Fake) {
+		f.values[name] = value
+		f.managed[name] = true
+	}
+}
+
+// WithServer sets ServerURL.
+func WithServer(serverURL string) Option {
+	return WithValue("ServerURL", serverURL)
+}
+
+// KeychainMode configures the recovery key to be stored in the keychain.
+func KeychainMode() Option {
+	return WithValue("StoreRecoveryKeyInKeychain", true)
+}
+
+// PlistMode configures the recovery key to be stored in a plist at outputPath,
+// which is removed after escrow if removePlist is true.
+func PlistMode(outputPath string, removePlist bool) Option {
+	return func(f *Fake) {
+		f.values["StoreRecoveryKeyInKeychain"] = false
+		f.values["OutputPath"] = outputPath
+		f.values["RemovePlist"] = removePlist
+	}
+}
+
+// MTLS configures escrow to use mTLS with the certificate matching commonName.
+func MTLS(commonName string) Option {
+	return WithValue("CommonNameForEscrow", commonName)
+}
+
+// Calls returns every call made on the Fake so far.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := make([]Call, len(f.calls))
+	copy(calls, f.calls)
+	return calls
+}
+
+// CallsTo returns the calls made to method.
+func (f *Fake) CallsTo(method string) []Call {
+	var calls []Call
+	for _, c := range f.Calls() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Value returns the stored value of a preference without recording a call.
+func (f *Fake) Value(name string) (interface{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[name]
+	return v, ok
+}
+
+func (f *Fake) record(method string, name string, value interface{}) {
+	f.calls = append(f.calls, Call{Method: method, Name: name, Value: value})
+}
+
+func (f *Fake) get(method string, name string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(method, name, nil)
+
+	if v, ok := f.values[name]; ok {
+		return v
+	}
+	for _, d := range pref.Definitions() {
+		if d.Name == name && d.Default != nil {
+			if d.SaveDefault {
+				f.values[name] = d.Default
+			}
+			return d.Default
+		}
+	}
+	return nil
+}
+
+func (f *Fake) set(method string, name string, value interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(method, name, value)
+	if f.managed[name] {
+		return fmt.Errorf("preference %s is managed", name)
+	}
+	f.values[name] = value
+	return nil
+}
+
+// Get returns the value of a preference.
+func (f *Fake) Get(prefName string) (interface{}, error) {
+	return f.get("Get", prefName), nil
+}
+
+// Set sets the value of a preference.
+func (f *Fake) Set(prefName string, value interface{}) error {
+	return f.set("Set", prefName, value)
+}
+
+// Delete removes a preference.
+func (f *Fake) Delete(prefName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Delete", prefName, nil)
+	if f.managed[prefName] {
+		return fmt.Errorf("preference %s is managed", prefName)
+	}
+	delete(f.values, prefName)
+	return nil
+}
+
+// GetString returns the value of a preference as a string.
+func (f *Fake) GetString(prefName string) (string, error) {
+	v := f.get("GetString", prefName)
+	if v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("preference %s is a %T, not a string", prefName, v)
+	}
+	return s, nil
+}
+
+// GetBool returns the value of a preference as a bool.
+func (f *Fake) GetBool(prefName string) (bool, error) {
+	v := f.get("GetBool", prefName)
+	if v == nil {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("preference %s is a %T, not a bool", prefName, v)
+	}
+	return b, nil
+}
+
+// GetInt returns the value of a preference as an int.
+func (f *Fake) GetInt(prefName string) (int, error) {
+	v := f.get("GetInt", prefName)
+	if v == nil {
+		return 0, nil
+	}
+	i, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("preference %s is a %T, not an int", prefName, v)
+	}
+	return i, nil
+}
+
+// GetArray returns the value of a preference as an array.
+func (f *Fake) GetArray(prefName string) ([]string, error) {
+	v := f.get("GetArray", prefName)
+	if v == nil {
+		return []string{}, nil
+	}
+	a, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("preference %s is a %T, not an array", prefName, v)
+	}
+	return a, nil
+}
+
+// GetDate returns the value of a preference as a date.
+func (f *Fake) GetDate(prefName string) (time.Time, error) {
+	v := f.get("GetDate", prefName)
+	if v == nil {
+		return time.Time{}, nil
+	}
+	d, ok := v.(time.Time)
+	if !ok {
+		return time.Time{}, fmt.Errorf("preference %s is a %T, not a date", prefName, v)
+	}
+	return d, nil
+}
+
+// SetString sets the value of a preference as a string.
+func (f *Fake) SetString(prefName string, value string) error {
+	return f.set("SetString", prefName, value)
+}
+
+// SetBool sets the value of a preference as a bool.
+func (f *Fake) SetBool(prefName string, value bool) error {
+	return f.set("SetBool", prefName, value)
+}
+
+// SetInt sets the value of a preference as an int.
+func (f *Fake) SetInt(prefName string, value int) error {
+	return f.set("SetInt", prefName, value)
+}
+
+// SetArray sets the value of a preference as an array.
+func (f *Fake) SetArray(prefName string, value []string) error {
+	return f.set("SetArray", prefName, value)
+}
+
+// SetDate sets the value of a preference as a date.
+func (f *Fake) SetDate(prefName string, value time.Time) error {
+	return f.set("SetDate", prefName, value)
+}
+
+var _ pref.PrefInterface = (*Fake)(nil)
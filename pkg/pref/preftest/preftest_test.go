@@ -0,0 +1,95 @@
+package preftest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeDefaults(t *testing.T) {
+	f := New()
+
+	removePlist, err := f.GetBool("RemovePlist")
+	assert.NoError(t, err)
+	assert.True(t, removePlist)
+
+	// like the real preferences, the default is stored once read
+	stored, ok := f.Value("RemovePlist")
+	assert.True(t, ok)
+	assert.Equal(t, true, stored)
+
+	serverURL, err := f.GetString("ServerURL")
+	assert.NoError(t, err)
+	assert.Empty(t, serverURL)
+	_, ok = f.Value("ServerURL")
+	assert.False(t, ok)
+
+	skipUsers, err := f.GetArray("SkipUsers")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, skipUsers)
+
+	// defaults that are not saved are returned but never stored
+	anchor, err := f.GetString("AuthMechsAnchor")
+	assert.NoError(t, err)
+	assert.Equal(t, "loginwindow:done", anchor)
+	_, ok = f.Value("AuthMechsAnchor")
+	assert.False(t, ok)
+}
+
+func TestFakeSetGetDelete(t *testing.T) {
+	f := New()
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.NoError(t, f.SetString("ServerURL", "https://crypt.example.com"))
+	assert.NoError(t, f.SetInt("KeyEscrowInterval", 4))
+	assert.NoError(t, f.SetDate("LastEscrow", date))
+
+	serverURL, _ := f.GetString("ServerURL")
+	assert.Equal(t, "https://crypt.example.com", serverURL)
+	interval, _ := f.GetInt("KeyEscrowInterval")
+	assert.Equal(t, 4, interval)
+	lastEscrow, _ := f.GetDate("LastEscrow")
+	assert.Equal(t, date, lastEscrow)
+
+	assert.NoError(t, f.Delete("LastEscrow"))
+	lastEscrow, _ = f.GetDate("LastEscrow")
+	assert.True(t, lastEscrow.IsZero())
+
+	_, err := f.GetBool("ServerURL")
+	assert.Error(t, err)
+}
+
+func TestFakeRecordsCalls(t *testing.T) {
+	f := New()
+	_, _ = f.GetString("ServerURL")
+	_ = f.SetBool("RemovePlist", false)
+	_ = f.Delete("LastEscrow")
+
+	assert.Equal(t, []Call{
+		{Method: "GetString", Name: "ServerURL"},
+		{Method: "SetBool", Name: "RemovePlist", Value: false},
+		{Method: "Delete", Name: "LastEscrow"},
+	}, f.Calls())
+	assert.Equal(t, []Call{{Method: "Delete", Name: "LastEscrow"}}, f.CallsTo("Delete"))
+}
+
+func TestScenarioOptions(t *testing.T) {
+	keychain := New(KeychainMode(), WithServer("https://crypt.example.com"))
+	useKeychain, _ := keychain.GetBool("StoreRecoveryKeyInKeychain")
+	assert.True(t, useKeychain)
+	serverURL, _ := keychain.GetString("ServerURL")
+	assert.Equal(t, "https://crypt.example.com", serverURL)
+
+	plistMode := New(PlistMode("/tmp/crypt_output.plist", true))
+	useKeychain, _ = plistMode.GetBool("StoreRecoveryKeyInKeychain")
+	assert.False(t, useKeychain)
+	outputPath, _ := plistMode.GetString("OutputPath")
+	assert.Equal(t, "/tmp/crypt_output.plist", outputPath)
+	removePlist, _ := plistMode.GetBool("RemovePlist")
+	assert.True(t, removePlist)
+
+	mTLS := New(MTLS("Crypt Client CA"))
+	commonName, _ := mTLS.GetString("CommonNameForEscrow")
+	assert.Equal(t, "Crypt Client CA", commonName)
+}
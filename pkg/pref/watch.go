@@ -0,0 +1,154 @@
+package pref
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// DefaultWatchInterval is how often a Watcher checks for changed preferences.
+const DefaultWatchInterval = 2 * time.Second
+
+// WatchPaths returns the files a preference change lands in: the plist written
+// when a configuration profile is installed or removed, and the local
+// preference domain.
+func WatchPaths() []string {
+	return []string{
+		filepath.Join("/Library/Managed Preferences", BundleID+".plist"),
+		filepath.Join("/Library/Preferences", BundleID+".plist"),
+	}
+}
+
+// Change is a single field that differs between two Configs.
+type Change struct {
+	Name string
+	Old  interface{}
+	New  interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s changed from %#v to %#v", c.Name, c.Old, c.New)
+}
+
+// Diff returns the fields that differ between c and other, in the order they
+// are declared in Config. Empty and nil arrays are treated as equal.
+func (c Config) Diff(other Config) []Change {
+	var changes []Change
+	oldValue := reflect.ValueOf(c)
+	newValue := reflect.ValueOf(other)
+	for i := 0; i < oldValue.NumField(); i++ {
+		o, n := oldValue.Field(i), newValue.Field(i)
+		if o.Kind() == reflect.Slice && o.Len() == 0 && n.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			changes = append(changes, Change{
+				Name: oldValue.Type().Field(i).Name,
+				Old:  o.Interface(),
+				New:  n.Interface(),
+			})
+		}
+	}
+	return changes
+}
+
+// Watcher reloads the Config when the preference files change on disk.
+type Watcher struct {
+	// Prefs is read to build the new Config.
+	Prefs PrefInterface
+	// Paths are polled for changes. A file appearing or being removed counts
+	// as a change.
+	Paths []string
+	// Interval is how often Paths are polled.
+	Interval time.Duration
+	// Synchronize is called before the preferences are read again so that
+	// cached values are not returned.
+	Synchronize func() error
+}
+
+// NewWatcher returns a Watcher for Crypt's preference files that reads p.
+func NewWatcher(p PrefInterface) *Watcher {
+	return &Watcher{
+		Prefs:       p,
+		Paths:       WatchPaths(),
+		Interval:    DefaultWatchInterval,
+		Synchronize: Synchronize,
+	}
+}
+
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+// Watch polls the preference files until ctx is done. Whenever one of them
+// changes the preferences are reloaded and validated. If the new Config differs
+// from the one in effect the changed keys are logged and onChange is called
+// with the previous and new Config, so Crypt's own writes to the preference
+// domain, such as saving a default, do not count as a change. A Config that
+// fails validation is logged and ignored, leaving the previous one in effect.
+func (w *Watcher) Watch(ctx context.Context, current Config, onChange func(old, new Config)) {
+	stamps := w.stamps()
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		latest := w.stamps()
+		if reflect.DeepEqual(stamps, latest) {
+			continue
+		}
+		stamps = latest
+
+		next, changed := w.reload(current)
+		if !changed {
+			continue
+		}
+		old := current
+		current = next
+		onChange(old, next)
+	}
+}
+
+func (w *Watcher) stamps() []fileStamp {
+	stamps := make([]fileStamp, len(w.Paths))
+	for i, path := range w.Paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to check %s for changes: %v", path, err)
+			}
+			continue
+		}
+		stamps[i] = fileStamp{exists: true, modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps
+}
+
+func (w *Watcher) reload(current Config) (Config, bool) {
+	if err := w.Synchronize(); err != nil {
+		log.Printf("Failed to synchronize preferences: %v", err)
+	}
+
+	next, err := Load(w.Prefs)
+	if err != nil {
+		log.Printf("Ignoring preference change: %v", err)
+		return current, false
+	}
+
+	changes := current.Diff(next)
+	for _, c := range changes {
+		log.Println(c)
+	}
+	return next, len(changes) > 0
+}
@@ -0,0 +1,148 @@
+package pref_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/pref/preftest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDiff(t *testing.T) {
+	old := pref.Config{ServerURL: "https://old.example.com", ManageAuthMechs: false, SkipUsers: nil}
+	next := pref.Config{ServerURL: "https://new.example.com", ManageAuthMechs: true, SkipUsers: []string{}}
+
+	assert.Equal(t, []pref.Change{
+		{Name: "ServerURL", Old: "https://old.example.com", New: "https://new.example.com"},
+		{Name: "ManageAuthMechs", Old: false, New: true},
+	}, old.Diff(next))
+	assert.Empty(t, old.Diff(old))
+	assert.Equal(t, `ServerURL changed from "https://old.example.com" to "https://new.example.com"`, old.Diff(next)[0].String())
+}
+
+func TestWatcherReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	managed := filepath.Join(dir, "managed.plist")
+	p := preftest.New(preftest.WithServer("https://old.example.com"))
+
+	current, err := pref.Load(p)
+	require.NoError(t, err)
+
+	var synced int32
+	w := &pref.Watcher{
+		Prefs:    p,
+		Paths:    []string{managed, filepath.Join(dir, "local.plist")},
+		Interval: 5 * time.Millisecond,
+		Synchronize: func() error {
+			atomic.AddInt32(&synced, 1)
+			return nil
+		},
+	}
+
+	changes := make(chan [2]pref.Config, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Watch(ctx, current, func(old, next pref.Config) {
+			changes <- [2]pref.Config{old, next}
+		})
+		close(done)
+	}()
+
+	// an invalid configuration is ignored
+	require.NoError(t, p.SetInt("KeyEscrowInterval", -1))
+	touchUntil(t, managed, func() bool { return atomic.LoadInt32(&synced) > 0 })
+	// wait for the last reload to finish; PostRunCommand is the last
+	// preference Load reads
+	time.Sleep(10 * w.Interval)
+	require.Eventually(t, func() bool {
+		return len(p.CallsTo("Get")) == int(atomic.LoadInt32(&synced))+1
+	}, 5*time.Second, time.Millisecond)
+	require.Empty(t, changes)
+
+	// a valid one is picked up
+	require.NoError(t, p.SetInt("KeyEscrowInterval", 1))
+	require.NoError(t, p.SetString("ServerURL", "https://new.example.com"))
+	require.NoError(t, p.SetBool("ManageAuthMechs", false))
+	touchUntil(t, managed, func() bool { return len(changes) > 0 })
+
+	got := <-changes
+	assert.Equal(t, "https://old.example.com", got[0].ServerURL)
+	assert.Equal(t, "https://new.example.com", got[1].ServerURL)
+	assert.True(t, got[0].ManageAuthMechs)
+	assert.False(t, got[1].ManageAuthMechs)
+
+	cancel()
+	<-done
+	assert.Empty(t, changes)
+}
+
+func TestWatcherIgnoresOwnWrites(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.plist")
+	p := preftest.New(
+		preftest.WithServer("https://crypt.example.com"),
+		preftest.WithValue("LastEscrow", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+	)
+
+	current, err := pref.Load(p)
+	require.NoError(t, err)
+
+	var synced int32
+	w := &pref.Watcher{
+		Prefs:    p,
+		Paths:    []string{local},
+		Interval: 5 * time.Millisecond,
+		Synchronize: func() error {
+			atomic.AddInt32(&synced, 1)
+			return nil
+		},
+	}
+
+	changes := make(chan [2]pref.Config, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Watch(ctx, current, func(old, next pref.Config) {
+			changes <- [2]pref.Config{old, next}
+		})
+		close(done)
+	}()
+
+	// checkin removing the legacy LastEscrow and saving a default again
+	// rewrites the local domain without changing the Config
+	require.NoError(t, p.Delete("LastEscrow"))
+	require.NoError(t, p.Delete("RemovePlist"))
+	touchUntil(t, local, func() bool { return atomic.LoadInt32(&synced) > 0 })
+	time.Sleep(10 * w.Interval)
+	require.Eventually(t, func() bool {
+		return len(p.CallsTo("Get")) == int(atomic.LoadInt32(&synced))+1
+	}, 5*time.Second, time.Millisecond)
+	_, saved := p.Value("RemovePlist")
+	assert.True(t, saved)
+
+	cancel()
+	<-done
+	assert.Empty(t, changes)
+}
+
+// touchUntil rewrites path until cond is true, as the watcher may not have
+// taken its first look at the file when it is first written.
+func touchUntil(t *testing.T, path string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", i+1)), 0600))
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the watcher")
+}
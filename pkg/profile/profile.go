@@ -0,0 +1,228 @@
+// Package profile builds configuration profiles that manage Crypt's
+// preferences.
+package profile
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/pref"
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/groob/plist"
+	"github.com/pkg/errors"
+)
+
+// DefaultIdentifier is the PayloadIdentifier of generated profiles. Keeping it
+// the same between runs means a newly generated profile replaces the old one
+// when it is installed.
+const DefaultIdentifier = pref.BundleID
+
+// Options describes the profile to generate.
+type Options struct {
+	Organization      string
+	DisplayName       string
+	Description       string
+	Identifier        string
+	RemovalDisallowed bool
+	// Values are the preferences set by the profile, keyed by name.
+	Values map[string]interface{}
+}
+
+type configuration struct {
+	PayloadContent           []map[string]interface{} `plist:"PayloadContent"`
+	PayloadDescription       string                   `plist:"PayloadDescription"`
+	PayloadDisplayName       string                   `plist:"PayloadDisplayName"`
+	PayloadEnabled           bool                     `plist:"PayloadEnabled"`
+	PayloadIdentifier        string                   `plist:"PayloadIdentifier"`
+	PayloadOrganization      string                   `plist:"PayloadOrganization,omitempty"`
+	PayloadRemovalDisallowed bool                     `plist:"PayloadRemovalDisallowed"`
+	PayloadScope             string                   `plist:"PayloadScope"`
+	PayloadType              string                   `plist:"PayloadType"`
+	PayloadUUID              string                   `plist:"PayloadUUID"`
+	PayloadVersion           int                      `plist:"PayloadVersion"`
+}
+
+// Generate returns an unsigned .mobileconfig that sets opts.Values in the
+// com.grahamgilbert.crypt domain. Every preference must be one Crypt knows
+// about and hold a value of the matching type. Each call uses fresh UUIDs.
+func Generate(opts Options) ([]byte, error) {
+	if opts.Identifier == "" {
+		opts.Identifier = DefaultIdentifier
+	}
+	if opts.DisplayName == "" {
+		opts.DisplayName = "Crypt Settings"
+	}
+
+	profileUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	payloadUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"PayloadDescription": opts.DisplayName,
+		"PayloadDisplayName": opts.DisplayName,
+		"PayloadEnabled":     true,
+		"PayloadIdentifier":  fmt.Sprintf("%s.%s", opts.Identifier, payloadUUID),
+		"PayloadType":        pref.BundleID,
+		"PayloadUUID":        payloadUUID,
+		"PayloadVersion":     1,
+	}
+	if opts.Organization != "" {
+		payload["PayloadOrganization"] = opts.Organization
+	}
+	for name, value := range opts.Values {
+		def, ok := pref.Lookup(name)
+		if !ok || def.Internal {
+			return nil, fmt.Errorf("%s is not a preference that can be set in a profile", name)
+		}
+		if err := checkType(def, value); err != nil {
+			return nil, err
+		}
+		payload[def.Name] = value
+	}
+
+	profile := configuration{
+		PayloadContent:           []map[string]interface{}{payload},
+		PayloadDescription:       opts.Description,
+		PayloadDisplayName:       opts.DisplayName,
+		PayloadEnabled:           true,
+		PayloadIdentifier:        opts.Identifier,
+		PayloadOrganization:      opts.Organization,
+		PayloadRemovalDisallowed: opts.RemovalDisallowed,
+		PayloadScope:             "System",
+		PayloadType:              "Configuration",
+		PayloadUUID:              profileUUID,
+		PayloadVersion:           1,
+	}
+
+	data, err := plist.MarshalIndent(profile, "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode profile")
+	}
+	return data, nil
+}
+
+// checkType returns an error if value is not of the type def is stored as.
+func checkType(def pref.Definition, value interface{}) error {
+	var ok bool
+	switch def.Kind {
+	case pref.KindString:
+		_, ok = value.(string)
+	case pref.KindBool:
+		_, ok = value.(bool)
+	case pref.KindInt:
+		_, ok = value.(int)
+	case pref.KindArray:
+		_, ok = value.([]string)
+	case pref.KindDate:
+		_, ok = value.(time.Time)
+	case pref.KindCommand:
+		switch value.(type) {
+		case string, []string:
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s must be a %s, got %T", def.Name, def.Kind, value)
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID in the upper case form Apple uses.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errors.Wrap(err, "failed to generate UUID")
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])), nil
+}
+
+// Sign signs a profile in CMS with the PEM encoded certificate and private key
+// at certPath and keyPath, returning the DER encoded signed profile.
+func Sign(r utils.Runner, profile []byte, certPath string, keyPath string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "crypt-profile")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	unsigned := filepath.Join(dir, "unsigned.mobileconfig")
+	signed := filepath.Join(dir, "signed.mobileconfig")
+	if err := os.WriteFile(unsigned, profile, 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to write unsigned profile")
+	}
+
+	_, err = r.Runner.RunCmd("/usr/bin/openssl", "smime", "-sign",
+		"-signer", certPath,
+		"-inkey", keyPath,
+		"-nodetach",
+		"-outform", "der",
+		"-in", unsigned,
+		"-out", signed,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign profile")
+	}
+
+	data, err := os.ReadFile(signed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signed profile")
+	}
+	return data, nil
+}
+
+// RegisterFlags adds a flag to fs for every preference that can be set in a
+// profile, named after the preference. Parsed values are stored in values.
+func RegisterFlags(fs *flag.FlagSet, values map[string]interface{}) {
+	for _, def := range pref.Definitions() {
+		if def.Internal {
+			continue
+		}
+		usage := def.Description
+		if def.Kind == pref.KindArray {
+			usage += " (comma separated, or a JSON array)"
+		}
+		fs.Var(&prefFlag{def: def, values: values}, def.Name, usage)
+	}
+}
+
+// prefFlag is a flag.Value that parses a preference with its definition.
+type prefFlag struct {
+	def    pref.Definition
+	values map[string]interface{}
+}
+
+func (f *prefFlag) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+	if v, ok := f.values[f.def.Name]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (f *prefFlag) Set(raw string) error {
+	value, err := f.def.Parse(raw)
+	if err != nil {
+		return err
+	}
+	f.values[f.def.Name] = value
+	return nil
+}
+
+// IsBoolFlag lets bool preferences be given as -Name rather than -Name=true.
+func (f *prefFlag) IsBoolFlag() bool {
+	return f.def.Kind == pref.KindBool
+}
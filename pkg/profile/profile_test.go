@@ -0,0 +1,143 @@
+package profile
+
+import (
+	"flag"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/groob/plist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9A-F]{8}-[0-9A-F]{4}-4[0-9A-F]{3}-[89AB][0-9A-F]{3}-[0-9A-F]{12}$`)
+
+type decodedProfile struct {
+	PayloadContent    []map[string]interface{} `plist:"PayloadContent"`
+	PayloadIdentifier string                   `plist:"PayloadIdentifier"`
+	PayloadScope      string                   `plist:"PayloadScope"`
+	PayloadType       string                   `plist:"PayloadType"`
+	PayloadUUID       string                   `plist:"PayloadUUID"`
+}
+
+func decode(t *testing.T, data []byte) decodedProfile {
+	t.Helper()
+	var p decodedProfile
+	require.NoError(t, plist.Unmarshal(data, &p))
+	require.Len(t, p.PayloadContent, 1)
+	return p
+}
+
+func TestGenerate(t *testing.T) {
+	data, err := Generate(Options{
+		Organization: "Example Org",
+		Values: map[string]interface{}{
+			"ServerURL":         "https://crypt.example.com",
+			"RemovePlist":       false,
+			"KeyEscrowInterval": 2,
+			"SkipUsers":         []string{"admin", "support"},
+			"PostRunCommand":    "/usr/local/bin/logout",
+		},
+	})
+	require.NoError(t, err)
+
+	p := decode(t, data)
+	assert.Equal(t, "Configuration", p.PayloadType)
+	assert.Equal(t, "System", p.PayloadScope)
+	assert.Equal(t, DefaultIdentifier, p.PayloadIdentifier)
+	assert.Regexp(t, uuidPattern, p.PayloadUUID)
+
+	payload := p.PayloadContent[0]
+	assert.Equal(t, "com.grahamgilbert.crypt", payload["PayloadType"])
+	assert.Regexp(t, uuidPattern, payload["PayloadUUID"])
+	assert.NotEqual(t, p.PayloadUUID, payload["PayloadUUID"])
+	assert.Equal(t, "Example Org", payload["PayloadOrganization"])
+	assert.Equal(t, "https://crypt.example.com", payload["ServerURL"])
+	assert.Equal(t, false, payload["RemovePlist"])
+	assert.EqualValues(t, 2, payload["KeyEscrowInterval"])
+	assert.Equal(t, []interface{}{"admin", "support"}, payload["SkipUsers"])
+	assert.Equal(t, "/usr/local/bin/logout", payload["PostRunCommand"])
+	assert.NotContains(t, payload, "OutputPath")
+
+	assert.Contains(t, string(data), "<integer>2</integer>")
+	assert.Contains(t, string(data), "<false/>")
+
+	again, err := Generate(Options{})
+	require.NoError(t, err)
+	assert.NotEqual(t, p.PayloadUUID, decode(t, again).PayloadUUID)
+}
+
+func TestGenerateRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+	}{
+		{name: "unknown preference", values: map[string]interface{}{"NotAPreference": true}},
+		{name: "internal preference", values: map[string]interface{}{"LastEscrow": time.Now()}},
+		{name: "string for bool", values: map[string]interface{}{"RemovePlist": "false"}},
+		{name: "string for int", values: map[string]interface{}{"KeyEscrowInterval": "1"}},
+		{name: "string for array", values: map[string]interface{}{"SkipUsers": "admin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Generate(Options{Values: tt.values})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	values := map[string]interface{}{}
+	fs := flag.NewFlagSet("profile generate", flag.ContinueOnError)
+	RegisterFlags(fs, values)
+
+	err := fs.Parse([]string{
+		"-ServerURL", "https://crypt.example.com",
+		"-RemovePlist=false",
+		"-GenerateNewKey",
+		"-KeyEscrowInterval", "4",
+		"-SkipUsers", "admin,support",
+		"-AuthMechsInsert", `["Crypt:Check,privileged"]`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"ServerURL":         "https://crypt.example.com",
+		"RemovePlist":       false,
+		"GenerateNewKey":    true,
+		"KeyEscrowInterval": 4,
+		"SkipUsers":         []string{"admin", "support"},
+		"AuthMechsInsert":   []string{"Crypt:Check,privileged"},
+	}, values)
+
+	assert.Nil(t, fs.Lookup("LastEscrow"))
+	assert.Error(t, fs.Parse([]string{"-KeyEscrowInterval", "often"}))
+}
+
+// signingRunner writes a fake signed profile to the -out argument.
+type signingRunner struct {
+	utils.MockCmdRunner
+	args []string
+}
+
+func (s *signingRunner) RunCmd(name string, arg ...string) ([]byte, error) {
+	s.args = append([]string{name}, arg...)
+	for i, a := range arg {
+		if a == "-out" {
+			return nil, os.WriteFile(arg[i+1], []byte("signed"), 0600)
+		}
+	}
+	return nil, nil
+}
+
+func TestSign(t *testing.T) {
+	runner := &signingRunner{}
+	signed, err := Sign(utils.Runner{Runner: runner}, []byte("unsigned"), "/tmp/cert.pem", "/tmp/key.pem")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("signed"), signed)
+	assert.Equal(t, "/usr/bin/openssl", runner.args[0])
+	assert.Subset(t, runner.args, []string{"smime", "-sign", "-signer", "/tmp/cert.pem", "-inkey", "/tmp/key.pem", "-nodetach", "-outform", "der"})
+}
@@ -0,0 +1,177 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/grahamgilbert/crypt/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// DefaultPath is where checkin keeps its runtime state. Only root can read or
+// write it.
+const DefaultPath = "/var/db/crypt/state.json"
+
+// SchemaVersion is the version of the state file written by this build.
+const SchemaVersion = 1
+
+// State is what checkin records between runs. It is kept out of the
+// preference domain so preferences only ever hold configuration.
+type State struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// LastEscrow is when the current recovery key was last escrowed. It is
+	// zero when the key has never been escrowed or has been rotated since.
+	LastEscrow time.Time `json:"last_escrow"`
+	// LastEscrowFingerprint is the keyhistory fingerprint of the key that was
+	// last escrowed, so a key that changes is escrowed straight away.
+	LastEscrowFingerprint string `json:"last_escrow_fingerprint,omitempty"`
+	// ImportedLastEscrow is the LastEscrow preference last imported from the
+	// preference domain while it could not be removed from there, so the
+	// same value is not imported again on every run.
+	ImportedLastEscrow time.Time `json:"imported_last_escrow"`
+
+	LastEscrowAttempt   time.Time `json:"last_escrow_attempt"`
+	LastEscrowServer    string    `json:"last_escrow_server,omitempty"`
+	LastEscrowError     string    `json:"last_escrow_error,omitempty"`
+	EscrowAttempts      int       `json:"escrow_attempts"`
+	EscrowFailures      int       `json:"escrow_failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+
+	// AuthDBDrift is the times Crypt's mechanisms were found missing or out
+	// of place in system.login.console and put back, oldest first.
+	AuthDBDrift []DriftEvent `json:"authdb_drift,omitempty"`
+	// AuthMechsSpec is a hash of the AuthMechs preferences Crypt's mechanisms
+	// were last placed with. Mechanisms that are not as configured only count
+	// as drift if they were placed with the same preferences before.
+	AuthMechsSpec string `json:"authmechs_spec,omitempty"`
+}
+
+// DriftEvent records system.login.console found not as configured.
+type DriftEvent struct {
+	Time time.Time `json:"time"`
+	// OSBuild is the macOS build, as printed by sw_vers -buildVersion.
+	OSBuild string   `json:"os_build,omitempty"`
+	Before  []string `json:"before"`
+	After   []string `json:"after"`
+}
+
+// Store reads and writes State to a file.
+type Store struct {
+	path string
+}
+
+// New returns a Store backed by the file at path.
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path returns the file the Store is backed by.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// migrations upgrade the raw state from the version used as the key to the
+// next one.
+var migrations = map[int]func(raw map[string]interface{}) error{
+	// Version 0 is a state file written before schema versions existed. It
+	// has the same fields as version 1.
+	0: func(raw map[string]interface{}) error { return nil },
+}
+
+// Load returns the stored State, migrating it to the current schema if it was
+// written by an older version. A missing file is an empty State.
+func (s *Store) Load() (State, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return State{SchemaVersion: SchemaVersion}, nil
+	}
+	if err != nil {
+		return State{}, errors.Wrap(err, "failed to read state file")
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return State{}, errors.Wrap(err, "failed to parse state file")
+	}
+
+	if err := migrate(raw); err != nil {
+		return State{}, err
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return State{}, errors.Wrap(err, "failed to encode migrated state")
+	}
+
+	var st State
+	if err := json.Unmarshal(migrated, &st); err != nil {
+		return State{}, errors.Wrap(err, "failed to decode state")
+	}
+
+	return st, nil
+}
+
+func migrate(raw map[string]interface{}) error {
+	version := 0
+	if v, ok := raw["schema_version"].(float64); ok {
+		version = int(v)
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("state file has schema version %d, newer than the supported version %d", version, SchemaVersion)
+	}
+
+	for version < SchemaVersion {
+		m, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from state schema version %d", version)
+		}
+		if err := m(raw); err != nil {
+			return errors.Wrapf(err, "failed to migrate state from schema version %d", version)
+		}
+		version++
+		raw["schema_version"] = version
+	}
+
+	return nil
+}
+
+// Save atomically writes st to the store, creating the root-only directory
+// that holds it if needed.
+func (s *Store) Save(st State) error {
+	st.SchemaVersion = SchemaVersion
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create state directory")
+	}
+
+	if err := utils.WriteFileAtomic(s.path, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	return nil
+}
+
+// Update loads the State, applies fn to it and saves the result. Nothing is
+// saved if fn returns an error.
+func (s *Store) Update(fn func(st *State) error) error {
+	st, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&st); err != nil {
+		return err
+	}
+
+	return s.Save(st)
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMissing(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "state.json"))
+
+	st, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, State{SchemaVersion: SchemaVersion}, st)
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crypt", "state.json")
+	s := New(path)
+
+	want := State{
+		LastEscrow:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		LastEscrowServer: "https://crypt.example.com/checkin/",
+		EscrowAttempts:   3,
+		EscrowFailures:   1,
+		AuthDBDrift: []DriftEvent{{
+			Time:    time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+			OSBuild: "23E224",
+			Before:  []string{"loginwindow:done"},
+			After:   []string{"Crypt:Check,privileged", "loginwindow:done"},
+		}},
+	}
+	require.NoError(t, s.Save(want))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	dirInfo, err := os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), dirInfo.Mode().Perm())
+
+	got, err := s.Load()
+	require.NoError(t, err)
+	want.SchemaVersion = SchemaVersion
+	assert.Equal(t, want, got)
+}
+
+func TestLoadMigratesUnversionedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := os.WriteFile(path, []byte(`{"last_escrow":"2024-05-01T12:00:00Z","escrow_attempts":2}`), 0600)
+	require.NoError(t, err)
+
+	st, err := New(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, SchemaVersion, st.SchemaVersion)
+	assert.Equal(t, 2, st.EscrowAttempts)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), st.LastEscrow)
+}
+
+func TestLoadNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := os.WriteFile(path, []byte(`{"schema_version":999}`), 0600)
+	require.NoError(t, err)
+
+	_, err = New(path).Load()
+	assert.Error(t, err)
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := os.WriteFile(path, []byte(`{"schema_version":`), 0600)
+	require.NoError(t, err)
+
+	_, err = New(path).Load()
+	assert.Error(t, err)
+}
+
+func TestUpdate(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "state.json"))
+
+	for i := 0; i < 2; i++ {
+		err := s.Update(func(st *State) error {
+			st.EscrowAttempts++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	err := s.Update(func(st *State) error {
+		st.EscrowAttempts = 100
+		return errors.New("boom")
+	})
+	assert.Error(t, err)
+
+	st, err := s.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.EscrowAttempts)
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFileAtomic writes data to path by writing a temporary file in the same
+// directory, syncing it to disk and renaming it over path. A crash part way
+// through leaves either the old file or the new one, never a truncated file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, data, perm, nil)
+}
+
+// WriteFileAtomicOwned is WriteFileAtomic, but the file is also owned by uid
+// and gid before it replaces path, so there is never a moment where path has
+// the wrong owner.
+func WriteFileAtomicOwned(path string, data []byte, perm os.FileMode, uid, gid int) error {
+	return writeFileAtomic(path, data, perm, func(tmp *os.File) error {
+		if err := tmp.Chown(uid, gid); err != nil {
+			return errors.Wrap(err, "failed to set owner of temporary file")
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic implements WriteFileAtomic, calling prepare on the temporary
+// file, if it is not nil, before it is synced.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, prepare func(tmp *os.File) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) //nolint:errcheck // already renamed on success
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write temporary file")
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to set permissions on temporary file")
+	}
+	if prepare != nil {
+		if err := prepare(tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temporary file")
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "failed to rename temporary file")
+	}
+
+	// Sync the directory so the rename itself survives a crash.
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync directory")
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	err := WriteFileAtomic(path, []byte("first"), 0600)
+	require.NoError(t, err)
+
+	err = WriteFileAtomic(path, []byte("second"), 0600)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteFileAtomicMissingDirectory(t *testing.T) {
+	err := WriteFileAtomic(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("data"), 0600)
+	assert.Error(t, err)
+}
+
+func TestWriteFileAtomicOwned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crypt_output.plist")
+
+	err := WriteFileAtomicOwned(path, []byte("data"), 0600, os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+
+	data, err := ReadFileSecure(path, os.Getuid())
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -12,20 +12,30 @@ package utils
 */
 import "C"
 import (
-	"errors"
-	"fmt"
+	"encoding/json"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
-)
 
-const service = "com.grahamgilbert.crypt.recovery"
+	"github.com/pkg/errors"
+)
 
-var serviceStringRef = stringToCFString(service)
 var mu sync.Mutex
 
-// AddSecret will add a secret to the keychain. This secret can be retrieved by this application without any user authorization.
-func AddSecret(secret string) error {
+// KeychainSecretStore is a SecretStore backed by generic password items in
+// the macOS keychain. Each secret is an item whose label and service are its
+// name, which is how the authorization plugin stores the recovery key.
+type KeychainSecretStore struct{}
+
+// NewKeychainSecretStore returns a SecretStore that uses the keychain.
+func NewKeychainSecretStore() *KeychainSecretStore {
+	return &KeychainSecretStore{}
+}
+
+// Set will add a secret to the keychain. This secret can be retrieved by this application without any user authorization.
+// If an item with the same name already exists its data is replaced, keeping the item's other attributes and access control.
+func (k *KeychainSecretStore) Set(name string, secret string) error {
 	secret = strings.TrimSpace(secret)
 	if secret == "" {
 		return errors.New("secret cannot be empty")
@@ -34,6 +44,9 @@ func AddSecret(secret string) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	nameStringRef := stringToCFString(name)
+	defer releaseCFString(nameStringRef)
+
 	query := C.CFDictionaryCreateMutable(
 		C.kCFAllocatorDefault,
 		0,
@@ -46,29 +59,84 @@ func AddSecret(secret string) error {
 	defer C.CFRelease(C.CFTypeRef(data))
 
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassGenericPassword))
-	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrService), unsafe.Pointer(serviceStringRef))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(nameStringRef))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrService), unsafe.Pointer(nameStringRef))
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecValueData), unsafe.Pointer(data))
 
 	status := C.SecItemAdd(C.CFDictionaryRef(query), nil)
+	if status == C.errSecDuplicateItem {
+		return updateSecret(nameStringRef, data, name)
+	}
 	if status != C.errSecSuccess {
-		return fmt.Errorf("failed to add %v to keychain: %v", service, status)
+		return errors.Errorf("failed to add %v to keychain: %v", name, status)
 	}
 	return nil
 }
 
-// GetSecret retrieves a secret from the macOS keychain.
-// It creates a query dictionary to search for a generic password item with a specific label.
-// If the item is found, it returns the secret as a string.
-// If the item is not found, it returns an empty string.
-// If an error occurs during the retrieval, it returns an error.
+// updateSecret replaces the data of the existing item labelled nameStringRef.
+func updateSecret(nameStringRef C.CFStringRef, data C.CFDataRef, name string) error {
+	attributes := C.CFDictionaryCreateMutable(
+		C.kCFAllocatorDefault,
+		0,
+		&C.kCFTypeDictionaryKeyCallBacks,
+		&C.kCFTypeDictionaryValueCallBacks, //nolint:gocritic // dubSubExpr false positive
+	)
+	defer C.CFRelease(C.CFTypeRef(attributes))
+
+	C.CFDictionaryAddValue(attributes, unsafe.Pointer(C.kSecValueData), unsafe.Pointer(data))
+
+	return updateItem(nameStringRef, attributes, name)
+}
+
+// updateItem sets attributes on the existing item labelled nameStringRef.
+func updateItem(nameStringRef C.CFStringRef, attributes C.CFMutableDictionaryRef, name string) error {
+	query := C.CFDictionaryCreateMutable(
+		C.kCFAllocatorDefault,
+		0,
+		&C.kCFTypeDictionaryKeyCallBacks,
+		&C.kCFTypeDictionaryValueCallBacks, //nolint:gocritic // dubSubExpr false positive
+	)
+	defer C.CFRelease(C.CFTypeRef(query))
+
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassGenericPassword))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(nameStringRef))
+
+	status := C.SecItemUpdate(C.CFDictionaryRef(query), C.CFDictionaryRef(attributes))
+	if status == C.errSecItemNotFound {
+		return errors.Wrapf(ErrSecretNotFound, "could not find %v in keychain", name)
+	}
+	if status != C.errSecSuccess {
+		return errors.Errorf("failed to update %v in keychain: %v", name, status)
+	}
+	return nil
+}
+
+// Get retrieves a secret from the macOS keychain.
+// If the item is not found, it returns an error wrapping ErrSecretNotFound.
+func (k *KeychainSecretStore) Get(name string) (string, error) {
+	secret, err := k.GetSecret(name)
+	return secret.Value, err
+}
+
+// GetSecret retrieves a secret and its metadata from the macOS keychain.
+// It creates a query dictionary to search for a generic password item labelled with name,
+// returning both its data and its attributes. The metadata is read from the item's
+// generic attribute, where SetMetadata stores it as JSON.
+// If the item is not found, it returns an error wrapping ErrSecretNotFound.
+//
+// Parameters:
+//   - name: The label of the keychain item.
 //
 // Returns:
-//   - string: The secret retrieved from the keychain, or an empty string if not found.
+//   - Secret: The secret retrieved from the keychain, with its metadata and modification date.
 //   - error: An error if the retrieval fails, or nil if successful.
-func GetSecret() (string, error) {
+func (k *KeychainSecretStore) GetSecret(name string) (Secret, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	nameStringRef := stringToCFString(name)
+	defer releaseCFString(nameStringRef)
+
 	query := C.CFDictionaryCreateMutable(
 		C.kCFAllocatorDefault,
 		0,
@@ -79,28 +147,93 @@ func GetSecret() (string, error) {
 
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassGenericPassword))
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecReturnData), unsafe.Pointer(C.kCFBooleanTrue))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecReturnAttributes), unsafe.Pointer(C.kCFBooleanTrue))
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecMatchLimit), unsafe.Pointer(C.kSecMatchLimitOne))
-	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(serviceStringRef))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(nameStringRef))
 
-	var data C.CFTypeRef
-	status := C.SecItemCopyMatching(C.CFDictionaryRef(query), &data) //nolint:gocritic // dubSubExpr false positive
+	var result C.CFTypeRef
+	status := C.SecItemCopyMatching(C.CFDictionaryRef(query), &result) //nolint:gocritic // dubSubExpr false positive
 	if status != C.errSecSuccess {
 		if status == C.errSecItemNotFound {
-			return "", fmt.Errorf("could not find %v in keychain", service)
+			return Secret{}, errors.Wrapf(ErrSecretNotFound, "could not find %v in keychain", name)
+		}
+		return Secret{}, errors.Errorf("failed to retrieve %v from keychain: %v", name, status)
+	}
+	defer C.CFRelease(result)
+
+	item := C.CFDictionaryRef(result)
+	var secret Secret
+
+	data := C.CFDataRef(C.CFDictionaryGetValue(item, unsafe.Pointer(C.kSecValueData)))
+	if unsafe.Pointer(data) == nil {
+		return Secret{}, errors.Errorf("keychain item %v has no data", name)
+	}
+	secret.Value = string(cfDataToBytes(data))
+
+	generic := C.CFDataRef(C.CFDictionaryGetValue(item, unsafe.Pointer(C.kSecAttrGeneric)))
+	if unsafe.Pointer(generic) != nil {
+		if err := json.Unmarshal(cfDataToBytes(generic), &secret.Metadata); err != nil {
+			return Secret{}, errors.Wrapf(err, "failed to parse metadata of %v", name)
 		}
-		return "", fmt.Errorf("failed to retrieve %v from keychain: %v", service, status)
 	}
-	defer C.CFRelease(data)
 
-	secret := C.CFDataGetBytePtr(C.CFDataRef(data))
-	return C.GoString((*C.char)(unsafe.Pointer(secret))), nil
+	modified := C.CFDateRef(C.CFDictionaryGetValue(item, unsafe.Pointer(C.kSecAttrModificationDate)))
+	if unsafe.Pointer(modified) != nil {
+		abs := float64(C.CFDateGetAbsoluteTime(modified)) + float64(C.kCFAbsoluteTimeIntervalSince1970)
+		secret.Modified = time.Unix(0, int64(abs*float64(time.Second)))
+	}
+
+	return secret, nil
+}
+
+// SetMetadata stores metadata on the keychain item labelled name. The metadata is
+// kept as JSON in the item's generic attribute and summarised in its comment, so it
+// is visible in Keychain Access. The keychain updates the modification date.
+func (k *KeychainSecretStore) SetMetadata(name string, metadata SecretMetadata) error {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode metadata")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	nameStringRef := stringToCFString(name)
+	defer releaseCFString(nameStringRef)
+
+	commentStringRef := stringToCFString(metadata.Comment())
+	defer releaseCFString(commentStringRef)
+
+	generic := C.CFDataCreate(C.kCFAllocatorDefault, (*C.UInt8)(&encoded[0]), C.CFIndex(len(encoded)))
+	defer C.CFRelease(C.CFTypeRef(generic))
+
+	attributes := C.CFDictionaryCreateMutable(
+		C.kCFAllocatorDefault,
+		0,
+		&C.kCFTypeDictionaryKeyCallBacks,
+		&C.kCFTypeDictionaryValueCallBacks, //nolint:gocritic // dubSubExpr false positive
+	)
+	defer C.CFRelease(C.CFTypeRef(attributes))
+
+	C.CFDictionaryAddValue(attributes, unsafe.Pointer(C.kSecAttrGeneric), unsafe.Pointer(generic))
+	C.CFDictionaryAddValue(attributes, unsafe.Pointer(C.kSecAttrComment), unsafe.Pointer(commentStringRef))
+
+	return updateItem(nameStringRef, attributes, name)
 }
 
-// deleteSecret will delete a secret from the keychain.
-func DeleteSecret() error {
+// cfDataToBytes copies the contents of a CFDataRef into a byte slice.
+func cfDataToBytes(data C.CFDataRef) []byte {
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(data)), C.int(C.CFDataGetLength(data)))
+}
+
+// Delete will delete a secret from the keychain.
+func (k *KeychainSecretStore) Delete(name string) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	nameStringRef := stringToCFString(name)
+	defer releaseCFString(nameStringRef)
+
 	query := C.CFDictionaryCreateMutable(
 		C.kCFAllocatorDefault,
 		0,
@@ -111,11 +244,14 @@ func DeleteSecret() error {
 
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassGenericPassword))
 	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecMatchLimit), unsafe.Pointer(C.kSecMatchLimitOne))
-	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(serviceStringRef))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(nameStringRef))
 
 	status := C.SecItemDelete(C.CFDictionaryRef(query))
+	if status == C.errSecItemNotFound {
+		return errors.Wrapf(ErrSecretNotFound, "failed to delete %v from keychain", name)
+	}
 	if status != C.errSecSuccess {
-		return fmt.Errorf("failed to delete %v from keychain: %v", service, status)
+		return errors.Errorf("failed to delete %v from keychain: %v", name, status)
 	}
 	return nil
 }
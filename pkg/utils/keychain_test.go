@@ -5,6 +5,7 @@ package utils
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,85 +15,86 @@ func TestKeychainFunctionality(t *testing.T) {
 	// They may fail in CI environments that don't have keychain access
 
 	const testSecret = "test-recovery-key-12345"
+	store := NewKeychainSecretStore()
 
 	t.Run("add and retrieve secret", func(t *testing.T) {
 		// Clean up any existing test secret first
-		_ = DeleteSecret() // Ignore error if nothing exists
+		_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
 
 		// Add a secret to keychain
-		err := AddSecret(testSecret)
+		err := store.Set(RecoveryKeySecret, testSecret)
 		if err != nil {
 			t.Skipf("Skipping keychain test - keychain not available: %v", err)
 		}
 
 		// Retrieve the secret
-		retrievedSecret, err := GetSecret()
+		retrievedSecret, err := store.Get(RecoveryKeySecret)
 		assert.NoError(t, err)
 		assert.Equal(t, testSecret, retrievedSecret)
 
 		// Clean up
-		err = DeleteSecret()
+		err = store.Delete(RecoveryKeySecret)
 		assert.NoError(t, err)
 	})
 
 	t.Run("get nonexistent secret", func(t *testing.T) {
 		// Clean up any existing secret first
-		_ = DeleteSecret() // Ignore error if nothing exists
+		_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
 
 		// Try to get a secret that doesn't exist
-		_, err := GetSecret()
+		_, err := store.Get(RecoveryKeySecret)
 		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "could not find")
+		assert.ErrorIs(t, err, ErrSecretNotFound)
 	})
 
 	t.Run("add empty secret", func(t *testing.T) {
 		// Try to add an empty secret
-		err := AddSecret("")
+		err := store.Set(RecoveryKeySecret, "")
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "secret cannot be empty")
 	})
 
 	t.Run("add whitespace-only secret", func(t *testing.T) {
 		// Try to add a whitespace-only secret
-		err := AddSecret("   \n\t  ")
+		err := store.Set(RecoveryKeySecret, "   \n\t  ")
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "secret cannot be empty")
 	})
 
 	t.Run("delete nonexistent secret", func(t *testing.T) {
 		// Clean up any existing secret first
-		_ = DeleteSecret() // Ignore error if nothing exists
+		_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
 
 		// Try to delete a secret that doesn't exist
-		err := DeleteSecret()
+		err := store.Delete(RecoveryKeySecret)
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "failed to delete")
+		assert.ErrorIs(t, err, ErrSecretNotFound)
 	})
 
 	t.Run("update existing secret", func(t *testing.T) {
 		// Clean up any existing test secret first
-		_ = DeleteSecret() // Ignore error if nothing exists
+		_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
 
 		const firstSecret = "first-test-secret"
 		const secondSecret = "second-test-secret"
 
 		// Add first secret
-		err := AddSecret(firstSecret)
+		err := store.Set(RecoveryKeySecret, firstSecret)
 		if err != nil {
 			t.Skipf("Skipping keychain test - keychain not available: %v", err)
 		}
 
-		// Try to add second secret (should fail because item already exists)
-		err = AddSecret(secondSecret)
-		assert.Error(t, err)
+		// Setting it again replaces the existing item
+		err = store.Set(RecoveryKeySecret, secondSecret)
+		assert.NoError(t, err)
 
-		// Verify first secret is still there
-		retrievedSecret, err := GetSecret()
+		retrievedSecret, err := store.Get(RecoveryKeySecret)
 		assert.NoError(t, err)
-		assert.Equal(t, firstSecret, retrievedSecret)
+		assert.Equal(t, secondSecret, retrievedSecret)
 
 		// Clean up
-		err = DeleteSecret()
+		err = store.Delete(RecoveryKeySecret)
 		assert.NoError(t, err)
 	})
 }
@@ -101,24 +103,51 @@ func TestKeychainWithTrimming(t *testing.T) {
 	// Test that secrets are properly trimmed before storage
 	const secretWithWhitespace = "  test-secret-with-whitespace  \n"
 	const expectedSecret = "test-secret-with-whitespace"
+	store := NewKeychainSecretStore()
 
 	t.Run("secret trimming", func(t *testing.T) {
 		// Clean up any existing test secret first
-		_ = DeleteSecret() // Ignore error if nothing exists
+		_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
 
 		// Add secret with whitespace
-		err := AddSecret(secretWithWhitespace)
+		err := store.Set(RecoveryKeySecret, secretWithWhitespace)
 		if err != nil {
 			t.Skipf("Skipping keychain test - keychain not available: %v", err)
 		}
 
 		// Retrieve and verify it was trimmed
-		retrievedSecret, err := GetSecret()
+		retrievedSecret, err := store.Get(RecoveryKeySecret)
 		assert.NoError(t, err)
 		assert.Equal(t, expectedSecret, retrievedSecret)
 
 		// Clean up
-		err = DeleteSecret()
+		err = store.Delete(RecoveryKeySecret)
 		assert.NoError(t, err)
 	})
 }
+
+func TestKeychainMetadata(t *testing.T) {
+	store := NewKeychainSecretStore()
+	_ = store.Delete(RecoveryKeySecret) // Ignore error if nothing exists
+
+	err := store.Set(RecoveryKeySecret, "test-recovery-key-12345")
+	if err != nil {
+		t.Skipf("Skipping keychain test - keychain not available: %v", err)
+	}
+	defer store.Delete(RecoveryKeySecret) //nolint:errcheck
+
+	metadata := SecretMetadata{
+		Fingerprint:      "0123456789abcdef",
+		EnabledUser:      "jappleseed",
+		LastEscrow:       time.Now().UTC().Truncate(time.Second),
+		LastEscrowServer: "https://crypt.example.com/checkin/",
+	}
+	assert.NoError(t, store.SetMetadata(RecoveryKeySecret, metadata))
+
+	secret, err := store.GetSecret(RecoveryKeySecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-recovery-key-12345", secret.Value)
+	assert.Equal(t, metadata.Fingerprint, secret.Metadata.Fingerprint)
+	assert.True(t, metadata.LastEscrow.Equal(secret.Metadata.LastEscrow))
+	assert.False(t, secret.Modified.IsZero())
+}
@@ -0,0 +1,10 @@
+package utils
+
+// OrDash returns s, or "-" if s is empty, for columns in tables printed for
+// people.
+func OrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,22 @@
+package utils
+
+import "testing"
+
+func TestOrDash(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "empty string", s: "", want: "-"},
+		{name: "non-empty string", s: "23E224", want: "23E224"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OrDash(tt.s); got != tt.want {
+				t.Errorf("OrDash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
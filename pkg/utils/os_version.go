@@ -12,3 +12,13 @@ func GetOSVersion(runner CmdRunner) (string, error) {
 
 	return strings.TrimSpace(string(out)), nil
 }
+
+// GetOSBuild returns the macOS build, such as 23E224.
+func GetOSBuild(runner CmdRunner) (string, error) {
+	out, err := runner.RunCmd("/usr/bin/sw_vers", "-buildVersion")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
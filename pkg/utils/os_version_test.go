@@ -44,3 +44,12 @@ func TestGetOSVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestGetOSBuild(t *testing.T) {
+	got, err := GetOSBuild(MockCmdRunner{Output: "23E224\n"})
+	require.NoError(t, err)
+	require.Equal(t, "23E224", got)
+
+	_, err = GetOSBuild(MockCmdRunner{Err: errors.New("command error")})
+	require.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RecoveryKeySecret is the name the FileVault recovery key is stored under.
+// It matches the label the authorization plugin gives the keychain item.
+const RecoveryKeySecret = "com.grahamgilbert.crypt.recovery"
+
+// ErrSecretNotFound is returned, possibly wrapped, by SecretStore.Get when
+// there is no secret with the given name.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore stores secrets, such as the recovery key, by name.
+type SecretStore interface {
+	// Set stores secret under name, replacing any existing secret.
+	Set(name string, secret string) error
+	// Get returns the secret stored under name.
+	Get(name string) (string, error)
+	// GetSecret returns the secret stored under name with its metadata.
+	GetSecret(name string) (Secret, error)
+	// SetMetadata replaces the metadata of the secret stored under name.
+	SetMetadata(name string, metadata SecretMetadata) error
+	// Delete removes the secret stored under name.
+	Delete(name string) error
+}
+
+// SecretMetadata describes a stored recovery key and when it was escrowed.
+type SecretMetadata struct {
+	Fingerprint      string    `json:"fingerprint,omitempty"`
+	EnabledUser      string    `json:"enabled_user,omitempty"`
+	EnabledDate      string    `json:"enabled_date,omitempty"`
+	LastEscrow       time.Time `json:"last_escrow,omitempty"`
+	LastEscrowServer string    `json:"last_escrow_server,omitempty"`
+}
+
+// Comment returns a human readable summary of the metadata.
+func (m SecretMetadata) Comment() string {
+	if m.LastEscrow.IsZero() {
+		return "FileVault recovery key generated by Crypt. Do NOT Delete! Not escrowed yet."
+	}
+	return fmt.Sprintf("FileVault recovery key generated by Crypt. Do NOT Delete! Last escrowed to %s at %s.",
+		m.LastEscrowServer, m.LastEscrow.UTC().Format(time.RFC3339))
+}
+
+// Secret is a stored secret with its metadata.
+type Secret struct {
+	Value    string
+	Metadata SecretMetadata
+	// Modified is when the secret or its metadata last changed.
+	Modified time.Time
+}
+
+// MemorySecretStore is a SecretStore that only keeps secrets in memory. It is
+// meant for tests.
+type MemorySecretStore struct {
+	mu      sync.Mutex
+	secrets map[string]Secret
+}
+
+// NewMemorySecretStore returns an empty MemorySecretStore.
+func NewMemorySecretStore() *MemorySecretStore {
+	return &MemorySecretStore{secrets: map[string]Secret{}}
+}
+
+// Set stores secret under name, keeping any existing metadata.
+func (m *MemorySecretStore) Set(name string, secret string) error {
+	if secret == "" {
+		return errors.New("secret cannot be empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.secrets[name]
+	stored.Value = secret
+	stored.Modified = time.Now()
+	m.secrets[name] = stored
+	return nil
+}
+
+// Get returns the secret stored under name.
+func (m *MemorySecretStore) Get(name string) (string, error) {
+	secret, err := m.GetSecret(name)
+	return secret.Value, err
+}
+
+// GetSecret returns the secret stored under name with its metadata.
+func (m *MemorySecretStore) GetSecret(name string) (Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, ok := m.secrets[name]
+	if !ok {
+		return Secret{}, errors.Wrapf(ErrSecretNotFound, "could not find %v", name)
+	}
+	return secret, nil
+}
+
+// SetMetadata replaces the metadata of the secret stored under name.
+func (m *MemorySecretStore) SetMetadata(name string, metadata SecretMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, ok := m.secrets[name]
+	if !ok {
+		return errors.Wrapf(ErrSecretNotFound, "could not find %v", name)
+	}
+	secret.Metadata = metadata
+	secret.Modified = time.Now()
+	m.secrets[name] = secret
+	return nil
+}
+
+// Delete removes the secret stored under name.
+func (m *MemorySecretStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.secrets[name]; !ok {
+		return errors.Wrapf(ErrSecretNotFound, "failed to delete %v", name)
+	}
+	delete(m.secrets, name)
+	return nil
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const secretKeySize = 32
+
+// FileSecretStore is a SecretStore that keeps secrets in a single file, each
+// encrypted with AES-256-GCM. The key is kept in a separate file that is
+// created the first time a secret is stored. Both files are only readable by
+// their owner.
+type FileSecretStore struct {
+	path    string
+	keyPath string
+	mu      sync.Mutex
+}
+
+type secretFile struct {
+	// Secrets maps names to the nonce followed by the sealed secret. The
+	// name is authenticated with the secret so entries cannot be swapped.
+	Secrets map[string][]byte `json:"secrets"`
+	// Metadata is not encrypted as it describes, but never contains, the
+	// secrets.
+	Metadata map[string]SecretMetadata `json:"metadata,omitempty"`
+	Modified map[string]time.Time      `json:"modified,omitempty"`
+}
+
+// NewFileSecretStore returns a FileSecretStore that stores secrets at path
+// using the key at keyPath.
+func NewFileSecretStore(path string, keyPath string) *FileSecretStore {
+	return &FileSecretStore{path: path, keyPath: keyPath}
+}
+
+// Set stores secret under name.
+func (f *FileSecretStore) Set(name string, secret string) error {
+	if secret == "" {
+		return errors.New("secret cannot be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	aead, err := f.cipher(true)
+	if err != nil {
+		return err
+	}
+	file, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "failed to generate nonce")
+	}
+	file.Secrets[name] = aead.Seal(nonce, nonce, []byte(secret), []byte(name))
+	file.Modified[name] = time.Now()
+
+	return f.save(file)
+}
+
+// Get returns the secret stored under name.
+func (f *FileSecretStore) Get(name string) (string, error) {
+	secret, err := f.GetSecret(name)
+	return secret.Value, err
+}
+
+// GetSecret returns the secret stored under name with its metadata.
+func (f *FileSecretStore) GetSecret(name string) (Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := f.load()
+	if err != nil {
+		return Secret{}, err
+	}
+	sealed, ok := file.Secrets[name]
+	if !ok {
+		return Secret{}, errors.Wrapf(ErrSecretNotFound, "could not find %v in %v", name, f.path)
+	}
+
+	aead, err := f.cipher(false)
+	if err != nil {
+		return Secret{}, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return Secret{}, errors.Errorf("secret %v in %v is truncated", name, f.path)
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to decrypt %v", name)
+	}
+	return Secret{Value: string(secret), Metadata: file.Metadata[name], Modified: file.Modified[name]}, nil
+}
+
+// SetMetadata replaces the metadata of the secret stored under name.
+func (f *FileSecretStore) SetMetadata(name string, metadata SecretMetadata) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := file.Secrets[name]; !ok {
+		return errors.Wrapf(ErrSecretNotFound, "could not find %v in %v", name, f.path)
+	}
+	file.Metadata[name] = metadata
+	file.Modified[name] = time.Now()
+	return f.save(file)
+}
+
+// Delete removes the secret stored under name.
+func (f *FileSecretStore) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := file.Secrets[name]; !ok {
+		return errors.Wrapf(ErrSecretNotFound, "failed to delete %v from %v", name, f.path)
+	}
+	delete(file.Secrets, name)
+	delete(file.Metadata, name)
+	delete(file.Modified, name)
+	return f.save(file)
+}
+
+// cipher returns the AEAD for the store's key, generating the key first if
+// create is true and there isn't one yet.
+func (f *FileSecretStore) cipher(create bool) (cipher.AEAD, error) {
+	key, err := os.ReadFile(f.keyPath)
+	if os.IsNotExist(err) && create {
+		key = make([]byte, secretKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "failed to generate key")
+		}
+		if err := os.MkdirAll(filepath.Dir(f.keyPath), 0700); err != nil {
+			return nil, errors.Wrap(err, "failed to create key directory")
+		}
+		if err := WriteFileAtomic(f.keyPath, key, 0600); err != nil {
+			return nil, errors.Wrap(err, "failed to write key")
+		}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read key")
+	}
+	if len(key) != secretKeySize {
+		return nil, errors.Errorf("key in %v is %d bytes, expected %d", f.keyPath, len(key), secretKeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *FileSecretStore) load() (secretFile, error) {
+	file := secretFile{
+		Secrets:  map[string][]byte{},
+		Metadata: map[string]SecretMetadata{},
+		Modified: map[string]time.Time{},
+	}
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return file, errors.Wrapf(err, "failed to read %v", f.path)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, errors.Wrapf(err, "failed to parse %v", f.path)
+	}
+	if file.Secrets == nil {
+		file.Secrets = map[string][]byte{}
+	}
+	if file.Metadata == nil {
+		file.Metadata = map[string]SecretMetadata{}
+	}
+	if file.Modified == nil {
+		file.Modified = map[string]time.Time{}
+	}
+	return file, nil
+}
+
+func (f *FileSecretStore) save(file secretFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode secrets")
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create secrets directory")
+	}
+	return WriteFileAtomic(f.path, data, 0600)
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) SecretStore{
+		"memory": func(t *testing.T) SecretStore {
+			return NewMemorySecretStore()
+		},
+		"file": func(t *testing.T) SecretStore {
+			dir := t.TempDir()
+			return NewFileSecretStore(filepath.Join(dir, "secrets.json"), filepath.Join(dir, "secrets.key"))
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+
+			_, err := s.Get(RecoveryKeySecret)
+			assert.ErrorIs(t, err, ErrSecretNotFound)
+			assert.ErrorIs(t, s.Delete(RecoveryKeySecret), ErrSecretNotFound)
+			assert.Error(t, s.Set(RecoveryKeySecret, ""))
+
+			require.NoError(t, s.Set(RecoveryKeySecret, "ABCD-EFGH"))
+			require.NoError(t, s.Set("api-token", "token"))
+			secret, err := s.Get(RecoveryKeySecret)
+			require.NoError(t, err)
+			assert.Equal(t, "ABCD-EFGH", secret)
+
+			require.NoError(t, s.Set(RecoveryKeySecret, "IJKL-MNOP"))
+			secret, err = s.Get(RecoveryKeySecret)
+			require.NoError(t, err)
+			assert.Equal(t, "IJKL-MNOP", secret)
+
+			require.NoError(t, s.Delete(RecoveryKeySecret))
+			_, err = s.Get(RecoveryKeySecret)
+			assert.ErrorIs(t, err, ErrSecretNotFound)
+
+			token, err := s.Get("api-token")
+			require.NoError(t, err)
+			assert.Equal(t, "token", token)
+		})
+
+		t.Run(name+" metadata", func(t *testing.T) {
+			s := newStore(t)
+			metadata := SecretMetadata{
+				Fingerprint:      "0123456789abcdef",
+				EnabledUser:      "jappleseed",
+				EnabledDate:      "2024-01-02 03:04:05 +0000",
+				LastEscrow:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				LastEscrowServer: "https://crypt.example.com/checkin/",
+			}
+
+			assert.ErrorIs(t, s.SetMetadata(RecoveryKeySecret, metadata), ErrSecretNotFound)
+
+			require.NoError(t, s.Set(RecoveryKeySecret, "ABCD-EFGH"))
+			require.NoError(t, s.SetMetadata(RecoveryKeySecret, metadata))
+
+			secret, err := s.GetSecret(RecoveryKeySecret)
+			require.NoError(t, err)
+			assert.Equal(t, "ABCD-EFGH", secret.Value)
+			assert.Equal(t, metadata.Fingerprint, secret.Metadata.Fingerprint)
+			assert.True(t, metadata.LastEscrow.Equal(secret.Metadata.LastEscrow))
+			assert.Equal(t, metadata.LastEscrowServer, secret.Metadata.LastEscrowServer)
+			assert.False(t, secret.Modified.IsZero())
+
+			// replacing the secret keeps its metadata
+			require.NoError(t, s.Set(RecoveryKeySecret, "IJKL-MNOP"))
+			secret, err = s.GetSecret(RecoveryKeySecret)
+			require.NoError(t, err)
+			assert.Equal(t, "jappleseed", secret.Metadata.EnabledUser)
+		})
+	}
+}
+
+func TestSecretMetadataComment(t *testing.T) {
+	assert.Contains(t, SecretMetadata{}.Comment(), "Not escrowed yet")
+
+	comment := SecretMetadata{
+		LastEscrow:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		LastEscrowServer: "https://crypt.example.com/checkin/",
+	}.Comment()
+	assert.Contains(t, comment, "Do NOT Delete!")
+	assert.Contains(t, comment, "https://crypt.example.com/checkin/ at 2024-01-02T03:04:05Z")
+}
+
+func TestFileSecretStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crypt", "secrets.json")
+	keyPath := filepath.Join(dir, "crypt", "secrets.key")
+	s := NewFileSecretStore(path, keyPath)
+
+	require.NoError(t, s.Set(RecoveryKeySecret, "ABCD-EFGH"))
+
+	t.Run("files are private and encrypted", func(t *testing.T) {
+		for _, p := range []string{path, keyPath} {
+			info, err := os.Stat(p)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "ABCD-EFGH")
+	})
+
+	t.Run("secrets survive a new store", func(t *testing.T) {
+		secret, err := NewFileSecretStore(path, keyPath).Get(RecoveryKeySecret)
+		require.NoError(t, err)
+		assert.Equal(t, "ABCD-EFGH", secret)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other := NewFileSecretStore(filepath.Join(dir, "other.json"), filepath.Join(dir, "other.key"))
+		require.NoError(t, other.Set("unused", "unused"))
+
+		_, err := NewFileSecretStore(path, filepath.Join(dir, "other.key")).Get(RecoveryKeySecret)
+		assert.Error(t, err)
+	})
+
+	t.Run("entries cannot be swapped", func(t *testing.T) {
+		require.NoError(t, s.Set("api-token", "token"))
+		file, err := s.load()
+		require.NoError(t, err)
+		file.Secrets["api-token"] = file.Secrets[RecoveryKeySecret]
+		require.NoError(t, s.save(file))
+
+		_, err = s.Get("api-token")
+		assert.Error(t, err)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := NewFileSecretStore(path, filepath.Join(dir, "missing.key")).Get(RecoveryKeySecret)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInsecureFile is returned by ReadFileSecure when a file is not safe to
+// trust.
+var ErrInsecureFile = errors.New("insecure file")
+
+// ReadFileSecure reads the regular file at path. It refuses to follow a
+// symlink, and to read a file that is not owned by uid or that can be written
+// by its group or by everyone, returning an error wrapping ErrInsecureFile.
+// The checks are made on the opened file, so the file cannot be swapped
+// between the checks and the read.
+func ReadFileSecure(path string, uid int) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, errors.Wrapf(ErrInsecureFile, "%v is a symlink", path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %v", path)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.Wrapf(ErrInsecureFile, "%v is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0022 != 0 {
+		return nil, errors.Wrapf(ErrInsecureFile, "%v is writable by group or others (mode %04o)", path, perm)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != uid {
+		return nil, errors.Wrapf(ErrInsecureFile, "%v is owned by uid %d, expected %d", path, stat.Uid, uid)
+	}
+
+	return io.ReadAll(f)
+}
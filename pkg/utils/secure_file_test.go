@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFileSecure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crypt_output.plist")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+	link := filepath.Join(dir, "link.plist")
+	require.NoError(t, os.Symlink(path, link))
+	writable := filepath.Join(dir, "writable.plist")
+	require.NoError(t, os.WriteFile(writable, []byte("data"), 0600))
+	require.NoError(t, os.Chmod(writable, 0666))
+
+	tests := []struct {
+		name     string
+		path     string
+		uid      int
+		insecure bool
+	}{
+		{name: "owned and private", path: path, uid: os.Getuid()},
+		{name: "symlink", path: link, uid: os.Getuid(), insecure: true},
+		{name: "world writable", path: writable, uid: os.Getuid(), insecure: true},
+		{name: "wrong owner", path: path, uid: os.Getuid() + 1, insecure: true},
+		{name: "directory", path: dir, uid: os.Getuid(), insecure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ReadFileSecure(tt.path, tt.uid)
+			if tt.insecure {
+				assert.ErrorIs(t, err, ErrInsecureFile)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+		})
+	}
+
+	_, err := ReadFileSecure(filepath.Join(dir, "missing.plist"), os.Getuid())
+	assert.True(t, os.IsNotExist(err))
+}